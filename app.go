@@ -2,8 +2,13 @@ package tlock
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"sort"
@@ -16,38 +21,127 @@ import (
 	"github.com/siddontang/goredis"
 )
 
-var errLockTimeout = errors.New("lock timeout")
-
 type App struct {
 	m sync.Mutex
 
+	cfg *Config
+
 	wg sync.WaitGroup
+	// the RESP connections, Shutdown waits them to release their locks
+	connsWG sync.WaitGroup
 
 	httpListener net.Listener
+	httpServer   *http.Server
 	respListener net.Listener
 
-	keyLockerGroup  *KeyLockerGroup
-	pathLockerGroup *PathLockerGroup
+	keyLockerGroup   *KeyLockerGroup
+	pathLockerGroup  *PathLockerGroup
+	rangeLockerGroup *RangeLockerGroup
 
-	locksMutex sync.Mutex
-	locks      map[uint64]*lockInfo
+	// path locker groups with custom separator or raw mode
+	pathGroupsMutex  sync.RWMutex
+	pathLockerGroups map[pathGroupKey]*PathLockerGroup
+
+	locks *lockRegistry
+	index *lockIndex
 
 	lockIDCounter uint32
+
+	leasesMutex sync.Mutex
+	leases      map[uint64]*lease
+
+	// the transfers by the token, and the tokens by the lock id
+	transfersMutex sync.Mutex
+	transfers      map[string]*transfer
+	transferLocks  map[uint64]string
+	transferCount  int32
+
+	// set when the app is shutting down, no lock or lease is granted then
+	shuttingDown int32
+
+	connsMutex sync.Mutex
+	conns      map[net.Conn]*respConn
+
+	// nil disables the audit log
+	audit AuditSink
+
+	watches *watchHub
+}
+
+// LockOptions are the optional arguments for a lock
+type LockOptions struct {
+	// wait timeout, zero means InfiniteTimeout
+	Timeout time.Duration
+
+	// lease id, zero means no lease
+	Lease uint64
+
+	// the ttl of a detached lock, zero means not detached. A detached lock
+	// has its own lease with the lock id, and is not released when its RESP
+	// connection is closed, renew or revoke the lease with the lock id.
+	Detach time.Duration
+
+	// the lock is tied to the lease only, and not released when its RESP
+	// connection is closed, so many locks of a session can be held over
+	// a few pooled connections.
+	Session bool
+
+	// for path lock only, see PathLockerGroupConfig,
+	// paths with different separators or raw modes never conflict.
+	Separator string
+	Raw       bool
+
+	// for path lock only, the default is LockModeX
+	Mode LockMode
+
+	// who holds the lock, like a hostname or a job, for the audit log
+	Owner string
+
+	// the remote address of the client, set by the RESP and HTTP servers
+	Client string
+}
+
+// checkLease checks the lease, detach and session options are not mixed
+func (o *LockOptions) checkLease() error {
+	if o.Detach > 0 && o.Lease != 0 {
+		return invalidArgumentf("a detached lock can not have a lease")
+	}
+	if o.Session && o.Lease == 0 {
+		return invalidArgumentf("a session lock must have a lease")
+	}
+	return nil
+}
+
+// bound returns true if the lock is released when its RESP connection is closed
+func (o *LockOptions) bound() bool {
+	return o.Detach == 0 && !o.Session
+}
+
+type pathGroupKey struct {
+	sep string
+	raw bool
 }
 
 type lockInfo struct {
 	id         uint64
 	names      []string
 	tp         string
+	group      LockerGroup
+	opts       LockOptions
 	createTime time.Time
+
+	// the duration waiting for the lock
+	wait time.Duration
 }
 
-func newLockInfo(id uint64, tp string, names []string) *lockInfo {
+func newLockInfo(id uint64, tp string, group LockerGroup, names []string, opts LockOptions) *lockInfo {
 	l := new(lockInfo)
 
 	l.id = id
 	l.names = names
 	l.tp = tp
+	l.group = group
+	l.opts = opts
 	l.createTime = time.Now()
 
 	return l
@@ -68,12 +162,33 @@ func (s lockInfos) Less(i, j int) bool {
 }
 
 func NewApp() *App {
-	a := new(App)
+	return NewAppWithConfig(NewConfig())
+}
 
-	a.keyLockerGroup = NewKeyLockerGroup()
-	a.pathLockerGroup = NewPathLockerGroup()
+// NewAppWithConfig creates the app with the config, the listen addresses
+// in the config are not used, use StartRESP and StartHTTP to listen.
+func NewAppWithConfig(cfg *Config) *App {
+	a := new(App)
 
-	a.locks = make(map[uint64]*lockInfo, 1024)
+	a.cfg = cfg
+
+	// keys conflict with the ranges containing them
+	a.rangeLockerGroup = NewRangeLockerGroup()
+	a.keyLockerGroup = NewKeyLockerGroupWithConfig(KeyLockerGroupConfig{
+		Ranges:   a.rangeLockerGroup,
+		SlotSize: cfg.KeySlotSize,
+	})
+	a.pathLockerGroup = NewPathLockerGroupWithConfig(PathLockerGroupConfig{SlotSize: cfg.PathSlotSize})
+	a.pathLockerGroups = make(map[pathGroupKey]*PathLockerGroup)
+	a.pathLockerGroups[pathGroupKey{defaultPathSeparator, false}] = a.pathLockerGroup
+
+	a.index = newLockIndex()
+	a.locks = newLockRegistry(a.index)
+	a.conns = make(map[net.Conn]*respConn)
+	a.watches = newWatchHub()
+	a.leases = make(map[uint64]*lease, 1024)
+	a.transfers = make(map[string]*transfer)
+	a.transferLocks = make(map[uint64]string)
 
 	return a
 }
@@ -83,30 +198,53 @@ func (a *App) StartHTTP(addr string) error {
 	defer a.m.Unlock()
 
 	var err error
-	a.httpListener, err = net.Listen("tcp", addr)
+	a.httpListener, err = a.listen(addr, a.cfg.TLS.enabled())
 	if err != nil {
 		return err
 	}
 
+	mux := http.NewServeMux()
+	mux.Handle("/lock", a.newLockHandler())
+	mux.Handle("/lock/watch", a.newWatchHandler())
+	mux.Handle("/lock/wait", a.newWaitHandler())
+	mux.Handle("/lock/status", a.newStatusHandler())
+	mux.Handle("/lock/extend", a.newExtendHandler(false))
+	mux.Handle("/lock/shrink", a.newExtendHandler(true))
+	mux.Handle("/lock/transfer", a.newTransferHandler(false))
+	mux.Handle("/lock/redeem", a.newTransferHandler(true))
+	mux.Handle("/lease", a.newLeaseHandler())
+
+	// Shutdown uses the server to finish the requests in flight
+	a.httpServer = &http.Server{Handler: a.newAuthHandler(mux)}
+
 	a.wg.Add(1)
 	go func() {
 		defer a.wg.Done()
 
-		mux := http.NewServeMux()
-		mux.Handle("/lock", a.newLockHandler())
-
-		http.Serve(a.httpListener, mux)
-
+		a.httpServer.Serve(a.httpListener)
 	}()
 	return nil
 }
 
+func (a *App) listen(addr string, useTLS bool) (net.Listener, error) {
+	if !useTLS {
+		return net.Listen("tcp", addr)
+	}
+
+	cert, err := tls.LoadX509KeyPair(a.cfg.TLS.CertFile, a.cfg.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+}
+
 func (a *App) StartRESP(addr string) error {
 	a.m.Lock()
 	defer a.m.Unlock()
 
 	var err error
-	a.respListener, err = net.Listen("tcp", addr)
+	a.respListener, err = a.listen(addr, a.cfg.TLS.RESP)
 	if err != nil {
 		return err
 	}
@@ -121,7 +259,12 @@ func (a *App) StartRESP(addr string) error {
 				return
 			}
 
-			go a.handleRESP(conn)
+			a.connsWG.Add(1)
+			go func() {
+				defer a.connsWG.Done()
+
+				a.handleRESP(conn)
+			}()
 		}
 
 	}()
@@ -140,9 +283,157 @@ func (a *App) Close() {
 		a.respListener.Close()
 	}
 
+	a.watches.close()
+
 	a.wg.Wait()
 }
 
+// Shutdown stops the app gracefully, it closes the listeners and grants no
+// new lock or lease, the new requests get ErrShuttingDown, and the HTTP
+// requests in flight are finished. Then it waits the RESP connections to
+// release the locks bound to them until the context is done, and closes the
+// remaining RESP connections, whose locks are released before it returns. The locks not
+// bound to a connection, like the HTTP, detached and session locks, are not
+// waited, no disconnect can release them.
+// It returns the context error if some locks are not released in time.
+func (a *App) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&a.shuttingDown, 1)
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	httpDone := make(chan error, 1)
+	if a.httpServer != nil {
+		go func() {
+			httpDone <- a.httpServer.Shutdown(ctx)
+		}()
+	} else {
+		httpDone <- nil
+	}
+
+	if a.respListener != nil {
+		a.respListener.Close()
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	var err error
+	for a.boundLocks() > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	// the watch streams never finish themselves
+	a.watches.close()
+
+	if e := <-httpDone; e != nil {
+		// cut the requests not finished in time
+		a.httpServer.Close()
+		if err == nil {
+			err = e
+		}
+	}
+
+	a.connsMutex.Lock()
+	for c, _ := range a.conns {
+		c.Close()
+	}
+	a.connsMutex.Unlock()
+
+	a.wg.Wait()
+
+	// no connection is accepted now, wait the closed ones to release
+	// and audit their locks, the audit sink may be closed after we return
+	a.connsWG.Wait()
+
+	return err
+}
+
+// boundLocks returns the number of the locks bound to the RESP connections
+func (a *App) boundLocks() int {
+	a.connsMutex.Lock()
+	defer a.connsMutex.Unlock()
+
+	n := 0
+	for _, rc := range a.conns {
+		for _, id := range rc.boundIDs() {
+			// may be released in other ways, like unlocked by others
+			if _, ok := a.locks.Get(id); ok {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// unbindLock unbinds the lock from the RESP connection bound to it, so the
+// disconnect does not release it any more.
+func (a *App) unbindLock(id uint64) {
+	a.connsMutex.Lock()
+	defer a.connsMutex.Unlock()
+
+	for _, rc := range a.conns {
+		rc.unbind(id)
+	}
+}
+
+// respConn is the state of a RESP connection
+type respConn struct {
+	m sync.Mutex
+
+	// the locks released when the connection is closed
+	lockIDs map[uint64]struct{}
+}
+
+func newRESPConn() *respConn {
+	c := new(respConn)
+	c.lockIDs = make(map[uint64]struct{})
+	return c
+}
+
+func (c *respConn) bind(id uint64) {
+	c.m.Lock()
+	c.lockIDs[id] = struct{}{}
+	c.m.Unlock()
+}
+
+func (c *respConn) unbind(id uint64) {
+	c.m.Lock()
+	delete(c.lockIDs, id)
+	c.m.Unlock()
+}
+
+func (c *respConn) boundIDs() []uint64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	ids := make([]uint64, 0, len(c.lockIDs))
+	for id := range c.lockIDs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// requestTimeout returns the timeout of a RESP or HTTP lock request, zero
+// uses the default timeout, and the timeout is truncated to the max timeout.
+func (a *App) requestTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return a.cfg.DefaultTimeout.Duration
+	}
+	if timeout > a.cfg.MaxTimeout.Duration {
+		return a.cfg.MaxTimeout.Duration
+	}
+	return timeout
+}
+
+func (a *App) isShuttingDown() bool {
+	return atomic.LoadInt32(&a.shuttingDown) == 1
+}
+
 func (a *App) HTTPAddr() net.Addr {
 	if a.httpListener == nil {
 		return nil
@@ -174,60 +465,228 @@ func (a *App) Lock(tp string, names []string) (uint64, error) {
 
 // Lock with timeout and returns a lock id, you must use this id to unlock
 func (a *App) LockTimeout(tp string, timeout time.Duration, names []string) (uint64, error) {
+	return a.LockLease(tp, timeout, 0, names)
+}
+
+// Lock with timeout under the lease and returns a lock id, the lock is
+// released when the lease expires or is revoked. A zero lease means no lease.
+func (a *App) LockLease(tp string, timeout time.Duration, leaseID uint64, names []string) (uint64, error) {
+	return a.LockWithOptions(tp, names, LockOptions{Timeout: timeout, Lease: leaseID})
+}
+
+// Lock with options and returns a lock id, you must use this id to unlock
+func (a *App) LockWithOptions(tp string, names []string, opts LockOptions) (uint64, error) {
 	if len(names) == 0 {
-		return 0, fmt.Errorf("empty lock names")
+		return 0, invalidArgumentf("empty lock names")
+	}
+
+	if a.isShuttingDown() {
+		return 0, ErrShuttingDown
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = InfiniteTimeout
+	}
+
+	if err := opts.checkLease(); err != nil {
+		return 0, err
+	}
+
+	if opts.Lease != 0 && !a.leaseExists(opts.Lease) {
+		return 0, ErrLeaseNotFound
 	}
 
-	var b bool
-	var err error
 	tp = strings.ToLower(tp)
+	group, err := a.lockGroup(tp, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if err := group.LockTimeout(opts.Timeout, names...); err != nil {
+		if errors.Is(err, ErrLockTimeout) {
+			l := newLockInfo(0, tp, group, names, opts)
+			l.wait = time.Since(start)
+			a.lockEvent(AuditTimeout, l)
+		}
+		return 0, err
+	}
+
+	if a.isShuttingDown() {
+		// we waited the lock when shutting down
+		group.Unlock(names...)
+		return 0, ErrShuttingDown
+	}
+
+	id := a.genLockID()
+	if opts.Detach > 0 {
+		opts.Lease = id
+	}
+
+	l := newLockInfo(id, tp, group, names, opts)
+	l.wait = l.createTime.Sub(start)
+
+	a.locks.Add(l)
+
+	if opts.Detach > 0 {
+		a.grantDetachedLease(id, opts.Detach)
+	} else if opts.Lease != 0 {
+		// the lease may expire when we wait the lock
+		if err := a.attachLease(opts.Lease, id); err != nil {
+			a.unlock(id, "")
+			return 0, err
+		}
+	}
+
+	a.lockEvent(AuditGrant, l)
+
+	return id, nil
+}
+
+// lockGroup returns the locker group for the lock type and options
+func (a *App) lockGroup(tp string, opts LockOptions) (LockerGroup, error) {
+	var group LockerGroup
 	switch tp {
 	case KeyLockType:
-		b, err = a.keyLockerGroup.LockTimeout(timeout, names...), nil
+		group = a.keyLockerGroup
 	case PathLockType:
-		b, err = a.pathLockerGroup.LockTimeout(timeout, names...), nil
+		group = &pathModeLockerGroup{a.getPathLockerGroup(opts.Separator, opts.Raw), opts.Mode}
+	case GlobLockType:
+		group = &globLockerGroup{a.getPathLockerGroup(opts.Separator, opts.Raw)}
+	case RangeLockType:
+		group = a.rangeLockerGroup
 	default:
-		return 0, fmt.Errorf("invalid lock type %s", tp)
+		return nil, invalidTypef(tp)
 	}
-	if !b {
-		return 0, errLockTimeout
-	} else if err != nil {
-		return 0, err
+
+	if opts.Mode != LockModeX && tp != PathLockType {
+		return nil, invalidArgumentf("lock mode %s is only for path lock", opts.Mode)
 	}
 
-	id := a.genLockID()
-	l := newLockInfo(id, tp, names)
+	return group, nil
+}
 
-	a.locksMutex.Lock()
-	a.locks[id] = l
-	a.locksMutex.Unlock()
-	return id, nil
+// WaitFree waits until none of the names is locked at a moment without
+// locking them, tp is key, path or range, opts Timeout, Separator and Raw
+// are used like LockWithOptions, returns ErrLockTimeout if the names are
+// not free before timeout, see the WaitFreeTimeout of the lock groups.
+func (a *App) WaitFree(tp string, names []string, opts LockOptions) error {
+	if len(names) == 0 {
+		return invalidArgumentf("empty names")
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = InfiniteTimeout
+	}
+
+	switch strings.ToLower(tp) {
+	case KeyLockType:
+		return a.keyLockerGroup.WaitFreeTimeout(opts.Timeout, names...)
+	case PathLockType:
+		return a.getPathLockerGroup(opts.Separator, opts.Raw).WaitFreeTimeout(opts.Timeout, names...)
+	case RangeLockType:
+		return a.rangeLockerGroup.WaitFreeTimeout(opts.Timeout, names...)
+	case GlobLockType:
+		return invalidArgumentf("can not wait %s, must be key, path or range", tp)
+	default:
+		return invalidTypef(tp)
+	}
+}
+
+func (a *App) getPathLockerGroup(sep string, raw bool) *PathLockerGroup {
+	if len(sep) == 0 {
+		sep = defaultPathSeparator
+	}
+
+	key := pathGroupKey{sep, raw}
+
+	a.pathGroupsMutex.RLock()
+	g, ok := a.pathLockerGroups[key]
+	a.pathGroupsMutex.RUnlock()
+	if ok {
+		return g
+	}
+
+	a.pathGroupsMutex.Lock()
+	defer a.pathGroupsMutex.Unlock()
+
+	g, ok = a.pathLockerGroups[key]
+	if !ok {
+		g = NewPathLockerGroupWithConfig(PathLockerGroupConfig{
+			Separator: sep,
+			Raw:       raw,
+			SlotSize:  a.cfg.PathSlotSize,
+		})
+		a.pathLockerGroups[key] = g
+	}
+	return g
 }
 
 func (a *App) Unlock(id uint64) error {
+	return a.unlock(id, AuditRelease)
+}
+
+// unlock releases the lock and audits it with the event, an empty event
+// is not audited, like rolling back a lock not granted yet.
+func (a *App) unlock(id uint64, event AuditEvent) error {
 	if id == 0 {
-		return fmt.Errorf("empty lock names")
+		return invalidArgumentf("empty lock id")
 	}
 
-	a.locksMutex.Lock()
-	l, ok := a.locks[id]
-	delete(a.locks, id)
-	a.locksMutex.Unlock()
+	l, ok := a.locks.Remove(id)
 
 	if !ok {
-		return nil
+		return ErrNotLocked
 	}
 
-	switch l.tp {
-	case KeyLockType:
-		a.keyLockerGroup.Unlock(l.names...)
-	case PathLockType:
-		a.pathLockerGroup.Unlock(l.names...)
-	default:
-		return fmt.Errorf("invalid lock type %s", l.tp)
+	a.leaveLease(l)
+	a.cancelTransfer(id)
+
+	// before releasing, so the watchers see the release of a name
+	// before the next grant of it
+	if len(event) > 0 {
+		a.lockEvent(event, l)
 	}
 
-	return nil
+	return l.group.Unlock(l.names...)
+}
+
+// SetAuditSink sets the sink of the audit log, nil disables it,
+// it must be called before starting the app, the app does not close it.
+func (a *App) SetAuditSink(sink AuditSink) {
+	a.audit = sink
+}
+
+// lockEvent writes the audit log and notifies the watchers
+func (a *App) lockEvent(event AuditEvent, l *lockInfo) {
+	if event != AuditTimeout {
+		a.watches.publish(event, l)
+	}
+
+	if a.audit == nil {
+		return
+	}
+
+	r := &AuditRecord{
+		Time:   time.Now(),
+		Event:  event,
+		ID:     l.id,
+		Type:   l.tp,
+		Names:  l.names,
+		Client: l.opts.Client,
+		Owner:  l.opts.Owner,
+		Lease:  l.opts.Lease,
+		WaitMs: durationMs(l.wait),
+	}
+
+	if event != AuditGrant && event != AuditTimeout {
+		r.HoldMs = durationMs(r.Time.Sub(l.createTime))
+	}
+
+	// the lock operation is done, so an audit error can only be logged
+	if err := a.audit.Write(r); err != nil {
+		log.Printf("audit %s lock %d: %v", event, l.id, err)
+	}
 }
 
 const timeFormat string = "2006-01-02 15:04:05"
@@ -237,19 +696,26 @@ func (a *App) dumpLockNames() []byte {
 
 	keyLocks := make(lockInfos, 0, 1024)
 	pathLocks := make(lockInfos, 0, 1024)
+	globLocks := make(lockInfos, 0, 1024)
+	rangeLocks := make(lockInfos, 0, 1024)
 
-	a.locksMutex.Lock()
-	for _, l := range a.locks {
-		if l.tp == KeyLockType {
+	for _, l := range a.locks.Snapshot() {
+		switch l.tp {
+		case KeyLockType:
 			keyLocks = append(keyLocks, l)
-		} else {
+		case GlobLockType:
+			globLocks = append(globLocks, l)
+		case RangeLockType:
+			rangeLocks = append(rangeLocks, l)
+		default:
 			pathLocks = append(pathLocks, l)
 		}
 	}
-	a.locksMutex.Unlock()
 
 	sort.Sort(keyLocks)
 	sort.Sort(pathLocks)
+	sort.Sort(globLocks)
+	sort.Sort(rangeLocks)
 
 	buf.WriteString("key lock:\n")
 	for _, l := range keyLocks {
@@ -257,15 +723,57 @@ func (a *App) dumpLockNames() []byte {
 	}
 
 	buf.WriteString("\npath lock:\n")
-	for _, l := range pathLocks {
-		buf.WriteString(fmt.Sprintf("%d %v\t%s\n", l.id, l.names, l.createTime.Format(timeFormat)))
+	dumpPathLocks(&buf, pathLocks)
+
+	buf.WriteString("\nglob lock:\n")
+	dumpPathLocks(&buf, globLocks)
+
+	buf.WriteString("\nrange lock:\n")
+	for _, l := range rangeLocks {
+		ranges := make([]string, 0, len(l.names)/2)
+		for i := 0; i+1 < len(l.names); i += 2 {
+			ranges = append(ranges, keyRange{l.names[i], l.names[i+1]}.String())
+		}
+		buf.WriteString(fmt.Sprintf("%d %v\t%s\n", l.id, ranges, l.createTime.Format(timeFormat)))
 	}
 
 	return buf.Bytes()
 }
 
-// lock name1, name2, ... [TYPE key] [TIMEOUT 60]
+func dumpPathLocks(buf *bytes.Buffer, locks lockInfos) {
+	for _, l := range locks {
+		buf.WriteString(fmt.Sprintf("%d %v\t%s", l.id, l.names, l.createTime.Format(timeFormat)))
+		if len(l.opts.Separator) > 0 && l.opts.Separator != defaultPathSeparator {
+			buf.WriteString(fmt.Sprintf("\tsep=%q", l.opts.Separator))
+		}
+		if l.opts.Raw {
+			buf.WriteString("\traw")
+		}
+		if l.opts.Mode != LockModeX {
+			buf.WriteString(fmt.Sprintf("\tmode=%s", l.opts.Mode))
+		}
+		buf.WriteString("\n")
+	}
+}
+
+// auth password
+// ping
+// lock [TYPE key] [TIMEOUT 60 | PXTIMEOUT 60000] [LEASE leaseid | SESSION leaseid | DETACH ttl] [SEP /] [RAW 0] [MODE x] [OWNER owner] NAMES name1 name2 ...
 // unlock id
+// extend id [TIMEOUT 60 | PXTIMEOUT 60000] NAMES name1 name2 ...
+// shrink id NAMES name1 name2 ...
+// transfer id TO owner|LEASE leaseid [TIMEOUT 60 | PXTIMEOUT 60000]
+// redeem token [OWNER owner]
+// grant ttl
+// renew leaseid
+// revoke leaseid
+// waitfree [TYPE key] [TIMEOUT 60 | PXTIMEOUT 60000] [SEP /] [RAW 0] NAMES name1 name2 ...
+// status [TYPE key] [SEP /] [RAW 0] NAMES name1 name2 ...
+// watch [TYPE key] [SEP /] [RAW 0] NAMES name1 name2 ...
+// unwatch
+// multi
+// exec
+// discard
 func (a *App) handleRESP(c net.Conn) {
 	conn, err := goredis.NewConn(c)
 	if err != nil {
@@ -273,12 +781,36 @@ func (a *App) handleRESP(c net.Conn) {
 		return
 	}
 
-	grapLockIDs := make(map[uint64]struct{})
+	a.connsMutex.Lock()
+	rc := newRESPConn()
+	a.conns[c] = rc
+	a.connsMutex.Unlock()
+
+	if a.isShuttingDown() {
+		// accepted before shutting down, but may be missed by Shutdown
+		a.connsMutex.Lock()
+		delete(a.conns, c)
+		a.connsMutex.Unlock()
+
+		conn.Close()
+		return
+	}
+
+	// the queued commands after MULTI, nil if not in a transaction,
+	// txErr is the error when queuing, EXEC fails with it.
+	var tx []TxOp
+	var txErr error
+
+	authed := len(a.cfg.Auth.Password) == 0
 
 	defer func() {
+		a.connsMutex.Lock()
+		delete(a.conns, c)
+		a.connsMutex.Unlock()
+
 		conn.Close()
-		for id, _ := range grapLockIDs {
-			a.Unlock(id)
+		for _, id := range rc.boundIDs() {
+			a.unlock(id, AuditForce)
 		}
 	}()
 
@@ -288,82 +820,482 @@ func (a *App) handleRESP(c net.Conn) {
 			return
 		}
 		if len(args) < 1 {
-			conn.SendValue(fmt.Errorf("empty command"))
+			conn.SendValue(respError(invalidArgumentf("empty command")))
 			continue
 		}
 
 		cmd := strings.ToUpper(string(args[0]))
 		args = args[1:]
+
+		if cmd == "AUTH" {
+			if err := a.parseRESPAuth(args); err != nil {
+				conn.SendValue(respError(err))
+			} else {
+				authed = true
+				conn.SendValue("OK")
+			}
+			continue
+		}
+
+		if !authed {
+			conn.SendValue(respError(ErrNoAuth))
+			continue
+		}
+
+		if tx != nil {
+			switch cmd {
+			case "EXEC":
+				ops, err := tx, txErr
+				tx, txErr = nil, nil
+
+				var ids []uint64
+				if err == nil {
+					ids, err = a.Exec(ops)
+				} else {
+					err = fmt.Errorf("transaction discarded because of the previous error, %w", err)
+				}
+
+				if err != nil {
+					conn.SendValue(respError(err))
+					continue
+				}
+
+				v := make([][]byte, len(ops))
+				for i, op := range ops {
+					switch op.Cmd {
+					case TxLock:
+						if op.Options.bound() {
+							rc.bind(ids[i])
+						}
+						v[i] = []byte(strconv.FormatUint(ids[i], 10))
+					case TxUnlock:
+						rc.unbind(op.ID)
+						v[i] = []byte("OK")
+					default:
+						v[i] = []byte("OK")
+					}
+				}
+				conn.SendValue(v)
+			case "DISCARD":
+				tx, txErr = nil, nil
+				conn.SendValue("OK")
+			default:
+				op, err := a.parseRESPTxOp(cmd, args)
+				if err != nil {
+					if txErr == nil {
+						txErr = err
+					}
+					conn.SendValue(respError(err))
+				} else {
+					op.Options.Client = c.RemoteAddr().String()
+					tx = append(tx, op)
+					conn.SendValue("QUEUED")
+				}
+			}
+			continue
+		}
+
 		switch cmd {
+		case "PING":
+			conn.SendValue("PONG")
+		case "MULTI":
+			tx = make([]TxOp, 0, 4)
+			conn.SendValue("OK")
+		case "EXEC", "DISCARD":
+			conn.SendValue(respError(invalidArgumentf("%s without MULTI", cmd)))
 		case "LOCK":
-			tp, names, timeout, err := a.parseRESPLock(args)
+			tp, names, opts, err := a.parseRESPLock(args)
 			if err != nil {
-				conn.SendValue(err)
+				conn.SendValue(respError(err))
 			} else {
-				id, err := a.LockTimeout(tp, timeout, names)
+				opts.Client = c.RemoteAddr().String()
+				id, err := a.LockWithOptions(tp, names, opts)
 				if err != nil {
-					conn.SendValue(err)
+					conn.SendValue(respError(err))
 				} else {
-					grapLockIDs[id] = struct{}{}
+					if opts.bound() {
+						rc.bind(id)
+					}
 					conn.SendValue([]byte(strconv.FormatUint(id, 10)))
 				}
 			}
 		case "UNLOCK":
 			id, err := a.parseRESPUnlock(args)
 			if err != nil {
-				conn.SendValue(err)
+				conn.SendValue(respError(err))
 			} else {
 				err = a.Unlock(id)
 				if err != nil {
-					conn.SendValue(err)
+					conn.SendValue(respError(err))
+				} else {
+					rc.unbind(id)
+					conn.SendValue("OK")
+				}
+			}
+		case "WAITFREE":
+			tp, names, opts, err := a.parseRESPLock(args)
+			if err == nil {
+				err = a.WaitFree(tp, names, opts)
+			}
+
+			if err != nil {
+				conn.SendValue(respError(err))
+			} else {
+				conn.SendValue("OK")
+			}
+		case "STATUS":
+			tp, names, opts, err := a.parseRESPLockArgs(args)
+			var statuses []NameStatus
+			if err == nil {
+				statuses, err = a.Status(tp, names, opts)
+			}
+
+			if err != nil {
+				conn.SendValue(respError(err))
+			} else {
+				v := make([][]byte, len(statuses))
+				for i, st := range statuses {
+					v[i], _ = json.Marshal(st)
+				}
+				conn.SendValue(v)
+			}
+		case "WATCH":
+			if !a.handleRESPWatch(conn, args) {
+				return
+			}
+		case "EXTEND", "SHRINK":
+			id, names, opts, err := a.parseRESPExtend(args)
+			if err == nil {
+				if cmd == "EXTEND" {
+					err = a.Extend(id, names, opts.Timeout)
+				} else {
+					err = a.Shrink(id, names)
+				}
+			}
+
+			if err != nil {
+				conn.SendValue(respError(err))
+			} else {
+				conn.SendValue("OK")
+			}
+		case "TRANSFER":
+			id, owner, lease, timeout, err := a.parseRESPTransfer(args)
+			var token string
+			if err == nil {
+				token, err = a.Transfer(id, owner, lease, timeout)
+			}
+
+			if err != nil {
+				conn.SendValue(respError(err))
+			} else {
+				conn.SendValue([]byte(token))
+			}
+		case "REDEEM":
+			token, owner, err := a.parseRESPRedeem(args)
+			var l *lockInfo
+			if err == nil {
+				l, err = a.redeem(token, owner)
+			}
+
+			if err != nil {
+				conn.SendValue(respError(err))
+			} else {
+				if l.opts.bound() {
+					rc.bind(l.id)
+				}
+				conn.SendValue([]byte(strconv.FormatUint(l.id, 10)))
+			}
+		case "GRANT":
+			ttl, err := a.parseRESPGrant(args)
+			if err != nil {
+				conn.SendValue(respError(err))
+			} else {
+				id, err := a.GrantLease(ttl)
+				if err != nil {
+					conn.SendValue(respError(err))
+				} else {
+					conn.SendValue([]byte(strconv.FormatUint(id, 10)))
+				}
+			}
+		case "RENEW", "REVOKE":
+			id, err := a.parseRESPLease(args)
+			if err != nil {
+				conn.SendValue(respError(err))
+			} else {
+				if cmd == "RENEW" {
+					err = a.RenewLease(id)
+				} else {
+					err = a.RevokeLease(id)
+				}
+
+				if err != nil {
+					conn.SendValue(respError(err))
 				} else {
-					delete(grapLockIDs, id)
 					conn.SendValue("OK")
 				}
 			}
 		default:
-			conn.SendValue(fmt.Errorf("invalid command %s", cmd))
+			conn.SendValue(respError(invalidArgumentf("invalid command %s", cmd)))
 		}
 	}
 }
 
-func (a *App) parseRESPLock(args [][]byte) (tp string, names []string, timeout time.Duration, err error) {
-	tp = KeyLockType
-	timeout = 60 * time.Second
+// parseRESPLock parses the LOCK arguments, the grammar is
+//
+//	[TYPE key] [TIMEOUT 60 | PXTIMEOUT 60000] [LEASE leaseid | SESSION leaseid | DETACH ttl] [SEP /] [RAW 0] [MODE x] [OWNER owner] NAMES name1 name2 ...
+//
+// all names are after the NAMES marker, so a name can be any string, like TYPE.
+// If there is no NAMES marker, the legacy grammar is used
+//
+//	name1 name2 ... [TYPE key] [TIMEOUT 60 | PXTIMEOUT 60000] [LEASE leaseid | SESSION leaseid | DETACH ttl] [SEP /] [RAW 0] [MODE x] [OWNER owner]
+//
+// which can not lock the names like TYPE or TIMEOUT.
+func (a *App) parseRESPLock(args [][]byte) (tp string, names []string, opts LockOptions, err error) {
+	tp, names, opts, err = a.parseRESPLockArgs(args)
+	opts.Timeout = a.requestTimeout(opts.Timeout)
+	return
+}
 
-	names = make([]string, 0, len(args))
+func (a *App) parseRESPLockArgs(args [][]byte) (tp string, names []string, opts LockOptions, err error) {
+	tp = KeyLockType
 
 	for i := 0; i < len(args); i++ {
-		arg := string(args[i])
-		s := strings.ToUpper(arg)
-		if s == "TYPE" && i < len(args) {
-			tp = strings.ToLower(string(args[i+1]))
-			i++
-		} else if s == "TIMEOUT" && i < len(args) {
-			var t uint64
-			t, err = strconv.ParseUint(string(args[i+1]), 10, 64)
-			if err != nil {
+		s := strings.ToUpper(string(args[i]))
+		if s == "NAMES" {
+			if i == len(args)-1 {
+				err = invalidArgumentf("empty lock names")
 				return
 			}
-			if t == 0 {
-				t = 60
+
+			names = make([]string, 0, len(args)-i-1)
+			for _, arg := range args[i+1:] {
+				names = append(names, string(arg))
 			}
+			return
+		}
 
-			timeout = time.Duration(t) * time.Second
-			i++
-		} else {
+		if !isRESPLockOption(s) {
+			// not an option before NAMES, use the legacy grammar
+			break
+		}
+
+		if i == len(args)-1 {
+			err = invalidArgumentf("missing value for %s", s)
+			return
+		}
+
+		if err = parseRESPLockOption(s, args[i+1], &tp, &opts); err != nil {
+			return
+		}
+		i++
+	}
+
+	return a.parseRESPLegacyLock(args)
+}
+
+func (a *App) parseRESPLegacyLock(args [][]byte) (tp string, names []string, opts LockOptions, err error) {
+	tp = KeyLockType
+
+	names = make([]string, 0, len(args))
+
+	for i := 0; i < len(args); i++ {
+		arg := string(args[i])
+		s := strings.ToUpper(arg)
+		if !isRESPLockOption(s) {
 			names = append(names, arg)
+			continue
 		}
+
+		if i == len(args)-1 {
+			err = invalidArgumentf("missing value for %s", s)
+			return
+		}
+
+		if err = parseRESPLockOption(s, args[i+1], &tp, &opts); err != nil {
+			return
+		}
+		i++
+	}
+
+	if len(names) == 0 {
+		err = invalidArgumentf("empty lock names")
 	}
 	return
 }
 
+func isRESPLockOption(s string) bool {
+	switch s {
+	case "TYPE", "TIMEOUT", "PXTIMEOUT", "LEASE", "SESSION", "DETACH", "PERSIST", "SEP", "RAW", "MODE", "OWNER":
+		return true
+	default:
+		return false
+	}
+}
+
+func parseRESPLockOption(option string, value []byte, tp *string, opts *LockOptions) error {
+	switch option {
+	case "TYPE":
+		*tp = strings.ToLower(string(value))
+	case "TIMEOUT", "PXTIMEOUT":
+		t, err := strconv.ParseUint(string(value), 10, 64)
+		if err != nil {
+			return invalidArgumentf("invalid timeout %s", value)
+		}
+
+		unit := time.Second
+		if option == "PXTIMEOUT" {
+			unit = time.Millisecond
+		}
+
+		// zero uses the default timeout later
+		if t > uint64(InfiniteTimeout/unit) {
+			return invalidArgumentf("timeout %s is too large", value)
+		}
+		opts.Timeout = time.Duration(t) * unit
+	case "LEASE", "SESSION":
+		id, err := strconv.ParseUint(string(value), 10, 64)
+		if err != nil {
+			return invalidArgumentf("invalid lease id %s", value)
+		}
+		opts.Lease = id
+		opts.Session = option == "SESSION"
+	case "DETACH", "PERSIST":
+		ttl, err := strconv.ParseUint(string(value), 10, 64)
+		if err != nil || ttl == 0 || ttl > uint64(InfiniteTimeout/time.Second) {
+			return invalidArgumentf("invalid detach ttl %s", value)
+		}
+		opts.Detach = time.Duration(ttl) * time.Second
+	case "SEP":
+		if len(value) == 0 {
+			return invalidArgumentf("empty separator")
+		}
+		opts.Separator = string(value)
+	case "RAW":
+		raw, err := strconv.ParseBool(string(value))
+		if err != nil {
+			return invalidArgumentf("invalid raw %s", value)
+		}
+		opts.Raw = raw
+	case "MODE":
+		mode, err := ParseLockMode(string(value))
+		if err != nil {
+			return err
+		}
+		opts.Mode = mode
+	case "OWNER":
+		opts.Owner = string(value)
+	}
+	return nil
+}
+
+func (a *App) parseRESPAuth(args [][]byte) error {
+	if len(args) != 1 {
+		return invalidArgumentf("empty password")
+	}
+
+	if len(a.cfg.Auth.Password) == 0 {
+		return invalidArgumentf("no password is set")
+	}
+
+	if !a.checkPassword(string(args[0])) {
+		return fmt.Errorf("%w: invalid password", ErrNoAuth)
+	}
+	return nil
+}
+
+func (a *App) checkPassword(password string) bool {
+	return subtle.ConstantTimeCompare([]byte(password), []byte(a.cfg.Auth.Password)) == 1
+}
+
 func (a *App) parseRESPUnlock(args [][]byte) (id uint64, err error) {
 	if len(args) != 1 {
-		return 0, fmt.Errorf("empty unlock id")
+		return 0, invalidArgumentf("empty unlock id")
+	}
+
+	return parseID(string(args[0]))
+}
+
+// parseRESPTxOp parses a command queued after MULTI
+func (a *App) parseRESPTxOp(cmd string, args [][]byte) (op TxOp, err error) {
+	op.Cmd = cmd
+
+	switch cmd {
+	case TxLock:
+		op.Type, op.Names, op.Options, err = a.parseRESPLock(args)
+	case TxUnlock:
+		op.ID, err = a.parseRESPUnlock(args)
+	case TxExtend:
+		op.ID, op.Names, op.Options, err = a.parseRESPExtend(args)
+	case TxRenew:
+		op.ID, err = a.parseRESPLease(args)
+	case "MULTI":
+		err = invalidArgumentf("MULTI calls can not be nested")
+	default:
+		err = invalidArgumentf("command %s is not allowed in MULTI", cmd)
+	}
+	return
+}
+
+// parseRESPExtend parses the lock id and the names like LOCK, the lock
+// options but the timeout are ignored, the names are locked like the lock.
+func (a *App) parseRESPExtend(args [][]byte) (id uint64, names []string, opts LockOptions, err error) {
+	if len(args) < 2 {
+		err = invalidArgumentf("empty lock id or names")
+		return
+	}
+
+	if id, err = parseID(string(args[0])); err != nil {
+		return
+	}
+
+	_, names, opts, err = a.parseRESPLock(args[1:])
+	return
+}
+
+func (a *App) parseRESPGrant(args [][]byte) (ttl time.Duration, err error) {
+	if len(args) != 1 {
+		return 0, invalidArgumentf("empty lease ttl")
 	}
 
-	return strconv.ParseUint(string(args[0]), 10, 64)
+	t, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil || t > uint64(InfiniteTimeout/time.Second) {
+		return 0, invalidArgumentf("invalid lease ttl %s", args[0])
+	}
+
+	return time.Duration(t) * time.Second, nil
+}
+
+func (a *App) parseRESPLease(args [][]byte) (id uint64, err error) {
+	if len(args) != 1 {
+		return 0, invalidArgumentf("empty lease id")
+	}
+
+	return parseID(string(args[0]))
+}
+
+func parseID(s string) (uint64, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, invalidArgumentf("invalid id %s", s)
+	}
+	return id, nil
+}
+
+// newAuthHandler checks the header Authorization: Bearer password if the password is set
+func (a *App) newAuthHandler(h http.Handler) http.Handler {
+	if len(a.cfg.Auth.Password) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || !a.checkPassword(auth[len("Bearer "):]) {
+			writeHTTPError(w, ErrNoAuth)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
 }
 
 type lockHandler struct {
@@ -377,10 +1309,16 @@ func (a *App) newLockHandler() *lockHandler {
 	return h
 }
 
-// Lock:   Post/Put /lock?names=a,b,c&timeout=10&type=key return a lock id
+// Lock:   Post/Put /lock?names=a,b,c&timeout=10&type=key[&lease=leaseid] return a lock id
+// Use timeout_ms=10000 instead of timeout for millisecond resolution
+// For path and glob lock, use sep=. for a custom separator and raw=true to not clean the path
+// For path lock, use mode=s or mode=six to lock with the mode, see LockMode, the default is x
+// Use owner=name to record who holds the lock in the audit log
 // Unlock: Delete   /lock?id=lockid
-// For HTTP, the default and maximum timeout is 60s
-// Lock type supports key and path, the default is key
+// Without timeout, the default_timeout in Config is used, and a larger timeout
+// than max_timeout is truncated
+// For range lock, names are start1,end1,start2,end2 for the ranges [start, end), an empty end means no upper bound
+// Lock type supports key, path, glob and range, the default is key
 // List locks: Get  /lock
 func (h *lockHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -390,47 +1328,209 @@ func (h *lockHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Write(buf)
 		return
 	case "POST", "PUT":
-		names := strings.Split(r.FormValue("names"), ",")
-		if len(names) == 0 {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("empty lock names"))
+		tp, names, opts, err := h.a.parseHTTPLock(r)
+		if err != nil {
+			writeHTTPError(w, err)
 			return
 		}
 
-		timeout, _ := strconv.Atoi(r.FormValue("timeout"))
+		id, err := h.a.LockWithOptions(tp, names, opts)
+		if err != nil {
+			writeHTTPError(w, err)
+		} else {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(strconv.FormatUint(id, 10)))
+		}
+	case "DELETE":
+		id, err := parseID(r.FormValue("id"))
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+
+		err = h.a.Unlock(id)
+
+		if err != nil {
+			writeHTTPError(w, err)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+// parseHTTPLock parses the lock arguments in the query, see lockHandler
+func (a *App) parseHTTPLock(r *http.Request) (tp string, names []string, opts LockOptions, err error) {
+	names = strings.Split(r.FormValue("names"), ",")
+	if len(names) == 0 {
+		err = invalidArgumentf("empty lock names")
+		return
+	}
+
+	var timeout time.Duration
+	if v := r.FormValue("timeout_ms"); len(v) > 0 {
+		t, _ := strconv.Atoi(v)
+		timeout = time.Duration(t) * time.Millisecond
+	} else {
+		t, _ := strconv.Atoi(r.FormValue("timeout"))
+		timeout = time.Duration(t) * time.Second
+	}
+
+	opts.Timeout = a.requestTimeout(timeout)
+
+	tp = strings.ToLower(r.FormValue("type"))
+	if len(tp) == 0 {
+		tp = KeyLockType
+	}
+
+	if v := r.FormValue("lease"); len(v) > 0 {
+		if opts.Lease, err = parseID(v); err != nil {
+			return
+		}
+	}
+
+	opts.Separator = r.FormValue("sep")
+	if v := r.FormValue("raw"); len(v) > 0 {
+		if opts.Raw, err = strconv.ParseBool(v); err != nil {
+			err = invalidArgumentf("invalid raw %s", v)
+			return
+		}
+	}
+
+	if opts.Mode, err = ParseLockMode(r.FormValue("mode")); err != nil {
+		return
+	}
+
+	opts.Owner = r.FormValue("owner")
+	opts.Client = r.RemoteAddr
+	return
+}
+
+type waitHandler struct {
+	a *App
+}
+
+func (a *App) newWaitHandler() *waitHandler {
+	h := new(waitHandler)
+	h.a = a
+
+	return h
+}
+
+// Wait free: Get /lock/wait?names=a,b,c&timeout=10&type=key
+// It returns once none of the names is locked at a moment, without locking
+// them, type supports key, path and range, and the options like lock,
+// returns 408 if the names are not free before timeout.
+func (h *waitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
 
-		if timeout <= 0 {
-			timeout = 60
+	tp, names, opts, err := h.a.parseHTTPLock(r)
+	if err == nil {
+		err = h.a.WaitFree(tp, names, opts)
+	}
+
+	if err != nil {
+		writeHTTPError(w, err)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type extendHandler struct {
+	a      *App
+	shrink bool
+}
+
+func (a *App) newExtendHandler(shrink bool) *extendHandler {
+	h := new(extendHandler)
+	h.a = a
+	h.shrink = shrink
+
+	return h
+}
+
+// Extend: Post/Put /lock/extend?id=lockid&names=a,b,c&timeout=10
+// Shrink: Post/Put /lock/shrink?id=lockid&names=a,b
+// The names are locked or released like the lock, see App Extend and Shrink
+func (h *extendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := parseID(r.FormValue("id"))
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	_, names, opts, err := h.a.parseHTTPLock(r)
+	if err == nil {
+		if h.shrink {
+			err = h.a.Shrink(id, names)
+		} else {
+			err = h.a.Extend(id, names, opts.Timeout)
 		}
-		tp := strings.ToLower(r.FormValue("type"))
-		if len(tp) == 0 {
-			tp = "key"
+	}
+
+	if err != nil {
+		writeHTTPError(w, err)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type leaseHandler struct {
+	a *App
+}
+
+func (a *App) newLeaseHandler() *leaseHandler {
+	h := new(leaseHandler)
+	h.a = a
+
+	return h
+}
+
+// Grant:  Post   /lease?ttl=10 return a lease id
+// Renew:  Put    /lease?id=leaseid
+// Revoke: Delete /lease?id=leaseid
+// Renew and revoke return 404 if the lease is not found or expired
+func (h *leaseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		ttl, err := strconv.ParseUint(r.FormValue("ttl"), 10, 64)
+		if err != nil || ttl > uint64(InfiniteTimeout/time.Second) {
+			writeHTTPError(w, invalidArgumentf("invalid lease ttl %s", r.FormValue("ttl")))
+			return
 		}
 
-		id, err := h.a.LockTimeout(tp, time.Duration(timeout)*time.Second, names)
-		if err != nil && err != errLockTimeout {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-		} else if err == errLockTimeout {
-			w.WriteHeader(http.StatusRequestTimeout)
-			w.Write([]byte("Lock timeout"))
+		id, err := h.a.GrantLease(time.Duration(ttl) * time.Second)
+		if err != nil {
+			writeHTTPError(w, err)
 		} else {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte(strconv.FormatUint(id, 10)))
 		}
-	case "DELETE":
-		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	case "PUT", "DELETE":
+		id, err := parseID(r.FormValue("id"))
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
+			writeHTTPError(w, err)
 			return
 		}
 
-		err = h.a.Unlock(id)
+		if r.Method == "PUT" {
+			err = h.a.RenewLease(id)
+		} else {
+			err = h.a.RevokeLease(id)
+		}
 
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
+			writeHTTPError(w, err)
 		} else {
 			w.WriteHeader(http.StatusOK)
 		}
@@ -1,13 +1,30 @@
 package tlock
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -202,7 +219,8 @@ func (s *serverTestSuite) TestRESPLock(c *C) {
 	<-done
 
 	c.Assert(err, NotNil)
-	c.Assert(strings.Contains(err.Error(), errLockTimeout.Error()), Equals, true)
+	c.Assert(strings.Contains(err.Error(), ErrLockTimeout.Error()), Equals, true)
+	c.Assert(errors.Is(err, ErrLockTimeout), Equals, true)
 
 	err = c1.LockTimeout(0)
 	c.Assert(err, IsNil)
@@ -246,7 +264,8 @@ func (s *serverTestSuite) TestRESPLockClose(c *C) {
 	<-done
 
 	c.Assert(err, NotNil)
-	c.Assert(strings.Contains(err.Error(), errLockTimeout.Error()), Equals, true)
+	c.Assert(strings.Contains(err.Error(), ErrLockTimeout.Error()), Equals, true)
+	c.Assert(strings.HasPrefix(err.Error(), "TIMEOUT "), Equals, true)
 
 	id, err := goredis.Bytes(c1.Do("LOCK", "a", "TYPE", "KEY", "TIMEOUT", 0))
 	c.Assert(err, IsNil)
@@ -255,3 +274,2442 @@ func (s *serverTestSuite) TestRESPLockClose(c *C) {
 
 	wg.Wait()
 }
+
+func (s *serverTestSuite) TestHTTPClientLock(c *C) {
+	addr := s.a.HTTPAddr()
+	c.Assert(addr, NotNil)
+
+	client := NewHTTPClient(addr.String())
+	defer client.Close()
+
+	c1, err := client.GetLocker(KeyLockType, "a")
+	c.Assert(err, IsNil)
+	c2, err := client.GetLocker(KeyLockType, "a")
+	c.Assert(err, IsNil)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	done := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		err := c2.Lock()
+		c.Assert(err, IsNil)
+
+		done <- struct{}{}
+		time.Sleep(2 * time.Second)
+		done <- struct{}{}
+
+		err = c2.Unlock()
+		c.Assert(err, IsNil)
+	}()
+
+	<-done
+	err = c1.LockTimeout(1)
+	<-done
+
+	c.Assert(err, Equals, ErrLockTimeout)
+
+	err = c1.LockTimeout(0)
+	c.Assert(err, IsNil)
+	err = c1.Unlock()
+	c.Assert(err, IsNil)
+
+	wg.Wait()
+
+	_, err = client.do(lockPath, "POST", url.Values{"names": {"a"}, "type": {"invalid"}})
+	c.Assert(errors.Is(err, ErrInvalidType), Equals, true)
+}
+
+func (s *serverTestSuite) TestErrors(c *C) {
+	httpClient := NewHTTPClient(s.a.HTTPAddr().String())
+	defer httpClient.Close()
+
+	respClient := NewRESPClient(s.a.RESPAddr().String())
+	defer respClient.Close()
+
+	// unlock an unknown id
+	_, err := httpClient.do(lockPath, "DELETE", url.Values{"id": {"1"}})
+	c.Assert(err, Equals, ErrNotLocked)
+	_, err = respClient.c.Do("UNLOCK", 1)
+	c.Assert(parseRESPError(err), Equals, ErrNotLocked)
+
+	// invalid arguments
+	_, err = httpClient.do(lockPath, "DELETE", url.Values{"id": {"abc"}})
+	c.Assert(errors.Is(err, ErrInvalidArgument), Equals, true)
+	_, err = respClient.c.Do("UNLOCK", "abc")
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidArgument), Equals, true)
+
+	// invalid type
+	_, err = respClient.c.Do("LOCK", "a", "TYPE", "invalid")
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidType), Equals, true)
+	c.Assert(parseRESPError(err).Error(), Equals, "invalid lock type invalid")
+
+	// unknown lease
+	c.Assert(respClient.renewLease(1, time.Second), Equals, ErrLeaseNotFound)
+	c.Assert(httpClient.renewLease(1, time.Second), Equals, ErrLeaseNotFound)
+
+	// a ttl overflowing the duration is rejected, not wrapped to a small one
+	_, err = httpClient.do(leasePath, "POST", url.Values{"ttl": {"18446744073709551615"}})
+	c.Assert(errors.Is(err, ErrInvalidArgument), Equals, true)
+	_, err = respClient.c.Do("GRANT", "18446744073709551615")
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidArgument), Equals, true)
+
+	// unknown error codes are treated as server failures
+	c.Assert(errors.Is(parseError("OOPS something wrong"), ErrInternal), Equals, true)
+	c.Assert(errors.Is(parseHTTPError(http.StatusRequestTimeout, "Lock timeout"), ErrLockTimeout), Equals, true)
+}
+
+func (s *serverTestSuite) TestLeaseExpire(c *C) {
+	leaseID, err := s.a.GrantLease(1 * time.Second)
+	c.Assert(err, IsNil)
+
+	_, err = s.a.LockLease(KeyLockType, time.Second, leaseID, []string{"lease_a"})
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(s.getLocks(c), "lease_a"), Equals, true)
+
+	// renew keeps the lock alive
+	time.Sleep(500 * time.Millisecond)
+	c.Assert(s.a.RenewLease(leaseID), IsNil)
+	time.Sleep(700 * time.Millisecond)
+	c.Assert(strings.Contains(s.getLocks(c), "lease_a"), Equals, true)
+
+	time.Sleep(500 * time.Millisecond)
+	c.Assert(strings.Contains(s.getLocks(c), "lease_a"), Equals, false)
+	c.Assert(s.a.RenewLease(leaseID), Equals, ErrLeaseNotFound)
+
+	_, err = s.a.LockLease(KeyLockType, time.Second, leaseID, []string{"lease_a"})
+	c.Assert(err, Equals, ErrLeaseNotFound)
+}
+
+func (s *serverTestSuite) TestSession(c *C) {
+	addr := s.a.RESPAddr()
+	c.Assert(addr, NotNil)
+
+	pool := NewRESPClient(addr.String())
+	defer pool.Close()
+
+	httpClient := NewHTTPClient(s.a.HTTPAddr().String())
+	defer httpClient.Close()
+
+	for _, client := range []interface {
+		NewSession(ttl int) (*Session, error)
+	}{pool, httpClient} {
+		session, err := client.NewSession(1)
+		c.Assert(err, IsNil)
+
+		l1, err := session.GetLocker(KeyLockType, "session_a")
+		c.Assert(err, IsNil)
+		l2, err := session.GetLocker(PathLockType, "session_b/c")
+		c.Assert(err, IsNil)
+
+		c.Assert(l1.Lock(), IsNil)
+		c.Assert(l2.Lock(), IsNil)
+
+		// the session must keep the lease alive longer than the ttl
+		time.Sleep(2 * time.Second)
+		str := s.getLocks(c)
+		c.Assert(strings.Contains(str, "session_a"), Equals, true)
+		c.Assert(strings.Contains(str, "session_b/c"), Equals, true)
+
+		// lost the lease, all locks are released together
+		c.Assert(s.a.RevokeLease(session.ID()), IsNil)
+
+		select {
+		case <-session.Done():
+		case <-time.After(2 * time.Second):
+			c.Fatal("session is not done after lease revoked")
+		}
+
+		str = s.getLocks(c)
+		c.Assert(strings.Contains(str, "session_a"), Equals, false)
+		c.Assert(strings.Contains(str, "session_b/c"), Equals, false)
+
+		c.Assert(session.Close(), Equals, ErrLeaseNotFound)
+	}
+}
+
+// TestSessionServerHang checks Done is closed when the server stops
+// answering the renews, at the time the server releases the lease.
+func (s *serverTestSuite) TestSessionServerHang(c *C) {
+	hang := make(chan struct{})
+	defer close(hang)
+
+	respListener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer respListener.Close()
+
+	go func() {
+		for {
+			nc, err := respListener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(nc net.Conn) {
+				defer nc.Close()
+
+				conn, _ := goredis.NewConn(nc)
+				for {
+					args, err := conn.ReceiveRequest()
+					if err != nil {
+						return
+					}
+
+					switch strings.ToUpper(string(args[0])) {
+					case "GRANT":
+						conn.SendValue([]byte("1"))
+					case "RENEW":
+						<-hang
+						return
+					default:
+						conn.SendValue("OK")
+					}
+				}
+			}(nc)
+		}
+	}()
+
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer httpListener.Close()
+
+	go http.Serve(httpListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			w.Write([]byte("1"))
+		case "PUT":
+			<-hang
+		}
+	}))
+
+	respClient := NewRESPClient(respListener.Addr().String())
+	defer respClient.Close()
+
+	httpClient := NewHTTPClient(httpListener.Addr().String())
+	defer httpClient.Close()
+
+	for _, client := range []interface {
+		NewSession(ttl int) (*Session, error)
+	}{respClient, httpClient} {
+		t := time.Now()
+		session, err := client.NewSession(1)
+		c.Assert(err, IsNil)
+
+		select {
+		case <-session.Done():
+		case <-time.After(3 * time.Second):
+			c.Fatal("session is not done when the renews hang")
+		}
+
+		d := time.Since(t)
+		c.Assert(d < 1200*time.Millisecond, Equals, true, Commentf("%v", d))
+		session.Close()
+	}
+}
+
+func (s *serverTestSuite) TestMillisecondTimeout(c *C) {
+	id, err := s.a.Lock(KeyLockType, []string{"ms_a"})
+	c.Assert(err, IsNil)
+
+	respClient := NewRESPClient(s.a.RESPAddr().String())
+	defer respClient.Close()
+
+	httpClient := NewHTTPClient(s.a.HTTPAddr().String())
+	defer httpClient.Close()
+
+	for _, client := range []Client{respClient, httpClient} {
+		l, err := client.GetLocker(KeyLockType, "ms_a")
+		c.Assert(err, IsNil)
+
+		t := time.Now()
+		err = l.(DurationLocker).LockTimeoutDuration(200 * time.Millisecond)
+		c.Assert(err, Equals, ErrLockTimeout)
+
+		d := time.Since(t)
+		c.Assert(d >= 200*time.Millisecond, Equals, true)
+		c.Assert(d < 900*time.Millisecond, Equals, true)
+	}
+
+	conn, err := goredis.Connect(s.a.RESPAddr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	t := time.Now()
+	_, err = conn.Do("LOCK", "ms_a", "TYPE", "key", "PXTIMEOUT", 100)
+	c.Assert(strings.HasPrefix(err.Error(), "TIMEOUT "), Equals, true)
+	c.Assert(time.Since(t) < 900*time.Millisecond, Equals, true)
+
+	t = time.Now()
+	_, err = httpClient.do(lockPath, "POST", url.Values{"names": {"ms_a"}, "timeout_ms": {"100"}})
+	c.Assert(err, Equals, ErrLockTimeout)
+	c.Assert(time.Since(t) < 900*time.Millisecond, Equals, true)
+
+	c.Assert(s.a.Unlock(id), IsNil)
+}
+
+func (s *serverTestSuite) TestParseRESPLock(c *C) {
+	toArgs := func(args ...string) [][]byte {
+		b := make([][]byte, len(args))
+		for i, arg := range args {
+			b[i] = []byte(arg)
+		}
+		return b
+	}
+
+	tp, names, opts, err := s.a.parseRESPLock(toArgs("TYPE", "path", "PXTIMEOUT", "100", "LEASE", "10", "SEP", ".", "RAW", "1", "NAMES", "TYPE", "TIMEOUT", "NAMES"))
+	c.Assert(err, IsNil)
+	c.Assert(tp, Equals, PathLockType)
+	c.Assert(names, DeepEquals, []string{"TYPE", "TIMEOUT", "NAMES"})
+	c.Assert(opts, Equals, LockOptions{Timeout: 100 * time.Millisecond, Lease: 10, Separator: ".", Raw: true})
+
+	// legacy grammar
+	tp, names, opts, err = s.a.parseRESPLock(toArgs("a", "b", "TYPE", "path", "TIMEOUT", "10"))
+	c.Assert(err, IsNil)
+	c.Assert(tp, Equals, PathLockType)
+	c.Assert(names, DeepEquals, []string{"a", "b"})
+	c.Assert(opts.Timeout, Equals, 10*time.Second)
+
+	// default options
+	tp, names, opts, err = s.a.parseRESPLock(toArgs("NAMES", "a"))
+	c.Assert(err, IsNil)
+	c.Assert(tp, Equals, KeyLockType)
+	c.Assert(names, DeepEquals, []string{"a"})
+	c.Assert(opts, Equals, LockOptions{Timeout: 60 * time.Second})
+
+	for _, args := range [][]string{
+		{},
+		{"NAMES"},
+		{"TYPE", "key", "NAMES"},
+		{"a", "TYPE"},
+		{"TYPE"},
+		{"a", "TIMEOUT"},
+		{"a", "TIMEOUT", "abc"},
+		{"a", "PXTIMEOUT", "-1"},
+		{"a", "TIMEOUT", "18446744073709551615"},
+		{"a", "LEASE"},
+		{"TIMEOUT", "10"},
+		{"SEP", "", "NAMES", "a"},
+		{"RAW", "abc", "NAMES", "a"},
+	} {
+		_, _, _, err = s.a.parseRESPLock(toArgs(args...))
+		c.Assert(errors.Is(err, ErrInvalidArgument), Equals, true, Commentf("%q", args))
+	}
+}
+
+func (s *serverTestSuite) TestRESPClientLegacyLock(c *C) {
+	// a server before NAMES, records the LOCK requests
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	reqs := make(chan string, 10)
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(nc net.Conn) {
+				conn, _ := goredis.NewConn(nc)
+				defer conn.Close()
+
+				for {
+					args, err := conn.ReceiveRequest()
+					if err != nil {
+						return
+					}
+
+					switch strings.ToUpper(string(args[0])) {
+					case "LOCK":
+						reqs <- string(bytes.Join(args[1:], []byte(" ")))
+						conn.SendValue([]byte("1"))
+					case "PING":
+						conn.SendValue("PONG")
+					default:
+						conn.SendValue("OK")
+					}
+				}
+			}(nc)
+		}
+	}()
+
+	client := NewRESPClient(ln.Addr().String())
+	defer client.Close()
+	ownerClient := NewRESPClientWithConfig(ln.Addr().String(), RESPClientConfig{Owner: "o"})
+	defer ownerClient.Close()
+
+	tests := []struct {
+		client  *RESPClient
+		names   []string
+		timeout time.Duration
+		req     string
+	}{
+		{client, []string{"a", "b"}, 10 * time.Second, "a b TYPE key TIMEOUT 10"},
+		// the new grammar only if needed
+		{client, []string{"type"}, 10 * time.Second, "TYPE key TIMEOUT 10 NAMES type"},
+		{client, []string{"a"}, 200 * time.Millisecond, "TYPE key PXTIMEOUT 200 NAMES a"},
+		{ownerClient, []string{"a"}, 10 * time.Second, "TYPE key TIMEOUT 10 OWNER o NAMES a"},
+	}
+
+	for _, t := range tests {
+		l, err := t.client.GetLocker(KeyLockType, t.names...)
+		c.Assert(err, IsNil)
+		c.Assert(l.(DurationLocker).LockTimeoutDuration(t.timeout), IsNil)
+		c.Assert(<-reqs, Equals, t.req)
+		c.Assert(l.Unlock(), IsNil)
+	}
+}
+
+// runRESP sends a request to a new connection served by handleRESP,
+// and returns the reply.
+func runRESP(a *App, args [][]byte) (interface{}, error) {
+	c1, c2 := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		a.handleRESP(c2)
+		close(done)
+	}()
+
+	conn, _ := goredis.NewConn(c1)
+
+	v := make([]interface{}, 0, len(args))
+	for _, arg := range args[1:] {
+		v = append(v, arg)
+	}
+	reply, err := conn.Do(string(args[0]), v...)
+
+	conn.Close()
+	<-done
+	return reply, err
+}
+
+func FuzzHandleRESP(f *testing.F) {
+	for _, seed := range []string{
+		"LOCK a TYPE key TIMEOUT 1",
+		"LOCK TYPE path PXTIMEOUT 10 NAMES a/b a/c",
+		"LOCK TYPE key NAMES TYPE TIMEOUT",
+		"LOCK a TYPE",
+		"LOCK NAMES",
+		"LOCK TIMEOUT 99999999999999999999 NAMES a",
+		"UNLOCK",
+		"UNLOCK abc",
+		"UNLOCK 1",
+		"GRANT 10",
+		"GRANT 0",
+		"RENEW 1",
+		"LOCK LEASE 1 NAMES a",
+		"UNKNOWN a",
+		"MULTI",
+		"EXEC",
+		"DISCARD",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data string) {
+		fields := strings.Fields(data)
+		if len(fields) == 0 {
+			return
+		}
+
+		args := make([][]byte, len(fields))
+		for i, field := range fields {
+			args[i] = []byte(field)
+		}
+
+		// a new app, so lock never waits
+		a := NewApp()
+		reply, err := runRESP(a, args)
+		if err != nil {
+			if _, ok := err.(goredis.Error); !ok {
+				t.Fatalf("%q: %v", data, err)
+			}
+			return
+		}
+
+		if reply == nil {
+			t.Fatalf("%q: nil reply", data)
+		}
+	})
+}
+
+func (s *serverTestSuite) TestInvalidPath(c *C) {
+	addr := s.a.HTTPAddr()
+
+	r, err := http.Post(fmt.Sprintf("http://%s/lock?names=/&type=path", addr), "", strings.NewReader(""))
+	c.Assert(err, IsNil)
+	ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	c.Assert(r.StatusCode, Equals, http.StatusBadRequest)
+
+	reply, err := runRESP(s.a, [][]byte{[]byte("LOCK"), []byte("TYPE"), []byte("path"), []byte("NAMES"), []byte("a/.."), []byte("b")})
+	c.Assert(reply, IsNil)
+	c.Assert(strings.HasPrefix(err.Error(), "INVALID "), Equals, true)
+}
+
+func (s *serverTestSuite) TestPathSeparatorLock(c *C) {
+	id1, err := s.a.LockWithOptions(PathLockType, []string{"sep.a.b"}, LockOptions{Separator: "."})
+	c.Assert(err, IsNil)
+
+	// different separators never conflict
+	id2, err := s.a.LockWithOptions(PathLockType, []string{"sep.a"}, LockOptions{Timeout: 10 * time.Millisecond})
+	c.Assert(err, IsNil)
+	c.Assert(s.a.Unlock(id2), IsNil)
+
+	reply, err := runRESP(s.a, [][]byte{[]byte("LOCK"), []byte("TYPE"), []byte("path"), []byte("SEP"), []byte("."), []byte("PXTIMEOUT"), []byte("10"), []byte("NAMES"), []byte("sep.a")})
+	c.Assert(reply, IsNil)
+	c.Assert(strings.HasPrefix(err.Error(), "TIMEOUT "), Equals, true)
+
+	httpClient := NewHTTPClient(s.a.HTTPAddr().String())
+	defer httpClient.Close()
+
+	_, err = httpClient.do(lockPath, "POST", url.Values{"names": {"sep"}, "type": {"path"}, "sep": {"."}, "timeout_ms": {"10"}})
+	c.Assert(err, Equals, ErrLockTimeout)
+
+	str := s.getLocks(c)
+	c.Assert(strings.Contains(str, `sep="."`), Equals, true)
+
+	c.Assert(s.a.Unlock(id1), IsNil)
+}
+
+func (s *serverTestSuite) TestGlobLock(c *C) {
+	id1, err := s.a.Lock(GlobLockType, []string{"glob/*/config"})
+	c.Assert(err, IsNil)
+
+	_, err = s.a.LockTimeout(PathLockType, 10*time.Millisecond, []string{"glob/a/config"})
+	c.Assert(err, Equals, ErrLockTimeout)
+
+	// glob locks are in different namespaces with different separators
+	id2, err := s.a.LockWithOptions(GlobLockType, []string{"glob.*"}, LockOptions{Timeout: 10 * time.Millisecond, Separator: "."})
+	c.Assert(err, IsNil)
+	c.Assert(s.a.Unlock(id2), IsNil)
+
+	reply, err := runRESP(s.a, [][]byte{[]byte("LOCK"), []byte("TYPE"), []byte("glob"), []byte("PXTIMEOUT"), []byte("10"), []byte("NAMES"), []byte("glob/b/*")})
+	c.Assert(reply, IsNil)
+	c.Assert(strings.HasPrefix(err.Error(), "TIMEOUT "), Equals, true)
+
+	httpClient := NewHTTPClient(s.a.HTTPAddr().String())
+	defer httpClient.Close()
+
+	l, err := httpClient.GetLocker(GlobLockType, "glob/*/data")
+	c.Assert(err, IsNil)
+	c.Assert(l.(DurationLocker).LockTimeoutDuration(100*time.Millisecond), IsNil)
+
+	str := s.getLocks(c)
+	c.Assert(strings.Contains(str, "glob lock:"), Equals, true)
+	c.Assert(strings.Contains(str, "glob/*/data"), Equals, true)
+
+	c.Assert(l.Unlock(), IsNil)
+	c.Assert(s.a.Unlock(id1), IsNil)
+}
+
+func (s *serverTestSuite) TestRangeLock(c *C) {
+	id1, err := s.a.Lock(RangeLockType, []string{"range:1000", "range:2000"})
+	c.Assert(err, IsNil)
+
+	_, err = s.a.LockTimeout(KeyLockType, 10*time.Millisecond, []string{"range:1500"})
+	c.Assert(err, Equals, ErrLockTimeout)
+
+	reply, err := runRESP(s.a, [][]byte{[]byte("LOCK"), []byte("TYPE"), []byte("range"), []byte("PXTIMEOUT"), []byte("10"), []byte("NAMES"), []byte("range:1999"), []byte("")})
+	c.Assert(reply, IsNil)
+	c.Assert(strings.HasPrefix(err.Error(), "TIMEOUT "), Equals, true)
+
+	httpClient := NewHTTPClient(s.a.HTTPAddr().String())
+	defer httpClient.Close()
+
+	// an unbounded range
+	buf, err := httpClient.do(lockPath, "POST", url.Values{"names": {"range:2000,"}, "type": {"range"}, "timeout_ms": {"100"}})
+	c.Assert(err, IsNil)
+	id2, err := strconv.ParseUint(string(buf), 10, 64)
+	c.Assert(err, IsNil)
+
+	_, err = httpClient.do(lockPath, "POST", url.Values{"names": {"range:3000"}, "type": {"range"}, "timeout_ms": {"100"}})
+	c.Assert(errors.Is(err, ErrInvalidArgument), Equals, true)
+
+	str := s.getLocks(c)
+	c.Assert(strings.Contains(str, "[[range:1000,range:2000)]"), Equals, true)
+	c.Assert(strings.Contains(str, "[[range:2000,)]"), Equals, true)
+
+	c.Assert(s.a.Unlock(id2), IsNil)
+	c.Assert(s.a.Unlock(id1), IsNil)
+}
+
+func (s *serverTestSuite) TestPathLockMode(c *C) {
+	id1, err := s.a.LockWithOptions(PathLockType, []string{"mode/db"}, LockOptions{Mode: LockModeS})
+	c.Assert(err, IsNil)
+
+	// the lock is released after the connection is closed
+	reply, err := runRESP(s.a, [][]byte{[]byte("LOCK"), []byte("TYPE"), []byte("path"), []byte("MODE"), []byte("s"), []byte("NAMES"), []byte("mode/db/t")})
+	c.Assert(err, IsNil)
+	_, err = goredis.Uint64(reply, nil)
+	c.Assert(err, IsNil)
+
+	id2, err := s.a.LockWithOptions(PathLockType, []string{"mode/db/t"}, LockOptions{Mode: LockModeS})
+	c.Assert(err, IsNil)
+
+	httpClient := NewHTTPClient(s.a.HTTPAddr().String())
+	defer httpClient.Close()
+
+	_, err = httpClient.do(lockPath, "POST", url.Values{"names": {"mode/db/t"}, "type": {"path"}, "timeout_ms": {"10"}})
+	c.Assert(err, Equals, ErrLockTimeout)
+
+	_, err = httpClient.do(lockPath, "POST", url.Values{"names": {"mode/db"}, "type": {"path"}, "mode": {"is"}})
+	c.Assert(errors.Is(err, ErrInvalidArgument), Equals, true)
+
+	_, err = s.a.LockWithOptions(KeyLockType, []string{"mode/db"}, LockOptions{Mode: LockModeS})
+	c.Assert(errors.Is(err, ErrInvalidArgument), Equals, true)
+
+	str := s.getLocks(c)
+	c.Assert(strings.Contains(str, "mode=s"), Equals, true)
+
+	c.Assert(s.a.Unlock(id2), IsNil)
+	c.Assert(s.a.Unlock(id1), IsNil)
+}
+
+func (s *serverTestSuite) TestLockRegistry(c *C) {
+	a := NewApp()
+
+	contains := func(id uint64) bool {
+		for _, l := range a.locks.Snapshot() {
+			if l.id == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id, err := a.Lock(KeyLockType, []string{fmt.Sprintf("registry-%d", i)})
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if !contains(id) {
+					errs <- fmt.Errorf("lock %d is not in the snapshot", id)
+					return
+				}
+
+				if err = a.Unlock(id); err != nil {
+					errs <- err
+					return
+				}
+
+				if contains(id) {
+					errs <- fmt.Errorf("lock %d is still in the snapshot", id)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert(a.locks.Snapshot(), HasLen, 0)
+}
+
+func benchmarkAppLock(b *testing.B, tp string, name func(n int32, i int) string) {
+	a := NewApp()
+
+	var n int32
+	b.RunParallel(func(pb *testing.PB) {
+		g := atomic.AddInt32(&n, 1)
+		i := 0
+		for pb.Next() {
+			id, err := a.LockTimeout(tp, time.Second, []string{name(g, i)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err = a.Unlock(id); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkAppKeyLock(b *testing.B) {
+	benchmarkAppLock(b, KeyLockType, func(n int32, i int) string {
+		return fmt.Sprintf("key-%d-%d", n, i%16)
+	})
+}
+
+func BenchmarkAppPathLock(b *testing.B) {
+	benchmarkAppLock(b, PathLockType, func(n int32, i int) string {
+		return fmt.Sprintf("tenants/%d/%d", n, i%16)
+	})
+}
+
+func BenchmarkAppLockWithDump(b *testing.B) {
+	a := NewApp()
+
+	// a background listing, like a monitor scraping GET /lock
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				a.dumpLockNames()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	var n int32
+	b.RunParallel(func(pb *testing.PB) {
+		g := atomic.AddInt32(&n, 1)
+		i := 0
+		for pb.Next() {
+			id, err := a.LockTimeout(KeyLockType, time.Second, []string{fmt.Sprintf("key-%d-%d", g, i%16)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err = a.Unlock(id); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func (s *serverTestSuite) TestShutdown(c *C) {
+	for _, release := range []bool{true, false} {
+		sink := new(memAuditSink)
+
+		a := NewApp()
+		a.SetAuditSink(sink)
+		c.Assert(a.StartRESP("127.0.0.1:0"), IsNil)
+		c.Assert(a.StartHTTP("127.0.0.1:0"), IsNil)
+
+		conn, err := goredis.Connect(a.RESPAddr().String())
+		c.Assert(err, IsNil)
+
+		id, err := goredis.Uint64(conn.Do("LOCK", "TYPE", "key", "NAMES", "shutdown"))
+		c.Assert(err, IsNil)
+
+		// the locks not bound to a connection are not waited
+		_, err = goredis.Uint64(conn.Do("LOCK", "DETACH", 30, "NAMES", "shutdown_detach"))
+		c.Assert(err, IsNil)
+		leaseID, err := a.GrantLease(time.Minute)
+		c.Assert(err, IsNil)
+		_, err = a.LockWithOptions(KeyLockType, []string{"shutdown_session"}, LockOptions{Lease: leaseID, Session: true})
+		c.Assert(err, IsNil)
+		_, err = a.LockWithOptions(KeyLockType, []string{"shutdown_http"}, LockOptions{})
+		c.Assert(err, IsNil)
+
+		// an HTTP request in flight is finished
+		httpClient := NewHTTPClient(a.HTTPAddr().String())
+		l, err := httpClient.GetLocker(KeyLockType, "shutdown")
+		c.Assert(err, IsNil)
+		httpErr := make(chan error, 1)
+		go func() {
+			httpErr <- l.LockTimeout(10)
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		timeout := 500 * time.Millisecond
+		if release {
+			timeout = 5 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		done := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			done <- a.Shutdown(ctx)
+		}()
+
+		for !a.isShuttingDown() {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// no new lock or lease
+		_, err = conn.Do("LOCK", "TYPE", "key", "NAMES", "shutdown2")
+		c.Assert(err, NotNil)
+		c.Assert(strings.HasPrefix(err.Error(), "SHUTTINGDOWN "), Equals, true)
+		c.Assert(errors.Is(parseRESPError(err), ErrShuttingDown), Equals, true)
+
+		_, err = a.GrantLease(time.Second)
+		c.Assert(err, Equals, ErrShuttingDown)
+
+		_, err = goredis.Connect(a.RESPAddr().String())
+		c.Assert(err, NotNil)
+
+		if release {
+			_, err = conn.Do("UNLOCK", id)
+			c.Assert(err, IsNil)
+
+			c.Assert(<-done, IsNil)
+			c.Assert(time.Since(start) < 2*time.Second, Equals, true)
+
+			// granted when shutting down
+			c.Assert(<-httpErr, Equals, ErrShuttingDown)
+		} else {
+			c.Assert(<-done, Equals, context.DeadlineExceeded)
+		}
+
+		// the connection is closed and the bound lock is released
+		_, err = conn.Do("UNLOCK", id)
+		c.Assert(err, NotNil)
+		_, ok := err.(goredis.Error)
+		c.Assert(ok, Equals, false)
+
+		// released and audited before Shutdown returns
+		_, ok = a.locks.Get(id)
+		c.Assert(ok, Equals, false)
+		c.Assert(a.locks.Len(), Equals, 3)
+		if !release {
+			r := sink.last(c, 1)[0]
+			c.Assert(r.Event, Equals, AuditForce)
+			c.Assert(r.ID, Equals, id)
+		}
+
+		httpClient.Close()
+		conn.Close()
+		cancel()
+	}
+}
+
+func (s *serverTestSuite) TestConfig(c *C) {
+	dir := c.MkDir()
+
+	path := filepath.Join(dir, "tlock.toml")
+	err := ioutil.WriteFile(path, []byte(`
+http_addr = "127.0.0.1:0"
+default_timeout = "10s"
+max_timeout = "1m"
+path_slot_size = 16
+
+[auth]
+password = "abc"
+`), 0644)
+	c.Assert(err, IsNil)
+
+	cfg, err := LoadConfig(path)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Addr, Equals, defaultRESPAddr)
+	c.Assert(cfg.HTTPAddr, Equals, "127.0.0.1:0")
+	c.Assert(cfg.DefaultTimeout.Duration, Equals, 10*time.Second)
+	c.Assert(cfg.MaxTimeout.Duration, Equals, time.Minute)
+	c.Assert(cfg.ShutdownTimeout.Duration, Equals, defaultShutdownTimeout)
+	c.Assert(cfg.KeySlotSize, Equals, defaultKeySlotSize)
+	c.Assert(cfg.PathSlotSize, Equals, 16)
+	c.Assert(cfg.Auth.Password, Equals, "abc")
+	c.Assert(cfg.Validate(), IsNil)
+
+	// the sample config is valid
+	cfg, err = LoadConfig("etc/tlock.toml")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Validate(), IsNil)
+
+	for _, content := range []string{
+		`unknown = 1`,
+		`[auth]
+pasword = "abc"`,
+		`default_timeout = "10"`,
+		`addr = `,
+	} {
+		err = ioutil.WriteFile(path, []byte(content), 0644)
+		c.Assert(err, IsNil)
+
+		_, err = LoadConfig(path)
+		c.Assert(err, NotNil, Commentf("%s", content))
+	}
+
+	tbl := []struct {
+		update func(cfg *Config)
+		err    string
+	}{
+		{func(cfg *Config) { cfg.Addr = "" }, "no listen address"},
+		{func(cfg *Config) { cfg.DefaultTimeout.Duration = 0 }, "default_timeout"},
+		{func(cfg *Config) { cfg.MaxTimeout.Duration = time.Second }, "max_timeout"},
+		{func(cfg *Config) { cfg.ShutdownTimeout.Duration = -time.Second }, "shutdown_timeout"},
+		{func(cfg *Config) { cfg.PathSlotSize = 0 }, "slot sizes"},
+		{func(cfg *Config) { cfg.TLS.CertFile = "cert.pem" }, "set together"},
+		{func(cfg *Config) { cfg.TLS.RESP = true }, "tls resp"},
+	}
+
+	for _, t := range tbl {
+		cfg := NewConfig()
+		t.update(cfg)
+		err := cfg.Validate()
+		c.Assert(err, NotNil, Commentf("%s", t.err))
+		c.Assert(strings.Contains(err.Error(), t.err), Equals, true, Commentf("%v", err))
+	}
+}
+
+func (s *serverTestSuite) TestRequestTimeout(c *C) {
+	cfg := NewConfig()
+	cfg.DefaultTimeout.Duration = 100 * time.Millisecond
+	cfg.MaxTimeout.Duration = 200 * time.Millisecond
+
+	a := NewAppWithConfig(cfg)
+	c.Assert(a.StartRESP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	c.Assert(a.requestTimeout(0), Equals, 100*time.Millisecond)
+	c.Assert(a.requestTimeout(150*time.Millisecond), Equals, 150*time.Millisecond)
+	c.Assert(a.requestTimeout(time.Hour), Equals, 200*time.Millisecond)
+
+	id, err := a.Lock(KeyLockType, []string{"timeout"})
+	c.Assert(err, IsNil)
+	defer a.Unlock(id)
+
+	client := NewRESPClient(a.RESPAddr().String())
+	defer client.Close()
+
+	l, err := client.GetLocker(KeyLockType, "timeout")
+	c.Assert(err, IsNil)
+
+	for _, timeout := range []time.Duration{0, time.Hour} {
+		t := time.Now()
+		err = l.(DurationLocker).LockTimeoutDuration(timeout)
+		c.Assert(errors.Is(err, ErrLockTimeout), Equals, true, Commentf("%v", err))
+		c.Assert(time.Since(t) < time.Second, Equals, true)
+	}
+}
+
+func (s *serverTestSuite) TestAuth(c *C) {
+	cfg := NewConfig()
+	cfg.Auth.Password = "secret"
+
+	a := NewAppWithConfig(cfg)
+	c.Assert(a.StartRESP("127.0.0.1:0"), IsNil)
+	c.Assert(a.StartHTTP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	_, err := runRESP(a, [][]byte{[]byte("LOCK"), []byte("auth")})
+	c.Assert(err, NotNil)
+	c.Assert(strings.HasPrefix(err.Error(), "NOAUTH "), Equals, true)
+
+	_, err = runRESP(a, [][]byte{[]byte("AUTH"), []byte("wrong")})
+	c.Assert(errors.Is(parseRESPError(err), ErrNoAuth), Equals, true, Commentf("%v", err))
+
+	_, err = runRESP(s.a, [][]byte{[]byte("AUTH"), []byte("secret")})
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidArgument), Equals, true, Commentf("%v", err))
+
+	for _, client := range []interface {
+		Client
+		Close()
+	}{
+		NewRESPClient(a.RESPAddr().String()),
+		NewHTTPClient(a.HTTPAddr().String()),
+	} {
+		l, err := client.GetLocker(KeyLockType, "auth")
+		c.Assert(err, IsNil)
+		err = l.Lock()
+		c.Assert(errors.Is(err, ErrNoAuth), Equals, true, Commentf("%v", err))
+		client.Close()
+	}
+
+	for _, client := range []interface {
+		Client
+		Close()
+	}{
+		NewRESPClientWithConfig(a.RESPAddr().String(), RESPClientConfig{Password: "secret"}),
+		NewHTTPClientWithConfig(a.HTTPAddr().String(), HTTPClientConfig{Password: "secret"}),
+	} {
+		l, err := client.GetLocker(KeyLockType, "auth")
+		c.Assert(err, IsNil)
+		c.Assert(l.Lock(), IsNil)
+		c.Assert(l.Unlock(), IsNil)
+		client.Close()
+	}
+}
+
+func (s *serverTestSuite) TestTLS(c *C) {
+	dir := c.MkDir()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tlock"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+
+	cfg := NewConfig()
+	cfg.TLS.CertFile = filepath.Join(dir, "cert.pem")
+	cfg.TLS.KeyFile = filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(cfg.TLS.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(cfg.TLS.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	c.Assert(err, IsNil)
+
+	a := NewAppWithConfig(cfg)
+	c.Assert(a.StartHTTP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	client := NewHTTPClientWithConfig(a.HTTPAddr().String(), HTTPClientConfig{TLSConfig: &tls.Config{RootCAs: pool}})
+	defer client.Close()
+
+	l, err := client.GetLocker(KeyLockType, "tls")
+	c.Assert(err, IsNil)
+	c.Assert(l.Lock(), IsNil)
+	c.Assert(l.Unlock(), IsNil)
+
+	// plain HTTP is not served
+	plain := NewHTTPClient(a.HTTPAddr().String())
+	defer plain.Close()
+
+	l, err = plain.GetLocker(KeyLockType, "tls")
+	c.Assert(err, IsNil)
+	c.Assert(l.Lock(), NotNil)
+}
+
+type memAuditSink struct {
+	sync.Mutex
+	records []AuditRecord
+}
+
+func (s *memAuditSink) Write(r *AuditRecord) error {
+	s.Lock()
+	s.records = append(s.records, *r)
+	s.Unlock()
+	return nil
+}
+
+func (s *memAuditSink) Close() error {
+	return nil
+}
+
+func (s *memAuditSink) last(c *C, n int) []AuditRecord {
+	s.Lock()
+	defer s.Unlock()
+	c.Assert(len(s.records) >= n, Equals, true, Commentf("%v", s.records))
+	return s.records[len(s.records)-n:]
+}
+
+func (s *serverTestSuite) TestAudit(c *C) {
+	sink := new(memAuditSink)
+
+	a := NewApp()
+	a.SetAuditSink(sink)
+	c.Assert(a.StartRESP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	conn, err := goredis.Connect(a.RESPAddr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	id, err := goredis.Uint64(conn.Do("LOCK", "TYPE", "path", "OWNER", "deployer", "NAMES", "deploy/prod"))
+	c.Assert(err, IsNil)
+
+	r := sink.last(c, 1)[0]
+	c.Assert(r.Event, Equals, AuditGrant)
+	c.Assert(r.ID, Equals, id)
+	c.Assert(r.Type, Equals, PathLockType)
+	c.Assert(r.Names, DeepEquals, []string{"deploy/prod"})
+	c.Assert(r.Owner, Equals, "deployer")
+	c.Assert(strings.HasPrefix(r.Client, "127.0.0.1:"), Equals, true, Commentf(r.Client))
+
+	_, err = a.LockWithOptions(PathLockType, []string{"deploy"}, LockOptions{Timeout: 50 * time.Millisecond, Owner: "other"})
+	c.Assert(err, Equals, ErrLockTimeout)
+
+	r = sink.last(c, 1)[0]
+	c.Assert(r.Event, Equals, AuditTimeout)
+	c.Assert(r.ID, Equals, uint64(0))
+	c.Assert(r.Owner, Equals, "other")
+	c.Assert(r.WaitMs >= 50, Equals, true, Commentf("%v", r.WaitMs))
+
+	time.Sleep(10 * time.Millisecond)
+	_, err = conn.Do("UNLOCK", id)
+	c.Assert(err, IsNil)
+
+	r = sink.last(c, 1)[0]
+	c.Assert(r.Event, Equals, AuditRelease)
+	c.Assert(r.ID, Equals, id)
+	c.Assert(r.Owner, Equals, "deployer")
+	c.Assert(r.HoldMs >= 10, Equals, true, Commentf("%v", r.HoldMs))
+
+	leaseID, err := a.GrantLease(50 * time.Millisecond)
+	c.Assert(err, IsNil)
+	id, err = a.LockLease(KeyLockType, time.Second, leaseID, []string{"audit_lease"})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 100 && a.leaseExists(leaseID); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r = sink.last(c, 1)[0]
+	c.Assert(r.Event, Equals, AuditExpire)
+	c.Assert(r.ID, Equals, id)
+	c.Assert(r.Lease, Equals, leaseID)
+
+	conn2, err := goredis.Connect(a.RESPAddr().String())
+	c.Assert(err, IsNil)
+	id, err = goredis.Uint64(conn2.Do("LOCK", "audit_force"))
+	c.Assert(err, IsNil)
+	conn2.Close()
+
+	for i := 0; i < 100 && a.locks.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r = sink.last(c, 1)[0]
+	c.Assert(r.Event, Equals, AuditForce)
+	c.Assert(r.ID, Equals, id)
+}
+
+func (s *serverTestSuite) TestAuditSink(c *C) {
+	r := &AuditRecord{
+		Time:   time.Now(),
+		Event:  AuditRelease,
+		ID:     1<<63 + 1,
+		Type:   KeyLockType,
+		Names:  []string{"a", "b"},
+		WaitMs: 1.5,
+	}
+
+	var buf bytes.Buffer
+	sink := NewJSONAuditSink(&buf)
+	c.Assert(sink.Write(r), IsNil)
+	c.Assert(sink.Close(), IsNil)
+
+	line := buf.String()
+	c.Assert(strings.HasSuffix(line, "}\n"), Equals, true)
+	c.Assert(strings.Contains(line, `"id":"9223372036854775809"`), Equals, true, Commentf(line))
+	c.Assert(strings.Contains(line, `"owner"`), Equals, false, Commentf(line))
+
+	var r2 AuditRecord
+	c.Assert(json.Unmarshal(buf.Bytes(), &r2), IsNil)
+	c.Assert(r2.ID, Equals, r.ID)
+	c.Assert(r2.Names, DeepEquals, r.Names)
+	c.Assert(r2.WaitMs, Equals, r.WaitMs)
+
+	path := filepath.Join(c.MkDir(), "audit.log")
+	fileSink, err := NewFileAuditSink(AuditConfig{File: path, MaxSize: 1, MaxBackups: 2})
+	c.Assert(err, IsNil)
+
+	// rotate every 2 records
+	fileSink.maxSize = int64(len(line))*2 + 1
+	for i := 0; i < 7; i++ {
+		c.Assert(fileSink.Write(r), IsNil)
+	}
+	c.Assert(fileSink.Close(), IsNil)
+	c.Assert(fileSink.Write(r), NotNil)
+
+	for _, t := range []struct {
+		path  string
+		lines int
+	}{
+		{path, 1},
+		{path + ".1", 2},
+		{path + ".2", 2},
+		{path + ".3", -1},
+	} {
+		b, err := ioutil.ReadFile(t.path)
+		if t.lines < 0 {
+			c.Assert(os.IsNotExist(err), Equals, true, Commentf("%s", t.path))
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(strings.Count(string(b), "\n"), Equals, t.lines, Commentf("%s", t.path))
+	}
+}
+
+func receiveWatchEvent(c *C, conn *goredis.Conn) *WatchEvent {
+	v, err := goredis.MultiBulk(conn.Receive())
+	c.Assert(err, IsNil)
+	c.Assert(v, HasLen, 2)
+	c.Assert(string(v[0].([]byte)), Equals, "event")
+
+	e := new(WatchEvent)
+	c.Assert(json.Unmarshal(v[1].([]byte), e), IsNil)
+	return e
+}
+
+func (s *serverTestSuite) TestWatch(c *C) {
+	a := NewApp()
+	c.Assert(a.StartRESP("127.0.0.1:0"), IsNil)
+	c.Assert(a.StartHTTP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	conn, err := goredis.Connect(a.RESPAddr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	ok, err := goredis.String(conn.Do("WATCH", "TYPE", "path", "NAMES", "deploy"))
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, "OK")
+
+	// not watched
+	id, err := a.LockWithOptions(PathLockType, []string{"other/deploy"}, LockOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(a.Unlock(id), IsNil)
+	id, err = a.LockWithOptions(KeyLockType, []string{"deploy"}, LockOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(a.Unlock(id), IsNil)
+	id, err = a.LockWithOptions(PathLockType, []string{"deploy"}, LockOptions{Separator: "."})
+	c.Assert(err, IsNil)
+	c.Assert(a.Unlock(id), IsNil)
+
+	// the path, the ancestor and the descendant
+	for _, name := range []string{"/deploy/", "deploy/prod", "/"} {
+		id, err = a.LockWithOptions(PathLockType, []string{"other", name}, LockOptions{Owner: "deployer"})
+		if name == "/" {
+			c.Assert(err, NotNil)
+			continue
+		}
+		c.Assert(err, IsNil)
+
+		e := receiveWatchEvent(c, conn)
+		c.Assert(e.Event, Equals, AuditGrant)
+		c.Assert(e.ID, Equals, id)
+		c.Assert(e.Type, Equals, PathLockType)
+		c.Assert(e.Names, DeepEquals, []string{"other", name})
+		c.Assert(e.Owner, Equals, "deployer")
+
+		c.Assert(a.Unlock(id), IsNil)
+
+		e = receiveWatchEvent(c, conn)
+		c.Assert(e.Event, Equals, AuditRelease)
+		c.Assert(e.ID, Equals, id)
+	}
+
+	id, err = a.LockWithOptions(GlobLockType, []string{"*/prod"}, LockOptions{})
+	c.Assert(err, IsNil)
+	e := receiveWatchEvent(c, conn)
+	c.Assert(e.Event, Equals, AuditGrant)
+	c.Assert(e.Type, Equals, GlobLockType)
+	c.Assert(a.Unlock(id), IsNil)
+	receiveWatchEvent(c, conn)
+
+	_, err = conn.Do("LOCK", "a")
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidArgument), Equals, true, Commentf("%v", err))
+
+	ok, err = goredis.String(conn.Do("UNWATCH"))
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, "OK")
+
+	// not watching now
+	id, err = goredis.Uint64(conn.Do("LOCK", "TYPE", "path", "NAMES", "deploy"))
+	c.Assert(err, IsNil)
+	_, err = conn.Do("UNLOCK", id)
+	c.Assert(err, IsNil)
+
+	// key watcher sees the ranges and the lease expiry
+	w, err := a.Watch(KeyLockType, []string{"k5"}, LockOptions{})
+	c.Assert(err, IsNil)
+
+	leaseID, err := a.GrantLease(50 * time.Millisecond)
+	c.Assert(err, IsNil)
+	_, err = a.LockLease(RangeLockType, time.Second, leaseID, []string{"k0", "k9"})
+	c.Assert(err, IsNil)
+
+	c.Assert((<-w.Events()).Event, Equals, AuditGrant)
+	c.Assert((<-w.Events()).Event, Equals, AuditExpire)
+	w.Close()
+
+	_, ok2 := <-w.Events()
+	c.Assert(ok2, Equals, false)
+	c.Assert(w.Overflowed(), Equals, false)
+
+	w, err = a.Watch(KeyLockType, []string{"overflow"}, LockOptions{})
+	c.Assert(err, IsNil)
+	for i := 0; i < watchEventBufferSize; i++ {
+		id, err = a.Lock(KeyLockType, []string{"overflow"})
+		c.Assert(err, IsNil)
+		c.Assert(a.Unlock(id), IsNil)
+	}
+	n := 0
+	for range w.Events() {
+		n++
+	}
+	c.Assert(n, Equals, watchEventBufferSize)
+	c.Assert(w.Overflowed(), Equals, true)
+	w.Close()
+
+	_, err = a.Watch(RangeLockType, []string{"a"}, LockOptions{})
+	c.Assert(err, NotNil)
+	_, err = a.Watch(PathLockType, []string{""}, LockOptions{})
+	c.Assert(err, NotNil)
+
+	r, err := http.Get(fmt.Sprintf("http://%s/lock/watch?type=key&names=sse,b", a.HTTPAddr()))
+	c.Assert(err, IsNil)
+	defer r.Body.Close()
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	c.Assert(r.Header.Get("Content-Type"), Equals, "text/event-stream")
+
+	id, err = a.LockWithOptions(KeyLockType, []string{"sse"}, LockOptions{Owner: "sse"})
+	c.Assert(err, IsNil)
+
+	reader := bufio.NewReader(r.Body)
+	line, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "event: grant\n")
+	line, err = reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(line, "data: "), Equals, true)
+
+	e = new(WatchEvent)
+	c.Assert(json.Unmarshal([]byte(line[len("data: "):]), e), IsNil)
+	c.Assert(e.ID, Equals, id)
+	c.Assert(e.Owner, Equals, "sse")
+
+	// the watchers are closed with the app
+	a.Close()
+	_, err = ioutil.ReadAll(reader)
+	c.Assert(err, IsNil)
+}
+
+func (s *serverTestSuite) TestWaitFree(c *C) {
+	id, err := s.a.LockWithOptions(PathLockType, []string{"migration/x"}, LockOptions{})
+	c.Assert(err, IsNil)
+
+	u := fmt.Sprintf("http://%s/lock/wait?type=path&names=migration,other&timeout_ms=50", s.a.HTTPAddr())
+	r, err := http.Get(u)
+	c.Assert(err, IsNil)
+	r.Body.Close()
+	c.Assert(r.StatusCode, Equals, http.StatusRequestTimeout)
+
+	_, err = runRESP(s.a, [][]byte{[]byte("WAITFREE"), []byte("TYPE"), []byte("glob"), []byte("NAMES"), []byte("migration/*")})
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidArgument), Equals, true, Commentf("%v", err))
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.a.Unlock(id)
+	}()
+
+	t := time.Now()
+	v, err := goredis.String(runRESP(s.a, [][]byte{[]byte("WAITFREE"), []byte("migration/x"), []byte("TYPE"), []byte("path"), []byte("TIMEOUT"), []byte("1")}))
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "OK")
+	c.Assert(time.Since(t) >= 100*time.Millisecond, Equals, true)
+
+	r, err = http.Get(u)
+	c.Assert(err, IsNil)
+	r.Body.Close()
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	// nothing is locked by the waiters
+	c.Assert(strings.Contains(s.getLocks(c), "migration"), Equals, false)
+}
+
+func (s *serverTestSuite) TestStatus(c *C) {
+	a := NewApp()
+	c.Assert(a.StartHTTP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	leaseID, err := a.GrantLease(time.Minute)
+	c.Assert(err, IsNil)
+
+	var ids []uint64
+	for _, t := range []struct {
+		tp    string
+		names []string
+		opts  LockOptions
+	}{
+		{PathLockType, []string{"a/b"}, LockOptions{Owner: "w1", Lease: leaseID}},
+		{PathLockType, []string{"x"}, LockOptions{Mode: LockModeS}},
+		{PathLockType, []string{"a/b"}, LockOptions{Separator: "."}},
+		{GlobLockType, []string{"g/*/c"}, LockOptions{}},
+		{KeyLockType, []string{"k1", "k1"}, LockOptions{}},
+		{RangeLockType, []string{"r0", "r9"}, LockOptions{}},
+	} {
+		id, err := a.LockWithOptions(t.tp, t.names, t.opts)
+		c.Assert(err, IsNil)
+		ids = append(ids, id)
+	}
+
+	statuses, err := a.Status(PathLockType, []string{"/a/b/", "a/b/c", "a", "a/c", "g/b", "g/b/d", "x/y"}, LockOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(statuses, HasLen, 7)
+
+	st := statuses[0]
+	c.Assert(st.Name, Equals, "/a/b/")
+	c.Assert(st.State, Equals, StatusHeld)
+	c.Assert(st.Locks, HasLen, 1)
+	c.Assert(st.Locks[0].ID, Equals, ids[0])
+	c.Assert(st.Locks[0].Owner, Equals, "w1")
+	c.Assert(st.Locks[0].Relation, Equals, "self")
+	c.Assert(st.Locks[0].Mode, Equals, "x")
+	c.Assert(st.Locks[0].TTLMs > 0, Equals, true)
+
+	for i, t := range []struct {
+		state    string
+		id       uint64
+		relation string
+	}{
+		{StatusBlocked, ids[0], "ancestor"},
+		{StatusBlocked, ids[0], "descendant"},
+		{StatusFree, 0, ""},
+		{StatusBlocked, ids[3], "glob"},
+		{StatusFree, 0, ""},
+		{StatusBlocked, ids[1], "ancestor"},
+	} {
+		st := statuses[i+1]
+		c.Assert(st.State, Equals, t.state, Commentf(st.Name))
+		if t.state == StatusFree {
+			c.Assert(st.Locks, HasLen, 0)
+			continue
+		}
+		c.Assert(st.Locks, HasLen, 1, Commentf(st.Name))
+		c.Assert(st.Locks[0].ID, Equals, t.id, Commentf(st.Name))
+		c.Assert(st.Locks[0].Relation, Equals, t.relation, Commentf(st.Name))
+	}
+	c.Assert(statuses[6].Locks[0].Mode, Equals, "s")
+
+	statuses, err = a.Status(PathLockType, []string{"a"}, LockOptions{Separator: "."})
+	c.Assert(err, IsNil)
+	c.Assert(statuses[0].State, Equals, StatusFree)
+
+	_, err = a.Status(GlobLockType, []string{"a"}, LockOptions{})
+	c.Assert(err, NotNil)
+	_, err = a.Status(PathLockType, []string{""}, LockOptions{})
+	c.Assert(err, NotNil)
+
+	// over RESP and HTTP
+	v, err := goredis.MultiBulk(runRESP(a, [][]byte{[]byte("STATUS"), []byte("TYPE"), []byte("key"), []byte("NAMES"), []byte("k1"), []byte("r5"), []byte("k2")}))
+	c.Assert(err, IsNil)
+	c.Assert(v, HasLen, 3)
+
+	statuses = make([]NameStatus, len(v))
+	for i := range v {
+		c.Assert(json.Unmarshal(v[i].([]byte), &statuses[i]), IsNil)
+	}
+
+	r, err := http.Get(fmt.Sprintf("http://%s/lock/status?type=key&names=k1,r5,k2", a.HTTPAddr()))
+	c.Assert(err, IsNil)
+	defer r.Body.Close()
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	var httpStatuses []NameStatus
+	c.Assert(json.NewDecoder(r.Body).Decode(&httpStatuses), IsNil)
+
+	for _, statuses := range [][]NameStatus{statuses, httpStatuses} {
+		c.Assert(statuses, HasLen, 3)
+		c.Assert(statuses[0].State, Equals, StatusHeld)
+		c.Assert(statuses[0].Locks[0].ID, Equals, ids[4])
+		c.Assert(statuses[0].Locks[0].TTLMs, Equals, float64(0))
+		c.Assert(statuses[1].State, Equals, StatusBlocked)
+		c.Assert(statuses[1].Locks[0].ID, Equals, ids[5])
+		c.Assert(statuses[1].Locks[0].Relation, Equals, "range")
+		c.Assert(statuses[2].State, Equals, StatusFree)
+	}
+
+	for _, id := range ids {
+		c.Assert(a.Unlock(id), IsNil)
+	}
+
+	statuses, err = a.Status(PathLockType, []string{"a/b", "a", "g/b", "x/y"}, LockOptions{})
+	c.Assert(err, IsNil)
+	for _, st := range statuses {
+		c.Assert(st.State, Equals, StatusFree, Commentf(st.Name))
+	}
+
+	for i := range a.index.shards {
+		c.Assert(a.index.shards[i].entries, HasLen, 0)
+	}
+	c.Assert(a.index.globs, HasLen, 0)
+	c.Assert(a.index.ranges, HasLen, 0)
+}
+
+func (s *serverTestSuite) TestExtend(c *C) {
+	a := NewApp()
+	c.Assert(a.StartHTTP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	id, err := a.Lock(KeyLockType, []string{"k1"})
+	c.Assert(err, IsNil)
+
+	c.Assert(a.Extend(id, []string{"k1", "k2", "k2"}, 0), IsNil)
+	l, _ := a.locks.Get(id)
+	c.Assert(l.names, DeepEquals, []string{"k1", "k2"})
+
+	_, err = a.LockTimeout(KeyLockType, 10*time.Millisecond, []string{"k2"})
+	c.Assert(err, Equals, ErrLockTimeout)
+
+	statuses, err := a.Status(KeyLockType, []string{"k2"}, LockOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(statuses[0].Locks[0].ID, Equals, id)
+
+	// wait the other holder
+	id2, err := a.Lock(KeyLockType, []string{"k3"})
+	c.Assert(err, IsNil)
+	c.Assert(a.Extend(id, []string{"k3"}, 10*time.Millisecond), Equals, ErrLockTimeout)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		a.Unlock(id2)
+	}()
+	c.Assert(a.Extend(id, []string{"k3"}, time.Second), IsNil)
+
+	// two holders extending to the keys of each other, the key before
+	// the held keys is not waited, so no deadlock even without timeout
+	id2, err = a.Lock(KeyLockType, []string{"k0"})
+	c.Assert(err, IsNil)
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Extend(id2, []string{"k3"}, 0)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	err = a.Extend(id, []string{"k0"}, 0)
+	c.Assert(errors.Is(err, ErrLockTimeout), Equals, true, Commentf("%v", err))
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	c.Assert(a.Unlock(id), IsNil)
+	c.Assert(<-done, IsNil)
+	c.Assert(a.Unlock(id2), IsNil)
+
+	id, err = a.Lock(KeyLockType, []string{"k1", "k2", "k3"})
+	c.Assert(err, IsNil)
+	c.Assert(a.Shrink(id, []string{"k1"}), IsNil)
+	id2, err = a.LockTimeout(KeyLockType, 10*time.Millisecond, []string{"k1"})
+	c.Assert(err, IsNil)
+	c.Assert(a.Unlock(id2), IsNil)
+
+	c.Assert(a.Shrink(id, []string{"k1"}), NotNil)
+	c.Assert(a.Shrink(id, []string{"k2", "k3"}), NotNil)
+	c.Assert(a.Extend(id+1, []string{"k4"}, 0), Equals, ErrNotLocked)
+	c.Assert(a.Shrink(id+1, []string{"k2"}), Equals, ErrNotLocked)
+
+	c.Assert(a.Unlock(id), IsNil)
+	id2, err = a.LockTimeout(KeyLockType, 10*time.Millisecond, []string{"k1", "k2", "k3"})
+	c.Assert(err, IsNil)
+	c.Assert(a.Unlock(id2), IsNil)
+
+	// paths
+	id, err = a.LockWithOptions(PathLockType, []string{"a/b"}, LockOptions{})
+	c.Assert(err, IsNil)
+
+	c.Assert(a.Extend(id, []string{"a/b/c", "a/c"}, 0), IsNil)
+	l, _ = a.locks.Get(id)
+	c.Assert(l.names, DeepEquals, []string{"a/b", "a/c/"})
+
+	err = a.Extend(id, []string{"a"}, 0)
+	c.Assert(errors.Is(err, ErrInvalidArgument), Equals, true, Commentf("%v", err))
+
+	c.Assert(a.Shrink(id, []string{"a/b/c"}), NotNil)
+	c.Assert(a.Shrink(id, []string{"/a/b/"}), IsNil)
+	l, _ = a.locks.Get(id)
+	c.Assert(l.names, DeepEquals, []string{"a/c/"})
+
+	id2, err = a.LockTimeout(PathLockType, 10*time.Millisecond, []string{"a/b"})
+	c.Assert(err, IsNil)
+	c.Assert(a.Unlock(id2), IsNil)
+	_, err = a.LockTimeout(PathLockType, 10*time.Millisecond, []string{"a"})
+	c.Assert(err, Equals, ErrLockTimeout)
+
+	// a/ is held with IX, and an X request waits it, so extending to a/d
+	// can not wait behind the X request, which waits us
+	go func() {
+		done <- func() error {
+			id2, err := a.LockTimeout(PathLockType, time.Second, []string{"a"})
+			if err == nil {
+				err = a.Unlock(id2)
+			}
+			return err
+		}()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	err = a.Extend(id, []string{"a/d"}, 0)
+	c.Assert(errors.Is(err, ErrLockTimeout), Equals, true, Commentf("%v", err))
+	c.Assert(a.Unlock(id), IsNil)
+	c.Assert(<-done, IsNil)
+
+	id, err = a.Lock(GlobLockType, []string{"g/*"})
+	c.Assert(err, IsNil)
+	c.Assert(a.Extend(id, []string{"h/*"}, 0), NotNil)
+	c.Assert(a.Unlock(id), IsNil)
+
+	// over RESP and HTTP
+	id, err = a.Lock(KeyLockType, []string{"resp1"})
+	c.Assert(err, IsNil)
+
+	_, err = runRESP(a, [][]byte{[]byte("EXTEND"), []byte(strconv.FormatUint(id, 10)), []byte("PXTIMEOUT"), []byte("100"), []byte("NAMES"), []byte("resp2")})
+	c.Assert(err, IsNil)
+
+	u := fmt.Sprintf("http://%s/lock/shrink?id=%d&names=resp1", a.HTTPAddr(), id)
+	r, err := http.Post(u, "", nil)
+	c.Assert(err, IsNil)
+	r.Body.Close()
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	_, err = runRESP(a, [][]byte{[]byte("SHRINK"), []byte(strconv.FormatUint(id, 10)), []byte("resp2")})
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidArgument), Equals, true, Commentf("%v", err))
+
+	u = fmt.Sprintf("http://%s/lock/extend?id=%d&names=resp3", a.HTTPAddr(), id)
+	r, err = http.Post(u, "", nil)
+	c.Assert(err, IsNil)
+	r.Body.Close()
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+
+	l, _ = a.locks.Get(id)
+	c.Assert(l.names, DeepEquals, []string{"resp2", "resp3"})
+	c.Assert(a.Unlock(id), IsNil)
+
+	// extend, shrink and unlock at the same time
+	id, err = a.Lock(KeyLockType, []string{"base"})
+	c.Assert(err, IsNil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if a.Extend(id, []string{key}, time.Second) != nil {
+					return
+				}
+				if a.Shrink(id, []string{key}) != nil {
+					return
+				}
+			}
+		}(fmt.Sprintf("concurrent%d", i))
+	}
+
+	time.Sleep(time.Millisecond)
+	c.Assert(a.Unlock(id), IsNil)
+	wg.Wait()
+
+	keys := []string{"base"}
+	for i := 0; i < 8; i++ {
+		keys = append(keys, fmt.Sprintf("concurrent%d", i))
+	}
+	id, err = a.LockTimeout(KeyLockType, 10*time.Millisecond, keys)
+	c.Assert(err, IsNil)
+	c.Assert(a.Unlock(id), IsNil)
+
+	for i := range a.index.shards {
+		c.Assert(a.index.shards[i].entries, HasLen, 0)
+	}
+}
+
+func (s *serverTestSuite) TestTransaction(c *C) {
+	a := NewApp()
+	c.Assert(a.StartRESP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	id1, err := a.Lock(KeyLockType, []string{"k1"})
+	c.Assert(err, IsNil)
+
+	// others wait k1
+	got := make(chan uint64, 1)
+	go func() {
+		id, _ := a.Lock(KeyLockType, []string{"k1"})
+		got <- id
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ids, err := a.Exec([]TxOp{
+		{Cmd: TxUnlock, ID: id1},
+		{Cmd: TxLock, Type: KeyLockType, Names: []string{"k1", "k2"}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(ids, HasLen, 2)
+	c.Assert(ids[0], Equals, uint64(0))
+	id2 := ids[1]
+
+	// k1 is handed over, never released
+	select {
+	case <-got:
+		c.Fatal("k1 is released in the transaction")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.Assert(a.Unlock(id1), Equals, ErrNotLocked)
+	c.Assert(a.Unlock(id2), IsNil)
+
+	id := <-got
+	c.Assert(a.Unlock(id), IsNil)
+
+	// rollback
+	id1, err = a.Lock(KeyLockType, []string{"k3"})
+	c.Assert(err, IsNil)
+	id2, err = a.Lock(KeyLockType, []string{"k4"})
+	c.Assert(err, IsNil)
+
+	_, err = a.Exec([]TxOp{
+		{Cmd: TxUnlock, ID: id1},
+		{Cmd: TxLock, Type: KeyLockType, Names: []string{"k5"}},
+		{Cmd: TxLock, Type: KeyLockType, Names: []string{"k4"}, Options: LockOptions{Timeout: 10 * time.Millisecond}},
+	})
+	c.Assert(errors.Is(err, ErrLockTimeout), Equals, true)
+	c.Assert(err, ErrorMatches, "command 3 LOCK: .*")
+
+	_, err = a.LockTimeout(KeyLockType, 10*time.Millisecond, []string{"k3"})
+	c.Assert(err, Equals, ErrLockTimeout)
+	id, err = a.LockTimeout(KeyLockType, 10*time.Millisecond, []string{"k5"})
+	c.Assert(err, IsNil)
+	c.Assert(a.Unlock(id), IsNil)
+
+	// the names of all commands are locked in order, so the opposing
+	// transactions never deadlock without timeout
+	done := make(chan error, 2)
+	for _, names := range [][]string{{"ta", "tb"}, {"tb", "ta"}} {
+		go func(names []string) {
+			for i := 0; i < 100; i++ {
+				ids, err := a.Exec([]TxOp{
+					{Cmd: TxLock, Type: KeyLockType, Names: names[0:1]},
+					{Cmd: TxLock, Type: KeyLockType, Names: names[1:2]},
+				})
+				if err == nil {
+					_, err = a.Exec([]TxOp{{Cmd: TxUnlock, ID: ids[0]}, {Cmd: TxUnlock, ID: ids[1]}})
+				}
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}(names)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			c.Assert(err, IsNil)
+		case <-time.After(10 * time.Second):
+			c.Fatal("the opposing transactions deadlock")
+		}
+	}
+
+	// a key conflicts with a range containing it, tx1 holds tb and its
+	// range waits tcc, then tx2 holds tce and its range waits tb, and tx1
+	// would wait tce when tcc is released. The range after the key is not
+	// waited, so tx1 fails at once instead.
+	id, err = a.Lock(KeyLockType, []string{"tcc"})
+	c.Assert(err, IsNil)
+
+	results := make(chan []uint64, 2)
+	for _, ops := range [][]TxOp{
+		{{Cmd: TxLock, Type: KeyLockType, Names: []string{"tb"}}, {Cmd: TxLock, Type: RangeLockType, Names: []string{"tc", "td"}}},
+		{{Cmd: TxLock, Type: KeyLockType, Names: []string{"tce"}}, {Cmd: TxLock, Type: RangeLockType, Names: []string{"ta", "tbb"}}},
+	} {
+		go func(ops []TxOp) {
+			ids, err := a.Exec(ops)
+			if err != nil && !errors.Is(err, ErrLockTimeout) {
+				done <- err
+				return
+			}
+			results <- ids
+		}(ops)
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.Assert(a.Unlock(id), IsNil)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			c.Fatal(err)
+		case ids := <-results:
+			for _, id := range ids {
+				c.Assert(a.Unlock(id), IsNil)
+			}
+		case <-time.After(5 * time.Second):
+			c.Fatal("the key and range transactions deadlock")
+		}
+	}
+	c.Assert(a.locks.Len(), Equals, 2)
+
+	_, err = a.Exec([]TxOp{
+		{Cmd: TxLock, Type: KeyLockType, Names: []string{"k5", "k6"}},
+		{Cmd: TxLock, Type: KeyLockType, Names: []string{"k6"}},
+	})
+	c.Assert(errors.Is(err, ErrInvalidArgument), Equals, true, Commentf("%v", err))
+	c.Assert(err, ErrorMatches, "command 2 LOCK: .*")
+
+	// extend with the names handed over
+	ids, err = a.Exec([]TxOp{
+		{Cmd: TxExtend, ID: id1, Names: []string{"k4", "k6"}},
+		{Cmd: TxUnlock, ID: id2},
+	})
+	c.Assert(err, IsNil)
+
+	l, _ := a.locks.Get(id1)
+	c.Assert(l.names, DeepEquals, []string{"k3", "k4", "k6"})
+	c.Assert(a.Unlock(id2), Equals, ErrNotLocked)
+	c.Assert(a.Unlock(id1), IsNil)
+
+	// paths in the same mode are handed over
+	id1, err = a.LockWithOptions(PathLockType, []string{"a/b", "a/c"}, LockOptions{Mode: LockModeS})
+	c.Assert(err, IsNil)
+
+	ids, err = a.Exec([]TxOp{
+		{Cmd: TxUnlock, ID: id1},
+		{Cmd: TxLock, Type: PathLockType, Names: []string{"/a/b/"}, Options: LockOptions{Mode: LockModeS}},
+	})
+	c.Assert(err, IsNil)
+	id2 = ids[1]
+
+	id, err = a.LockTimeout(PathLockType, 10*time.Millisecond, []string{"a/c"})
+	c.Assert(err, IsNil)
+	c.Assert(a.Unlock(id), IsNil)
+	_, err = a.LockTimeout(PathLockType, 10*time.Millisecond, []string{"a/b"})
+	c.Assert(err, Equals, ErrLockTimeout)
+
+	// in another mode, it waits itself
+	_, err = a.Exec([]TxOp{
+		{Cmd: TxUnlock, ID: id2},
+		{Cmd: TxLock, Type: PathLockType, Names: []string{"a/b"}, Options: LockOptions{Timeout: 10 * time.Millisecond}},
+	})
+	c.Assert(errors.Is(err, ErrLockTimeout), Equals, true)
+	c.Assert(a.Unlock(id2), IsNil)
+
+	// ranges are released, renew and lease
+	id1, err = a.Lock(RangeLockType, []string{"a", "c"})
+	c.Assert(err, IsNil)
+
+	lease, err := a.GrantLease(time.Minute)
+	c.Assert(err, IsNil)
+
+	ids, err = a.Exec([]TxOp{
+		{Cmd: TxRenew, ID: lease},
+		{Cmd: TxUnlock, ID: id1},
+		{Cmd: TxLock, Type: KeyLockType, Names: []string{"k7"}, Options: LockOptions{Lease: lease}},
+	})
+	c.Assert(err, IsNil)
+
+	id, err = a.LockTimeout(RangeLockType, 10*time.Millisecond, []string{"b", "d"})
+	c.Assert(err, IsNil)
+	c.Assert(a.Unlock(id), IsNil)
+
+	c.Assert(a.RevokeLease(lease), IsNil)
+	c.Assert(a.Unlock(ids[2]), Equals, ErrNotLocked)
+
+	// invalid transactions change nothing
+	id1, err = a.Lock(KeyLockType, []string{"k8"})
+	c.Assert(err, IsNil)
+
+	for _, ops := range [][]TxOp{
+		nil,
+		{{Cmd: TxUnlock, ID: id1}, {Cmd: TxUnlock, ID: id1}},
+		{{Cmd: TxUnlock, ID: id1}, {Cmd: TxExtend, ID: id1, Names: []string{"k9"}}},
+		{{Cmd: TxUnlock, ID: id1}, {Cmd: TxUnlock, ID: id1 + 1}},
+		{{Cmd: TxUnlock, ID: id1}, {Cmd: TxRenew, ID: lease}},
+		{{Cmd: TxUnlock, ID: id1}, {Cmd: "GRANT"}},
+		{{Cmd: TxUnlock, ID: id1}, {Cmd: TxLock, Type: "unknown", Names: []string{"k9"}}},
+	} {
+		_, err = a.Exec(ops)
+		c.Assert(err, NotNil)
+	}
+	c.Assert(a.Unlock(id1), IsNil)
+
+	// over RESP
+	conn, err := goredis.Connect(a.RESPAddr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	v, err := goredis.String(conn.Do("LOCK", "NAMES", "r1"))
+	c.Assert(err, IsNil)
+	rid1, _ := strconv.ParseUint(v, 10, 64)
+
+	_, err = conn.Do("EXEC")
+	c.Assert(err, NotNil)
+
+	v, err = goredis.String(conn.Do("MULTI"))
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "OK")
+	v, err = goredis.String(conn.Do("UNLOCK", rid1))
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "QUEUED")
+	v, err = goredis.String(conn.Do("LOCK", "NAMES", "r1", "r2"))
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "QUEUED")
+
+	replies, err := goredis.MultiBulk(conn.Do("EXEC"))
+	c.Assert(err, IsNil)
+	c.Assert(replies, HasLen, 2)
+	c.Assert(string(replies[0].([]byte)), Equals, "OK")
+	rid2, err := strconv.ParseUint(string(replies[1].([]byte)), 10, 64)
+	c.Assert(err, IsNil)
+
+	l, ok := a.locks.Get(rid2)
+	c.Assert(ok, Equals, true)
+	c.Assert(l.names, DeepEquals, []string{"r1", "r2"})
+
+	// an error when queuing discards the transaction
+	_, err = conn.Do("MULTI")
+	c.Assert(err, IsNil)
+	_, err = conn.Do("UNLOCK", rid2)
+	c.Assert(err, IsNil)
+	_, err = conn.Do("STATUS", "NAMES", "r1")
+	c.Assert(err, NotNil)
+	_, err = conn.Do("EXEC")
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidArgument), Equals, true, Commentf("%v", err))
+
+	_, err = conn.Do("MULTI")
+	c.Assert(err, IsNil)
+	_, err = conn.Do("UNLOCK", rid2)
+	c.Assert(err, IsNil)
+	_, err = conn.Do("DISCARD")
+	c.Assert(err, IsNil)
+	_, ok = a.locks.Get(rid2)
+	c.Assert(ok, Equals, true)
+
+	// the locks granted in the transaction are released when disconnected
+	conn.Close()
+	for i := 0; i < 100 && a.locks.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(a.locks.Len(), Equals, 0)
+
+	for i := range a.index.shards {
+		c.Assert(a.index.shards[i].entries, HasLen, 0)
+	}
+}
+
+func (s *serverTestSuite) TestTransfer(c *C) {
+	a := NewApp()
+	c.Assert(a.StartRESP("127.0.0.1:0"), IsNil)
+	c.Assert(a.StartHTTP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	scheduler, err := goredis.Connect(a.RESPAddr().String())
+	c.Assert(err, IsNil)
+	defer scheduler.Close()
+
+	v, err := goredis.String(scheduler.Do("LOCK", "OWNER", "scheduler", "NAMES", "job"))
+	c.Assert(err, IsNil)
+	id, _ := strconv.ParseUint(v, 10, 64)
+
+	token, err := goredis.String(scheduler.Do("TRANSFER", id, "TO", "worker"))
+	c.Assert(err, IsNil)
+
+	_, err = scheduler.Do("TRANSFER", id, "TO", "worker")
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidArgument), Equals, true, Commentf("%v", err))
+
+	// the scheduler's disconnect does not release it
+	scheduler.Close()
+	time.Sleep(50 * time.Millisecond)
+	_, ok := a.locks.Get(id)
+	c.Assert(ok, Equals, true)
+
+	worker, err := goredis.Connect(a.RESPAddr().String())
+	c.Assert(err, IsNil)
+	defer worker.Close()
+
+	_, err = worker.Do("REDEEM", token, "OWNER", "other")
+	c.Assert(errors.Is(parseRESPError(err), ErrNotOwner), Equals, true, Commentf("%v", err))
+
+	v, err = goredis.String(worker.Do("REDEEM", token, "OWNER", "worker"))
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, strconv.FormatUint(id, 10))
+
+	l, _ := a.locks.Get(id)
+	c.Assert(l.opts.Owner, Equals, "worker")
+
+	_, err = worker.Do("REDEEM", token)
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidArgument), Equals, true, Commentf("%v", err))
+
+	// the worker's disconnect releases it
+	worker.Close()
+	for i := 0; i < 100 && a.locks.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(a.locks.Len(), Equals, 0)
+
+	// transferred over HTTP or another connection, the owner's
+	// disconnect does not release it either
+	for _, viaHTTP := range []bool{true, false} {
+		owner, err := goredis.Connect(a.RESPAddr().String())
+		c.Assert(err, IsNil)
+		v, err = goredis.String(owner.Do("LOCK", "NAMES", "job"))
+		c.Assert(err, IsNil)
+		id, _ = strconv.ParseUint(v, 10, 64)
+
+		if viaHTTP {
+			u := fmt.Sprintf("http://%s/lock/transfer?id=%d&to=worker", a.HTTPAddr(), id)
+			r, err := http.Post(u, "", nil)
+			c.Assert(err, IsNil)
+			c.Assert(r.StatusCode, Equals, http.StatusOK)
+			buf, _ := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			token = string(buf)
+		} else {
+			other, err := goredis.Connect(a.RESPAddr().String())
+			c.Assert(err, IsNil)
+			token, err = goredis.String(other.Do("TRANSFER", id, "TO", "worker"))
+			c.Assert(err, IsNil)
+			other.Close()
+		}
+
+		worker, err := goredis.Connect(a.RESPAddr().String())
+		c.Assert(err, IsNil)
+		_, err = worker.Do("REDEEM", token)
+		c.Assert(err, IsNil)
+
+		owner.Close()
+		time.Sleep(50 * time.Millisecond)
+		_, ok := a.locks.Get(id)
+		c.Assert(ok, Equals, true, Commentf("via HTTP %v", viaHTTP))
+
+		worker.Close()
+		for i := 0; i < 100 && a.locks.Len() > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(a.locks.Len(), Equals, 0)
+	}
+
+	// not redeemed in time
+	id, err = a.Lock(KeyLockType, []string{"job"})
+	c.Assert(err, IsNil)
+	token, err = a.Transfer(id, "worker", 0, 20*time.Millisecond)
+	c.Assert(err, IsNil)
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(a.Unlock(id), Equals, ErrNotLocked)
+	_, err = a.Redeem(token, "")
+	c.Assert(err, NotNil)
+
+	// unlocking drops the transfer
+	id, err = a.Lock(KeyLockType, []string{"job"})
+	c.Assert(err, IsNil)
+	token, err = a.Transfer(id, "worker", 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(a.Unlock(id), IsNil)
+	c.Assert(a.transfers, HasLen, 0)
+	c.Assert(a.transferLocks, HasLen, 0)
+
+	// to the session with another lease
+	lease1, err := a.GrantLease(time.Minute)
+	c.Assert(err, IsNil)
+	lease2, err := a.GrantLease(time.Minute)
+	c.Assert(err, IsNil)
+
+	id, err = a.LockLease(KeyLockType, 0, lease1, []string{"job"})
+	c.Assert(err, IsNil)
+
+	_, err = a.Transfer(id, "", lease2+1, 0)
+	c.Assert(err, Equals, ErrLeaseNotFound)
+	_, err = a.Transfer(id, "", 0, 0)
+	c.Assert(err, NotNil)
+
+	u := fmt.Sprintf("http://%s/lock/transfer?id=%d&lease=%d", a.HTTPAddr(), id, lease2)
+	r, err := http.Post(u, "", nil)
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	buf, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+
+	u = fmt.Sprintf("http://%s/lock/redeem?token=%s", a.HTTPAddr(), buf)
+	r, err = http.Post(u, "", nil)
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusOK)
+	buf, _ = ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	c.Assert(string(buf), Equals, strconv.FormatUint(id, 10))
+
+	c.Assert(a.RevokeLease(lease1), IsNil)
+	l, ok = a.locks.Get(id)
+	c.Assert(ok, Equals, true)
+	c.Assert(l.opts.Lease, Equals, lease2)
+	c.Assert(l.opts.Session, Equals, true)
+
+	// redeemed into the session over RESP, the redeeming connection
+	// does not own it, its disconnect does not release it
+	id, err = a.Lock(KeyLockType, []string{"job2"})
+	c.Assert(err, IsNil)
+	token, err = a.Transfer(id, "", lease2, 0)
+	c.Assert(err, IsNil)
+
+	conn, err := goredis.Connect(a.RESPAddr().String())
+	c.Assert(err, IsNil)
+	v, err = goredis.String(conn.Do("REDEEM", token))
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, strconv.FormatUint(id, 10))
+
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	l, ok = a.locks.Get(id)
+	c.Assert(ok, Equals, true)
+	c.Assert(l.opts.Session, Equals, true)
+
+	c.Assert(a.RevokeLease(lease2), IsNil)
+	c.Assert(a.locks.Len(), Equals, 0)
+	c.Assert(a.transferCount, Equals, int32(0))
+}
+
+func (s *serverTestSuite) TestDetach(c *C) {
+	a := NewApp()
+	c.Assert(a.StartRESP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	conn1, err := goredis.Connect(a.RESPAddr().String())
+	c.Assert(err, IsNil)
+	defer conn1.Close()
+
+	_, err = conn1.Do("LOCK", "DETACH", 0, "NAMES", "d1")
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidArgument), Equals, true, Commentf("%v", err))
+	_, err = conn1.Do("LOCK", "DETACH", 10, "LEASE", 1, "NAMES", "d1")
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidArgument), Equals, true, Commentf("%v", err))
+
+	v, err := goredis.String(conn1.Do("LOCK", "DETACH", 10, "NAMES", "d1"))
+	c.Assert(err, IsNil)
+	id1, _ := strconv.ParseUint(v, 10, 64)
+
+	v, err = goredis.String(conn1.Do("LOCK", "PERSIST", 10, "NAMES", "d2"))
+	c.Assert(err, IsNil)
+	id2, _ := strconv.ParseUint(v, 10, 64)
+
+	_, err = conn1.Do("MULTI")
+	c.Assert(err, IsNil)
+	_, err = conn1.Do("LOCK", "DETACH", 10, "NAMES", "d3")
+	c.Assert(err, IsNil)
+	replies, err := goredis.MultiBulk(conn1.Do("EXEC"))
+	c.Assert(err, IsNil)
+	id3, _ := strconv.ParseUint(string(replies[0].([]byte)), 10, 64)
+
+	// survive the disconnect
+	conn1.Close()
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(a.locks.Len(), Equals, 3)
+
+	conn2, err := goredis.Connect(a.RESPAddr().String())
+	c.Assert(err, IsNil)
+	defer conn2.Close()
+
+	// renew and release with the lock id from another connection
+	_, err = conn2.Do("RENEW", id1)
+	c.Assert(err, IsNil)
+	_, err = conn2.Do("UNLOCK", id1)
+	c.Assert(err, IsNil)
+	c.Assert(a.leaseExists(id1), Equals, false)
+
+	_, err = conn2.Do("REVOKE", id2)
+	c.Assert(err, IsNil)
+	_, ok := a.locks.Get(id2)
+	c.Assert(ok, Equals, false)
+
+	// a redeemed lock is bound to the receiver
+	token, err := goredis.String(conn2.Do("TRANSFER", id3, "TO", "worker"))
+	c.Assert(err, IsNil)
+	_, err = conn2.Do("REDEEM", token)
+	c.Assert(err, IsNil)
+	c.Assert(a.leaseExists(id3), Equals, false)
+
+	conn2.Close()
+	for i := 0; i < 100 && a.locks.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(a.locks.Len(), Equals, 0)
+
+	// expire if not renewed
+	_, err = a.LockWithOptions(KeyLockType, []string{"d4"}, LockOptions{Detach: 20 * time.Millisecond})
+	c.Assert(err, IsNil)
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(a.locks.Len(), Equals, 0)
+
+	a.leasesMutex.Lock()
+	c.Assert(a.leases, HasLen, 0)
+	a.leasesMutex.Unlock()
+}
+
+// closeRESPConns breaks the RESP connections from the server side
+func closeRESPConns(a *App) {
+	a.connsMutex.Lock()
+	for c := range a.conns {
+		c.Close()
+	}
+	a.connsMutex.Unlock()
+}
+
+func (s *serverTestSuite) TestRESPClientLost(c *C) {
+	a := NewApp()
+	c.Assert(a.StartRESP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	lost := make(chan error, 1)
+	client := NewRESPClientWithConfig(a.RESPAddr().String(), RESPClientConfig{
+		CheckInterval: 20 * time.Millisecond,
+		OnLost: func(l ClientLocker, err error) {
+			lost <- err
+		},
+	})
+	defer client.Close()
+
+	l, err := client.GetLocker(KeyLockType, "lost")
+	c.Assert(err, IsNil)
+	c.Assert(l.(LostLocker).Lost(), IsNil)
+
+	c.Assert(l.Lock(), IsNil)
+	ch := l.(LostLocker).Lost()
+
+	// alive
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-ch:
+		c.Fatal("the lock is lost")
+	default:
+	}
+
+	closeRESPConns(a)
+
+	select {
+	case err = <-lost:
+		c.Assert(err, NotNil)
+	case <-time.After(time.Second):
+		c.Fatal("the lost lock is not notified")
+	}
+	<-ch
+
+	c.Assert(errors.Is(l.Unlock(), ErrNotLocked), Equals, true)
+	for i := 0; i < 100 && a.locks.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(a.locks.Len(), Equals, 0)
+
+	// lock again after lost
+	c.Assert(l.Lock(), IsNil)
+	c.Assert(l.Unlock(), IsNil)
+
+	// a detached lock reattaches
+	detached := NewRESPClientWithConfig(a.RESPAddr().String(), RESPClientConfig{
+		CheckInterval: 20 * time.Millisecond,
+		Detach:        time.Second,
+		OnLost: func(l ClientLocker, err error) {
+			lost <- err
+		},
+	})
+	defer detached.Close()
+
+	l, err = detached.GetLocker(KeyLockType, "detached")
+	c.Assert(err, IsNil)
+	c.Assert(l.Lock(), IsNil)
+	ch = l.(LostLocker).Lost()
+
+	for i := 0; i < 3; i++ {
+		closeRESPConns(a)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	select {
+	case <-ch:
+		c.Fatal("the detached lock is lost")
+	default:
+	}
+	c.Assert(a.locks.Len(), Equals, 1)
+
+	// renewed after reattached, the ttl is 1s
+	time.Sleep(time.Second)
+	c.Assert(a.locks.Len(), Equals, 1)
+
+	closeRESPConns(a)
+	c.Assert(l.Unlock(), IsNil)
+	c.Assert(a.locks.Len(), Equals, 0)
+
+	// lost if released by others
+	c.Assert(l.Lock(), IsNil)
+	ch = l.(LostLocker).Lost()
+	c.Assert(a.Unlock(a.locks.Snapshot()[0].id), IsNil)
+
+	select {
+	case err = <-lost:
+		c.Assert(errors.Is(err, ErrLeaseNotFound), Equals, true, Commentf("%v", err))
+	case <-time.After(time.Second):
+		c.Fatal("the lost lock is not notified")
+	}
+	<-ch
+	c.Assert(errors.Is(l.Unlock(), ErrNotLocked), Equals, true)
+}
+
+// respConnCount returns the number of the RESP connections of the server
+func respConnCount(a *App) int {
+	a.connsMutex.Lock()
+	defer a.connsMutex.Unlock()
+	return len(a.conns)
+}
+
+func (s *serverTestSuite) TestSessionLock(c *C) {
+	a := NewApp()
+	c.Assert(a.StartRESP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	conn, err := goredis.Connect(a.RESPAddr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = conn.Do("LOCK", "SESSION", 0, "NAMES", "s1")
+	c.Assert(errors.Is(parseRESPError(err), ErrInvalidArgument), Equals, true, Commentf("%v", err))
+
+	lease, err := a.GrantLease(time.Minute)
+	c.Assert(err, IsNil)
+
+	_, err = goredis.String(conn.Do("LOCK", "SESSION", lease, "NAMES", "s1"))
+	c.Assert(err, IsNil)
+	_, err = goredis.String(conn.Do("LOCK", "LEASE", lease, "NAMES", "s2"))
+	c.Assert(err, IsNil)
+
+	// the session lock is not tied to the connection
+	conn.Close()
+	for i := 0; i < 100 && a.locks.Len() > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(a.locks.Len(), Equals, 1)
+	c.Assert(a.locks.Snapshot()[0].names, DeepEquals, []string{"s1"})
+
+	c.Assert(a.RevokeLease(lease), IsNil)
+	c.Assert(a.locks.Len(), Equals, 0)
+}
+
+func (s *serverTestSuite) TestRESPClientConnections(c *C) {
+	a := NewApp()
+	c.Assert(a.StartRESP("127.0.0.1:0"), IsNil)
+	defer a.Close()
+
+	const (
+		workers = 8
+		locks   = 2000
+	)
+
+	client := NewRESPClientWithConfig(a.RESPAddr().String(), RESPClientConfig{MaxIdleConns: workers})
+	defer client.Close()
+
+	session, err := client.NewSession(10)
+	c.Assert(err, IsNil)
+
+	lockers := make([]ClientLocker, locks)
+	for i := range lockers {
+		lockers[i], err = session.GetLocker(KeyLockType, fmt.Sprintf("load-%d", i))
+		c.Assert(err, IsNil)
+	}
+
+	run := func(f func(l ClientLocker) error) {
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < locks; i += workers {
+					c.Check(f(lockers[i]), IsNil)
+				}
+			}(w)
+		}
+		wg.Wait()
+	}
+
+	run(func(l ClientLocker) error { return l.Lock() })
+	c.Assert(a.locks.Len(), Equals, locks)
+
+	// at most one connection for each worker and the session renewing
+	held := respConnCount(a)
+	c.Logf("%d session locks held over %d connections", locks, held)
+	c.Assert(held <= workers+1, Equals, true, Commentf("%d connections", held))
+
+	run(func(l ClientLocker) error { return l.Unlock() })
+	c.Assert(a.locks.Len(), Equals, 0)
+
+	// the lockers without a session hold a connection each, the pool
+	// does not help them, see RESPClientConfig MaxIdleConns
+	const bound = 100
+	plain := NewRESPClientWithConfig(a.RESPAddr().String(), RESPClientConfig{CheckInterval: time.Minute})
+	defer plain.Close()
+
+	for i := 0; i < bound; i++ {
+		lockers[i], err = plain.GetLocker(KeyLockType, fmt.Sprintf("bound-%d", i))
+		c.Assert(err, IsNil)
+		c.Assert(lockers[i].Lock(), IsNil)
+	}
+
+	n := respConnCount(a)
+	c.Logf("%d bound locks held over %d connections", bound, n)
+	c.Assert(n >= bound, Equals, true, Commentf("%d connections", n))
+
+	for i := 0; i < bound; i++ {
+		c.Assert(lockers[i].Unlock(), IsNil)
+	}
+
+	// the lockers of GetLocker with SessionTTL are in the client session,
+	// count the connections besides the idle ones of the clients above
+	base := respConnCount(a)
+	shared := NewRESPClientWithConfig(a.RESPAddr().String(), RESPClientConfig{MaxIdleConns: workers, SessionTTL: 10 * time.Second})
+	defer shared.Close()
+
+	for i := range lockers {
+		lockers[i], err = shared.GetLocker(KeyLockType, fmt.Sprintf("shared-%d", i))
+		c.Assert(err, IsNil)
+	}
+
+	run(func(l ClientLocker) error { return l.Lock() })
+	c.Assert(a.locks.Len(), Equals, locks)
+
+	held = respConnCount(a) - base
+	c.Logf("%d client session locks held over %d connections", locks, held)
+	c.Assert(held <= workers+1, Equals, true, Commentf("%d connections", held))
+
+	// all in the same session, lost together
+	lost := lockers[0].(LostLocker).Lost()
+	c.Assert(lockers[locks-1].(LostLocker).Lost() == lost, Equals, true)
+
+	run(func(l ClientLocker) error { return l.Unlock() })
+	c.Assert(a.locks.Len(), Equals, 0)
+
+	// closing the client releases the locks of its session
+	c.Assert(lockers[0].Lock(), IsNil)
+	shared.Close()
+	c.Assert(a.locks.Len(), Equals, 0)
+
+	c.Assert(session.Close(), IsNil)
+}
+
+// BenchmarkRESPSessionLock holds b.N locks of a session, and reports the
+// connections used, like go test -bench RESPSession -benchtime 10000x
+func BenchmarkRESPSessionLock(b *testing.B) {
+	a := NewApp()
+	if err := a.StartRESP("127.0.0.1:0"); err != nil {
+		b.Fatal(err)
+	}
+	defer a.Close()
+
+	client := NewRESPClientWithConfig(a.RESPAddr().String(), RESPClientConfig{MaxIdleConns: 16})
+	defer client.Close()
+
+	session, err := client.NewSession(60)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer session.Close()
+
+	var n int32
+	lockers := make(chan ClientLocker, b.N)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l, _ := session.GetLocker(KeyLockType, fmt.Sprintf("bench-%d", atomic.AddInt32(&n, 1)))
+			if err := l.Lock(); err != nil {
+				b.Error(err)
+				return
+			}
+			lockers <- l
+		}
+	})
+	b.StopTimer()
+
+	b.ReportMetric(float64(a.locks.Len()), "locks")
+	b.ReportMetric(float64(respConnCount(a)), "conns")
+
+	close(lockers)
+	for l := range lockers {
+		l.Unlock()
+	}
+}
@@ -0,0 +1,220 @@
+package tlock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEvent is the event of an audit record
+type AuditEvent string
+
+const (
+	// the lock is granted
+	AuditGrant AuditEvent = "grant"
+	// the lock is released by the holder, or its lease is revoked
+	AuditRelease AuditEvent = "release"
+	// the lock is not granted or extended in the timeout, the record of
+	// a lock not granted has no lock id
+	AuditTimeout AuditEvent = "timeout"
+	// the lock is released because its lease expires, or its transfer
+	// is not redeemed in time
+	AuditExpire AuditEvent = "expire"
+	// the lock is released because its RESP connection is closed
+	AuditForce AuditEvent = "force"
+	// the names are added to the lock, the record has the added names
+	AuditExtend AuditEvent = "extend"
+	// the names are released from the lock, the record has the released names
+	AuditShrink AuditEvent = "shrink"
+	// the lock is redeemed by the receiver of a transfer, the record has
+	// the new owner and lease
+	AuditTransfer AuditEvent = "transfer"
+)
+
+// AuditRecord is one line of the audit log
+type AuditRecord struct {
+	Time  time.Time  `json:"time"`
+	Event AuditEvent `json:"event"`
+
+	// the lock id is a string in JSON, it is too large for a float64
+	ID    uint64   `json:"id,string,omitempty"`
+	Type  string   `json:"type"`
+	Names []string `json:"names"`
+
+	// the remote address of the RESP or HTTP client, see LockOptions
+	Client string `json:"client,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	Lease  uint64 `json:"lease,string,omitempty"`
+
+	// the milliseconds waiting for the lock, and holding it until released
+	WaitMs float64 `json:"wait_ms"`
+	HoldMs float64 `json:"hold_ms,omitempty"`
+}
+
+// AuditSink receives the audit records, see App SetAuditSink.
+// Write is called concurrently and on the lock path, so it should be fast.
+type AuditSink interface {
+	Write(r *AuditRecord) error
+	Close() error
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d/time.Microsecond) / 1000
+}
+
+// jsonAuditSink writes the records as JSON lines
+type jsonAuditSink struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+// NewJSONAuditSink writes the records as JSON lines to w,
+// Close does not close w.
+func NewJSONAuditSink(w io.Writer) AuditSink {
+	return &jsonAuditSink{w: w}
+}
+
+func (s *jsonAuditSink) Write(r *AuditRecord) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	s.m.Lock()
+	_, err = s.w.Write(buf)
+	s.m.Unlock()
+	return err
+}
+
+func (s *jsonAuditSink) Close() error {
+	return nil
+}
+
+// FileAuditSink writes the records as JSON lines to a file, when the file
+// exceeds the max size, it is renamed to file.1, the older file.1 to file.2,
+// and so on, the files beyond the max backups are removed.
+type FileAuditSink struct {
+	m sync.Mutex
+
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// NewFileAuditSink opens the audit file in cfg, see AuditConfig
+func NewFileAuditSink(cfg AuditConfig) (*FileAuditSink, error) {
+	if len(cfg.File) == 0 {
+		return nil, invalidArgumentf("empty audit file")
+	}
+
+	s := new(FileAuditSink)
+	s.path = cfg.File
+	s.maxSize = cfg.MaxSize * 1024 * 1024
+	s.maxBackups = cfg.MaxBackups
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileAuditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.f = f
+	s.size = st.Size()
+	return nil
+}
+
+func (s *FileAuditSink) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
+
+func (s *FileAuditSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+
+	if s.maxBackups == 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.open()
+	}
+
+	os.Remove(s.backupPath(s.maxBackups))
+	for i := s.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(s.backupPath(i), s.backupPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Rename(s.path, s.backupPath(1)); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileAuditSink) Write(r *AuditRecord) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	if s.f == nil {
+		// the last rotation failed, try again
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(buf)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.f.Write(buf)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileAuditSink) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.closed = true
+	if s.f == nil {
+		return nil
+	}
+
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"log"
 	"os"
 	"os/signal"
 	"runtime"
@@ -10,19 +12,114 @@ import (
 	"github.com/siddontang/tlock"
 )
 
-var addr = flag.String("addr", "127.0.0.1:13000", "http listen address")
-var httpAddr = flag.String("http_addr", "", "http listen address")
+// the flag defaults are the config defaults
+var defaults = tlock.NewConfig()
+
+var configFile = flag.String("config", "", "config file, see etc/tlock.toml, the flags override the config file")
+var addr = flag.String("addr", defaults.Addr, "resp listen address")
+var httpAddr = flag.String("http_addr", defaults.HTTPAddr, "http listen address")
+var defaultTimeout = flag.Duration("default_timeout", defaults.DefaultTimeout.Duration, "timeout of the lock requests without timeout")
+var maxTimeout = flag.Duration("max_timeout", defaults.MaxTimeout.Duration, "the larger timeout of the lock requests is truncated")
+var shutdownTimeout = flag.Duration("shutdown_timeout", defaults.ShutdownTimeout.Duration, "wait the locks to be released before closing the connections on SIGTERM")
+var keySlotSize = flag.Int("key_slot_size", defaults.KeySlotSize, "slot size of the key locks")
+var pathSlotSize = flag.Int("path_slot_size", defaults.PathSlotSize, "slot size of the path locks")
+var password = flag.String("password", defaults.Auth.Password, "password for AUTH and HTTP Authorization: Bearer")
+var tlsCert = flag.String("tls_cert", defaults.TLS.CertFile, "tls cert file, enables HTTPS")
+var tlsKey = flag.String("tls_key", defaults.TLS.KeyFile, "tls key file")
+var tlsRESP = flag.Bool("tls_resp", defaults.TLS.RESP, "serve resp over tls too")
+var logFile = flag.String("log_file", defaults.Log.File, "log file, empty is stderr")
+var auditFile = flag.String("audit_file", defaults.Audit.File, "audit log file of JSON lines, empty disables the audit log")
+var auditMaxSize = flag.Int64("audit_max_size", defaults.Audit.MaxSize, "rotate the audit log file when it exceeds the MB")
+var auditMaxBackups = flag.Int("audit_max_backups", defaults.Audit.MaxBackups, "the rotated audit log files to keep")
+
+func loadConfig() (*tlock.Config, error) {
+	cfg := tlock.NewConfig()
+	if len(*configFile) > 0 {
+		var err error
+		if cfg, err = tlock.LoadConfig(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// only the flags set in the command line override the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Addr = *addr
+		case "http_addr":
+			cfg.HTTPAddr = *httpAddr
+		case "default_timeout":
+			cfg.DefaultTimeout.Duration = *defaultTimeout
+		case "max_timeout":
+			cfg.MaxTimeout.Duration = *maxTimeout
+		case "shutdown_timeout":
+			cfg.ShutdownTimeout.Duration = *shutdownTimeout
+		case "key_slot_size":
+			cfg.KeySlotSize = *keySlotSize
+		case "path_slot_size":
+			cfg.PathSlotSize = *pathSlotSize
+		case "password":
+			cfg.Auth.Password = *password
+		case "tls_cert":
+			cfg.TLS.CertFile = *tlsCert
+		case "tls_key":
+			cfg.TLS.KeyFile = *tlsKey
+		case "tls_resp":
+			cfg.TLS.RESP = *tlsRESP
+		case "log_file":
+			cfg.Log.File = *logFile
+		case "audit_file":
+			cfg.Audit.File = *auditFile
+		case "audit_max_size":
+			cfg.Audit.MaxSize = *auditMaxSize
+		case "audit_max_backups":
+			cfg.Audit.MaxBackups = *auditMaxBackups
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
 
-	a := tlock.NewApp()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(cfg.Log.File) > 0 {
+		f, err := os.OpenFile(cfg.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("open log file %s: %v", cfg.Log.File, err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+	}
+
+	a := tlock.NewAppWithConfig(cfg)
 
-	a.StartRESP(*addr)
+	if len(cfg.Audit.File) > 0 {
+		sink, err := tlock.NewFileAuditSink(cfg.Audit)
+		if err != nil {
+			log.Fatalf("open audit file %s: %v", cfg.Audit.File, err)
+		}
+		// closed after the app, the forced unlocks are audited too
+		defer sink.Close()
+		a.SetAuditSink(sink)
+	}
 
-	if len(*httpAddr) > 0 {
-		a.StartHTTP(*httpAddr)
+	if len(cfg.Addr) > 0 {
+		if err := a.StartRESP(cfg.Addr); err != nil {
+			log.Fatalf("start resp %s: %v", cfg.Addr, err)
+		}
+	}
+
+	if len(cfg.HTTPAddr) > 0 {
+		if err := a.StartHTTP(cfg.HTTPAddr); err != nil {
+			log.Fatalf("start http %s: %v", cfg.HTTPAddr, err)
+		}
 	}
 
 	sc := make(chan os.Signal, 1)
@@ -34,7 +131,24 @@ func main() {
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 
-	<-sc
+	sig := <-sc
 
-	a.Close()
+	if sig != syscall.SIGTERM {
+		a.Close()
+		return
+	}
+
+	// drain, the clients can retry with another server
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+
+	go func() {
+		// force to close with another signal
+		<-sc
+		cancel()
+	}()
+
+	if err := a.Shutdown(ctx); err != nil {
+		log.Printf("shutdown with locks not released: %v", err)
+	}
 }
@@ -0,0 +1,171 @@
+package tlock
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	defaultRESPAddr        = "127.0.0.1:13000"
+	defaultLockTimeout     = 60 * time.Second
+	defaultShutdownTimeout = 30 * time.Second
+	defaultAuditMaxSize    = 100
+	defaultAuditMaxBackups = 10
+)
+
+// Duration is a time.Duration in the config file, like "10s" or "500ms"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Config is the config of the tlock server, see etc/tlock.toml. There is no
+// persistence option, the server keeps the locks and leases in memory only,
+// they are lost when it exits and the clients must lock again.
+type Config struct {
+	// RESP listen address
+	Addr string `toml:"addr"`
+
+	// HTTP listen address, empty disables HTTP
+	HTTPAddr string `toml:"http_addr"`
+
+	// the timeout of the RESP and HTTP lock requests without timeout
+	DefaultTimeout Duration `toml:"default_timeout"`
+
+	// the larger timeout of the RESP and HTTP lock requests is truncated
+	MaxTimeout Duration `toml:"max_timeout"`
+
+	// wait the locks to be released on SIGTERM, see App Shutdown
+	ShutdownTimeout Duration `toml:"shutdown_timeout"`
+
+	// see KeyLockerGroupConfig and PathLockerGroupConfig
+	KeySlotSize  int `toml:"key_slot_size"`
+	PathSlotSize int `toml:"path_slot_size"`
+
+	Auth  AuthConfig  `toml:"auth"`
+	TLS   TLSConfig   `toml:"tls"`
+	Log   LogConfig   `toml:"log"`
+	Audit AuditConfig `toml:"audit"`
+}
+
+type AuthConfig struct {
+	// if not empty, the RESP clients must send AUTH password first, and
+	// the HTTP clients must send the header Authorization: Bearer password.
+	Password string `toml:"password"`
+}
+
+type TLSConfig struct {
+	// if set, HTTP is served over TLS
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+
+	// serve RESP over TLS too, RESPClient can not connect it then
+	RESP bool `toml:"resp"`
+}
+
+func (c TLSConfig) enabled() bool {
+	return len(c.CertFile) > 0
+}
+
+type LogConfig struct {
+	// the log file, empty is stderr
+	File string `toml:"file"`
+}
+
+type AuditConfig struct {
+	// the audit log file of JSON lines, empty disables the audit log,
+	// see AuditRecord
+	File string `toml:"file"`
+
+	// rotate the file when it exceeds max size MB,
+	// keep max backups rotated files, zero keeps none
+	MaxSize    int64 `toml:"max_size"`
+	MaxBackups int   `toml:"max_backups"`
+}
+
+// NewConfig returns the default config
+func NewConfig() *Config {
+	c := new(Config)
+	c.Addr = defaultRESPAddr
+	c.DefaultTimeout.Duration = defaultLockTimeout
+	c.MaxTimeout.Duration = InfiniteTimeout
+	c.ShutdownTimeout.Duration = defaultShutdownTimeout
+	c.KeySlotSize = defaultKeySlotSize
+	c.PathSlotSize = defaultPathSlotSize
+	c.Audit.MaxSize = defaultAuditMaxSize
+	c.Audit.MaxBackups = defaultAuditMaxBackups
+	return c
+}
+
+// LoadConfig loads the TOML config file, the missing items use the
+// default values, the unknown items are errors.
+func LoadConfig(path string) (*Config, error) {
+	c := NewConfig()
+
+	meta, err := toml.DecodeFile(path, c)
+	if err != nil {
+		return nil, fmt.Errorf("load config %s: %v", path, err)
+	}
+
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return nil, fmt.Errorf("load config %s: unknown items %s", path, strings.Join(keys, ", "))
+	}
+
+	return c, nil
+}
+
+// Validate checks the config, the server must not start with an invalid config
+func (c *Config) Validate() error {
+	if len(c.Addr) == 0 && len(c.HTTPAddr) == 0 {
+		return fmt.Errorf("invalid config: no listen address")
+	}
+
+	if c.DefaultTimeout.Duration <= 0 {
+		return fmt.Errorf("invalid config: default_timeout %v must be positive", c.DefaultTimeout)
+	}
+
+	if c.MaxTimeout.Duration < c.DefaultTimeout.Duration || c.MaxTimeout.Duration > InfiniteTimeout {
+		return fmt.Errorf("invalid config: max_timeout %v must be in [default_timeout, %v]", c.MaxTimeout, InfiniteTimeout)
+	}
+
+	if c.ShutdownTimeout.Duration < 0 {
+		return fmt.Errorf("invalid config: shutdown_timeout %v can not be negative", c.ShutdownTimeout)
+	}
+
+	if c.KeySlotSize <= 0 || c.PathSlotSize <= 0 {
+		return fmt.Errorf("invalid config: slot sizes must be positive")
+	}
+
+	if (len(c.TLS.CertFile) == 0) != (len(c.TLS.KeyFile) == 0) {
+		return fmt.Errorf("invalid config: tls cert_file and key_file must be set together")
+	}
+
+	if c.TLS.RESP && !c.TLS.enabled() {
+		return fmt.Errorf("invalid config: tls resp needs cert_file and key_file")
+	}
+
+	if c.Audit.MaxSize <= 0 || c.Audit.MaxBackups < 0 {
+		return fmt.Errorf("invalid config: audit max_size must be positive and max_backups can not be negative")
+	}
+
+	return nil
+}
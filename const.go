@@ -5,9 +5,11 @@ import (
 )
 
 type LockerGroup interface {
-	Lock(args ...string)
-	LockTimeout(timeout time.Duration, args ...string) bool
-	Unlock(args ...string)
+	Lock(args ...string) error
+	// returns ErrLockTimeout if timeout
+	LockTimeout(timeout time.Duration, args ...string) error
+	// returns ErrNotLocked if any arg is not locked
+	Unlock(args ...string) error
 }
 
 var InfiniteTimeout = 30 * 24 * 3600 * time.Second
@@ -15,8 +17,21 @@ var InfiniteTimeout = 30 * 24 * 3600 * time.Second
 const (
 	KeyLockType  = "key"
 	PathLockType = "path"
+	// GlobLockType locks all the paths matching the patterns, see PathLockerGroup LockGlobTimeout
+	GlobLockType = "glob"
+	// RangeLockType locks the key ranges, see RangeLockerGroup LockTimeout
+	RangeLockType = "range"
 )
 
+func isValidLockType(tp string) bool {
+	switch tp {
+	case KeyLockType, PathLockType, GlobLockType, RangeLockType:
+		return true
+	default:
+		return false
+	}
+}
+
 type Client interface {
 	GetLocker(tp string, names ...string) (ClientLocker, error)
 }
@@ -27,3 +42,10 @@ type ClientLocker interface {
 	LockTimeout(timeout int) error
 	Unlock() error
 }
+
+// DurationLocker is implemented by the lockers of RESPClient and HTTPClient,
+// check it with a type assertion, the timeout has millisecond resolution.
+type DurationLocker interface {
+	ClientLocker
+	LockTimeoutDuration(timeout time.Duration) error
+}
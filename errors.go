@@ -0,0 +1,145 @@
+package tlock
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Errors returned by the server and clients, use errors.Is to check them,
+// the server may wrap them with more detail. ErrShuttingDown is retryable,
+// the server is draining, retry later or with another server.
+var (
+	ErrLockTimeout     = errors.New("lock timeout")
+	ErrInvalidType     = errors.New("invalid lock type")
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrNotLocked       = errors.New("not locked")
+	ErrNotOwner        = errors.New("not lock owner")
+	ErrLeaseNotFound   = errors.New("lease not found")
+	ErrShuttingDown    = errors.New("shutting down")
+	ErrNoAuth          = errors.New("authentication required")
+	ErrInternal        = errors.New("internal error")
+)
+
+func invalidArgumentf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidArgument, fmt.Sprintf(format, args...))
+}
+
+func notLockedf(name string) error {
+	return fmt.Errorf("%w: %s", ErrNotLocked, name)
+}
+
+// lockOrderf is returned when a name sorting before the held names is locked,
+// waiting it out of order may deadlock, so it is not waited.
+func lockOrderf(name string) error {
+	return fmt.Errorf("%w: %s is locked and sorts before the held names", ErrLockTimeout, name)
+}
+
+func invalidTypef(tp string) error {
+	return fmt.Errorf("%w %s", ErrInvalidType, tp)
+}
+
+// errorCode is the stable prefix of the error message for RESP, like
+// the Redis -WRONGTYPE error, HTTP uses the same prefix in the body.
+type errorCode struct {
+	err    error
+	code   string
+	status int
+}
+
+var errorCodes = []errorCode{
+	{ErrLockTimeout, "TIMEOUT", http.StatusRequestTimeout},
+	{ErrInvalidType, "WRONGTYPE", http.StatusBadRequest},
+	{ErrInvalidArgument, "INVALID", http.StatusBadRequest},
+	{ErrNotLocked, "NOTLOCKED", http.StatusNotFound},
+	{ErrNotOwner, "NOTOWNER", http.StatusForbidden},
+	{ErrLeaseNotFound, "NOLEASE", http.StatusNotFound},
+	{ErrShuttingDown, "SHUTTINGDOWN", http.StatusServiceUnavailable},
+	{ErrNoAuth, "NOAUTH", http.StatusUnauthorized},
+	{ErrInternal, "ERR", http.StatusInternalServerError},
+}
+
+func findErrorCode(err error) errorCode {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c
+		}
+	}
+
+	// unknown error, treat it as a server failure
+	return errorCodes[len(errorCodes)-1]
+}
+
+// formatError returns "CODE message" for the error
+func formatError(err error) string {
+	return fmt.Sprintf("%s %s", findErrorCode(err).code, err.Error())
+}
+
+// respError converts the error to the one sent to a RESP client
+func respError(err error) error {
+	return errors.New(formatError(err))
+}
+
+// writeHTTPError writes the status code and the error to the response
+func writeHTTPError(w http.ResponseWriter, err error) {
+	w.WriteHeader(findErrorCode(err).status)
+	w.Write([]byte(formatError(err)))
+}
+
+// parseError converts "CODE message" returned by the server back to an error
+// wrapping the sentinel, so errors.Is works in the client.
+func parseError(msg string) error {
+	if err, ok := parseErrorCode(msg); ok {
+		return err
+	}
+
+	return &serverError{err: ErrInternal, msg: msg}
+}
+
+// parseHTTPError is like parseError, but uses the status code if the
+// body has no error code.
+func parseHTTPError(status int, body string) error {
+	if err, ok := parseErrorCode(body); ok {
+		return err
+	}
+
+	for _, c := range errorCodes {
+		if c.status == status {
+			return &serverError{err: c.err, msg: body}
+		}
+	}
+
+	return &serverError{err: ErrInternal, msg: fmt.Sprintf("unexpected status %d: %s", status, body)}
+}
+
+func parseErrorCode(msg string) (error, bool) {
+	seps := strings.SplitN(msg, " ", 2)
+	for _, c := range errorCodes {
+		if seps[0] != c.code {
+			continue
+		}
+
+		if len(seps) == 1 || seps[1] == c.err.Error() {
+			return c.err, true
+		}
+
+		return &serverError{err: c.err, msg: seps[1]}, true
+	}
+
+	return nil, false
+}
+
+// serverError is an error returned by the server
+type serverError struct {
+	err error
+	msg string
+}
+
+func (e *serverError) Error() string {
+	return e.msg
+}
+
+func (e *serverError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,216 @@
+package tlock
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// withNames returns a copy of the lock with the names
+func (l *lockInfo) withNames(names []string) *lockInfo {
+	n := *l
+	n.names = names
+	return &n
+}
+
+// pathGroup returns the path group of a path lock
+func (l *lockInfo) pathGroup() *PathLockerGroup {
+	return l.group.(*pathModeLockerGroup).g
+}
+
+// extendLocker is implemented by the groups supporting Extend
+type extendLocker interface {
+	// like LockTimeout, but the names sorting before the held names
+	// are locked without waiting
+	extendTimeout(held []string, timeout time.Duration, names ...string) error
+}
+
+// Extend locks the names too under the lock id, waits at most the timeout,
+// zero means InfiniteTimeout, the names are locked like the lock, with the
+// same type and options. For key locks, the keys already locked are skipped,
+// for path locks, the paths already locked or under a locked path are
+// skipped, and extending to an ancestor of a locked path is an error.
+//
+// The names sorting after the held names are waited like Lock, so all the
+// locks are still taken in order. The others, and for path locks the shared
+// ancestors held already, are not waited, and an error wrapping
+// ErrLockTimeout is returned at once if any of them is locked, unlock and
+// lock all the names again then.
+func (a *App) Extend(id uint64, names []string, timeout time.Duration) error {
+	if len(names) == 0 {
+		return invalidArgumentf("empty names")
+	}
+
+	if a.isShuttingDown() {
+		return ErrShuttingDown
+	}
+
+	if timeout <= 0 {
+		timeout = InfiniteTimeout
+	}
+
+	l, ok := a.locks.Get(id)
+	if !ok {
+		return ErrNotLocked
+	}
+
+	extra, err := l.extraNames(names)
+	if err != nil || len(extra) == 0 {
+		return err
+	}
+
+	group := l.group
+
+	start := time.Now()
+	if err := group.(extendLocker).extendTimeout(l.names, timeout, extra...); err != nil {
+		if errors.Is(err, ErrLockTimeout) {
+			e := l.withNames(extra)
+			e.wait = time.Since(start)
+			a.lockEvent(AuditTimeout, e)
+		}
+		return err
+	}
+
+	for {
+		n := l.withNames(append(append([]string(nil), l.names...), extra...))
+		if a.locks.Replace(l, n) {
+			e := n.withNames(extra)
+			e.wait = time.Since(start)
+			a.lockEvent(AuditExtend, e)
+			return nil
+		}
+
+		// extended or shrunk by others at the same time
+		if l, ok = a.locks.Get(id); !ok {
+			group.Unlock(extra...)
+			return ErrNotLocked
+		}
+	}
+}
+
+// extraNames returns the names not locked by the lock yet
+func (l *lockInfo) extraNames(names []string) ([]string, error) {
+	switch l.tp {
+	case KeyLockType:
+		held := make(map[string]struct{}, len(l.names))
+		for _, name := range l.names {
+			held[name] = struct{}{}
+		}
+
+		extra := make([]string, 0, len(names))
+		for _, name := range removeDuplicatedItems(names...) {
+			if _, ok := held[name]; !ok {
+				extra = append(extra, name)
+			}
+		}
+		return extra, nil
+	case PathLockType:
+		g := l.pathGroup()
+		held, err := g.NormalizePaths(l.names...)
+		if err != nil {
+			return nil, err
+		}
+
+		paths, err := g.NormalizePaths(names...)
+		if err != nil {
+			return nil, err
+		}
+
+		extra := make([]string, 0, len(paths))
+	next:
+		for _, path := range paths {
+			for _, h := range held {
+				if strings.HasPrefix(path, h) {
+					// locked already
+					continue next
+				}
+				if strings.HasPrefix(h, path) {
+					return nil, invalidArgumentf("path %s is the ancestor of the locked path %s", path, h)
+				}
+			}
+			extra = append(extra, path)
+		}
+		return extra, nil
+	default:
+		return nil, invalidArgumentf("can not extend or shrink %s lock", l.tp)
+	}
+}
+
+// Shrink releases the names from the lock id, the other names are still
+// locked, the names must be locked by the lock, use Unlock to release all
+// the names. For path locks, the names are canonicalized after shrinking.
+func (a *App) Shrink(id uint64, names []string) error {
+	if len(names) == 0 {
+		return invalidArgumentf("empty names")
+	}
+
+	for {
+		l, ok := a.locks.Get(id)
+		if !ok {
+			return ErrNotLocked
+		}
+
+		released, remains, err := l.shrinkNames(names)
+		if err != nil {
+			return err
+		}
+
+		n := l.withNames(remains)
+		if !a.locks.Replace(l, n) {
+			// extended or shrunk by others at the same time
+			continue
+		}
+
+		// before releasing, like unlock
+		a.lockEvent(AuditShrink, n.withNames(released))
+
+		return l.group.Unlock(released...)
+	}
+}
+
+// shrinkNames returns the names to release and the names remain
+func (l *lockInfo) shrinkNames(names []string) (released []string, remains []string, err error) {
+	var held []string
+	canonical := func(name string) string {
+		return name
+	}
+
+	switch l.tp {
+	case KeyLockType:
+		held = removeDuplicatedItems(l.names...)
+	case PathLockType:
+		g := l.pathGroup()
+		if held, err = g.NormalizePaths(l.names...); err != nil {
+			return
+		}
+		canonical = g.canonicalizePath
+	default:
+		err = invalidArgumentf("can not extend or shrink %s lock", l.tp)
+		return
+	}
+
+	shrunk := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		shrunk[canonical(name)] = struct{}{}
+	}
+
+	remains = make([]string, 0, len(held))
+	for _, name := range held {
+		if _, ok := shrunk[name]; ok {
+			released = append(released, name)
+			delete(shrunk, name)
+		} else {
+			remains = append(remains, name)
+		}
+	}
+
+	for name := range shrunk {
+		err = invalidArgumentf("%s is not locked by lock %d", name, l.id)
+		return
+	}
+
+	if len(remains) == 0 {
+		err = invalidArgumentf("can not shrink all the names, use unlock")
+	}
+	return
+}
@@ -0,0 +1,476 @@
+package tlock
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Glob lock locks all the paths matching the pattern, a pattern is a path
+// whose segments may have wildcards, matched segment by segment, * matches
+// any characters in a segment, ? matches one character, [abc] or [a-z]
+// matches a character in the set, [!abc] or [^abc] negates the set, and \c
+// matches character c.
+//
+// A glob lock behaves like path locks on every matching path, so it
+// conflicts with a path lock if a matching path is the ancestor, descendant
+// or the same of the locked path, e.g, services/*/config conflicts with
+// services, services/a/config and services/a/config/x, but not services/a/data.
+// Two glob locks conflict if a path may match both, a segment with wildcards
+// is assumed to overlap with another segment with wildcards, so logs/2026-*
+// conflicts with logs/*-01 but not with logs/2025.
+type globTable struct {
+	sep string
+
+	// the path locks hold the read lock to check the globs and register
+	// the paths, so they don't block each other, the glob locks hold the
+	// write lock.
+	m sync.RWMutex
+
+	// canonical pattern -> segments
+	globs map[string][]string
+
+	// closed and recreated when a glob is released, or a path is
+	// released and a glob lock is waiting.
+	changed chan struct{}
+
+	// the number of the glob locks checking or waiting the paths
+	globWaiters int32
+
+	hash  HashFunc
+	paths []*globPathShard
+}
+
+// globPathShard has the canonical path -> count of path locks holding or waiting it
+type globPathShard struct {
+	sync.Mutex
+	paths map[string]int
+}
+
+const globPathShardSize = 64
+
+func newGlobTable(sep string, hash HashFunc) *globTable {
+	t := new(globTable)
+	t.sep = sep
+	t.globs = make(map[string][]string)
+	t.changed = make(chan struct{})
+	t.hash = hash
+	t.paths = make([]*globPathShard, globPathShardSize)
+	for i := range t.paths {
+		t.paths[i] = &globPathShard{paths: make(map[string]int)}
+	}
+	return t
+}
+
+func (t *globTable) getShard(path string) *globPathShard {
+	return t.paths[t.hash(path)%uint32(len(t.paths))]
+}
+
+func (t *globTable) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// lockPaths registers the canonical paths of a path lock, waits if a
+// conflicting glob is locked.
+func (t *globTable) lockPaths(paths []string, timer *time.Timer) bool {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	for t.pathsConflict(paths) {
+		ch := t.changed
+		t.m.RUnlock()
+
+		select {
+		case <-ch:
+			t.m.RLock()
+		case <-timer.C:
+			t.m.RLock()
+			return false
+		}
+	}
+
+	for _, path := range paths {
+		shard := t.getShard(path)
+		shard.Lock()
+		shard.paths[path]++
+		shard.Unlock()
+	}
+	return true
+}
+
+func (t *globTable) unlockPaths(paths []string) {
+	for _, path := range paths {
+		shard := t.getShard(path)
+		shard.Lock()
+		if n := shard.paths[path]; n <= 1 {
+			delete(shard.paths, path)
+		} else {
+			shard.paths[path] = n - 1
+		}
+		shard.Unlock()
+	}
+
+	// a glob lock increases globWaiters before checking the paths, so
+	// either it sees the paths are released, or we see it and notify.
+	if atomic.LoadInt32(&t.globWaiters) > 0 {
+		t.m.Lock()
+		t.notify()
+		t.m.Unlock()
+	}
+}
+
+func (t *globTable) pathsConflict(paths []string) bool {
+	if len(t.globs) == 0 {
+		return false
+	}
+
+	for _, path := range paths {
+		segs := pathSegments(path, t.sep)
+		for _, glob := range t.globs {
+			if globConflictsPath(glob, segs) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *globTable) lockGlobs(globs map[string][]string, timer *time.Timer) bool {
+	atomic.AddInt32(&t.globWaiters, 1)
+	defer atomic.AddInt32(&t.globWaiters, -1)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for t.globsConflict(globs) {
+		ch := t.changed
+		t.m.Unlock()
+
+		select {
+		case <-ch:
+			t.m.Lock()
+		case <-timer.C:
+			t.m.Lock()
+			return false
+		}
+	}
+
+	for pattern, segs := range globs {
+		t.globs[pattern] = segs
+	}
+	return true
+}
+
+func (t *globTable) unlockGlobs(patterns []string) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	var err error
+	for _, pattern := range patterns {
+		if _, ok := t.globs[pattern]; !ok {
+			err = notLockedf(pattern)
+			continue
+		}
+		delete(t.globs, pattern)
+	}
+
+	t.notify()
+	return err
+}
+
+func (t *globTable) globsConflict(globs map[string][]string) bool {
+	for _, segs := range globs {
+		for _, glob := range t.globs {
+			if globsOverlap(glob, segs) {
+				return true
+			}
+		}
+	}
+
+	for _, shard := range t.paths {
+		shard.Lock()
+		conflict := shard.conflict(globs, t.sep)
+		shard.Unlock()
+
+		if conflict {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *globPathShard) conflict(globs map[string][]string, sep string) bool {
+	for path, _ := range s.paths {
+		segs := pathSegments(path, sep)
+		for _, glob := range globs {
+			if globConflictsPath(glob, segs) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pathSegments returns the segments of a canonical path
+func pathSegments(path string, sep string) []string {
+	items := makeAncestorPaths(path, sep)
+	segs := make([]string, len(items))
+	prev := 0
+	for i, item := range items {
+		segs[i] = item[prev : len(item)-len(sep)]
+		prev = len(item)
+	}
+	return segs
+}
+
+// globConflictsPath returns true if a path matching the glob is the
+// ancestor, descendant or the same of the path.
+func globConflictsPath(glob []string, path []string) bool {
+	for i := 0; i < len(glob) && i < len(path); i++ {
+		if !matchSegment(glob[i], path[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func globsOverlap(a []string, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if !segmentsOverlap(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasWildcard(seg string) bool {
+	return strings.ContainsAny(seg, `*?[\`)
+}
+
+func segmentsOverlap(a string, b string) bool {
+	aw := hasWildcard(a)
+	bw := hasWildcard(b)
+	switch {
+	case !aw && !bw:
+		return a == b
+	case !aw:
+		return matchSegment(b, a)
+	case !bw:
+		return matchSegment(a, b)
+	default:
+		// we can not tell easily, assume overlapped
+		return true
+	}
+}
+
+// matchSegment returns true if the name matches the pattern, a bad
+// pattern matches nothing, use validSegmentPattern to check it before.
+func matchSegment(pattern string, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// skip the continuous *
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegment(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			name = name[1:]
+		case '[':
+			if len(name) == 0 {
+				return false
+			}
+			matched, rest, ok := matchClass(pattern, name[0])
+			if !ok || !matched {
+				return false
+			}
+			pattern = rest
+			name = name[1:]
+		case '\\':
+			if len(pattern) < 2 || len(name) == 0 || pattern[1] != name[0] {
+				return false
+			}
+			pattern = pattern[2:]
+			name = name[1:]
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+			pattern = pattern[1:]
+			name = name[1:]
+		}
+	}
+	return len(name) == 0
+}
+
+// matchClass matches c with the class at the beginning of the pattern, like [a-z],
+// returns the rest pattern after the class, ok is false if the class is bad.
+func matchClass(pattern string, c byte) (matched bool, rest string, ok bool) {
+	i := 1
+	negated := false
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		negated = true
+		i++
+	}
+
+	first := true
+	for i < len(pattern) {
+		if pattern[i] == ']' && !first {
+			return matched != negated, pattern[i+1:], true
+		}
+		first = false
+
+		lo := pattern[i]
+		if lo == '\\' {
+			i++
+			if i >= len(pattern) {
+				return false, "", false
+			}
+			lo = pattern[i]
+		}
+		i++
+
+		hi := lo
+		if i+1 < len(pattern) && pattern[i] == '-' && pattern[i+1] != ']' {
+			hi = pattern[i+1]
+			i += 2
+			if hi == '\\' {
+				if i >= len(pattern) {
+					return false, "", false
+				}
+				hi = pattern[i]
+				i++
+			}
+		}
+
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+
+	// no ]
+	return false, "", false
+}
+
+func validSegmentPattern(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+			if i >= len(pattern) {
+				return false
+			}
+		case '[':
+			_, rest, ok := matchClass(pattern[i:], 0)
+			if !ok {
+				return false
+			}
+			i = len(pattern) - len(rest) - 1
+		}
+	}
+	return true
+}
+
+// normalizeGlobs canonicalizes the patterns and returns pattern -> segments
+func (g *PathLockerGroup) normalizeGlobs(patterns ...string) (map[string][]string, error) {
+	if len(patterns) == 0 {
+		return nil, invalidArgumentf("empty patterns")
+	}
+
+	globs := make(map[string][]string, len(patterns))
+	for _, pattern := range patterns {
+		p := g.canonicalizePath(pattern)
+		if p == g.sep {
+			return nil, invalidArgumentf("invalid pattern %q, can not empty", pattern)
+		}
+
+		segs := pathSegments(p, g.sep)
+		for _, seg := range segs {
+			if !validSegmentPattern(seg) {
+				return nil, invalidArgumentf("invalid pattern %q", pattern)
+			}
+		}
+
+		globs[p] = segs
+	}
+	return globs, nil
+}
+
+func (g *PathLockerGroup) LockGlob(patterns ...string) error {
+	// use a very long timeout
+	return g.LockGlobTimeout(InfiniteTimeout, patterns...)
+}
+
+// LockGlobTimeout locks all the paths matching the patterns, returns
+// ErrLockTimeout if not all are locked before timeout.
+func (g *PathLockerGroup) LockGlobTimeout(timeout time.Duration, patterns ...string) error {
+	globs, err := g.normalizeGlobs(patterns...)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	if !g.globs.lockGlobs(globs, timer) {
+		return ErrLockTimeout
+	}
+	return nil
+}
+
+// UnlockGlob unlocks the patterns, returns ErrNotLocked if any is not locked
+func (g *PathLockerGroup) UnlockGlob(patterns ...string) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	globs, err := g.normalizeGlobs(patterns...)
+	if err != nil {
+		return err
+	}
+
+	p := make([]string, 0, len(globs))
+	for pattern, _ := range globs {
+		p = append(p, pattern)
+	}
+	sort.Strings(p)
+
+	return g.globs.unlockGlobs(p)
+}
+
+// globLockerGroup is the LockerGroup for glob locks of a PathLockerGroup
+type globLockerGroup struct {
+	g *PathLockerGroup
+}
+
+func (g *globLockerGroup) Lock(patterns ...string) error {
+	return g.g.LockGlob(patterns...)
+}
+
+func (g *globLockerGroup) LockTimeout(timeout time.Duration, patterns ...string) error {
+	return g.g.LockGlobTimeout(timeout, patterns...)
+}
+
+// tryLock is like RangeLockerGroup tryLock, the free globs are checked first
+func (g *globLockerGroup) tryLock(patterns ...string) error {
+	return g.g.LockGlobTimeout(0, patterns...)
+}
+
+func (g *globLockerGroup) Unlock(patterns ...string) error {
+	return g.g.UnlockGlob(patterns...)
+}
@@ -0,0 +1,310 @@
+package tlock
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHTTPMaxIdleConns = 16
+	defaultHTTPRetries      = 3
+	defaultHTTPRetryBackoff = 100 * time.Millisecond
+)
+
+type HTTPClientConfig struct {
+	// the server password, see AuthConfig
+	Password string
+
+	// if not nil, use HTTPS
+	TLSConfig *tls.Config
+
+	// the owner of the locks in the audit log, see LockOptions
+	Owner string
+}
+
+type HTTPClient struct {
+	addr     string
+	scheme   string
+	password string
+	owner    string
+
+	transport *http.Transport
+	c         *http.Client
+
+	// retry times for idempotent operations, like unlock
+	retries int
+}
+
+// NewHTTPClient creates a client for the tlock HTTP service,
+// addr is host:port, like 127.0.0.1:13001
+func NewHTTPClient(addr string) *HTTPClient {
+	return NewHTTPClientWithConfig(addr, HTTPClientConfig{})
+}
+
+func NewHTTPClientWithConfig(addr string, cfg HTTPClientConfig) *HTTPClient {
+	c := new(HTTPClient)
+	c.addr = addr
+	c.password = cfg.Password
+	c.owner = cfg.Owner
+
+	c.scheme = "http"
+	if cfg.TLSConfig != nil {
+		c.scheme = "https"
+	}
+
+	c.transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        defaultHTTPMaxIdleConns,
+		MaxIdleConnsPerHost: defaultHTTPMaxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+		TLSClientConfig:     cfg.TLSConfig,
+	}
+
+	// no client timeout, lock may wait a long time
+	c.c = &http.Client{Transport: c.transport}
+	c.retries = defaultHTTPRetries
+
+	return c
+}
+
+func (c *HTTPClient) GetLocker(tp string, names ...string) (ClientLocker, error) {
+	return c.newHTTPLocker(tp, names...)
+}
+
+func (c *HTTPClient) Close() {
+	c.transport.CloseIdleConnections()
+}
+
+// NewSession grants a lease with ttl seconds and keeps it alive in background
+func (c *HTTPClient) NewSession(ttl int) (*Session, error) {
+	return newSession(c, ttl)
+}
+
+func (c *HTTPClient) grantLease(ttl int) (uint64, error) {
+	query := url.Values{}
+	query.Set("ttl", strconv.Itoa(ttl))
+
+	body, err := c.do(leasePath, "POST", query)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(string(body), 10, 64)
+}
+
+func (c *HTTPClient) renewLease(id uint64, timeout time.Duration) error {
+	query := url.Values{}
+	query.Set("id", strconv.FormatUint(id, 10))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := c.doIdempotent(ctx, leasePath, "PUT", query, nil)
+	return err
+}
+
+func (c *HTTPClient) revokeLease(id uint64) error {
+	query := url.Values{}
+	query.Set("id", strconv.FormatUint(id, 10))
+
+	_, err := c.doIdempotent(context.Background(), leasePath, "DELETE", query, ErrLeaseNotFound)
+	return err
+}
+
+const (
+	lockPath  = "/lock"
+	leasePath = "/lease"
+)
+
+func (c *HTTPClient) url(path string, query url.Values) string {
+	u := url.URL{
+		Scheme:   c.scheme,
+		Host:     c.addr,
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// do sends the request and returns the response body, the response
+// status code is mapped to an error if not 200.
+func (c *HTTPClient) do(path string, method string, query url.Values) ([]byte, error) {
+	return c.doContext(context.Background(), path, method, query)
+}
+
+// doContext is like do, but the request is canceled when the ctx is done
+func (c *HTTPClient) doContext(ctx context.Context, path string, method string, query url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path, query), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.password) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.password)
+	}
+
+	r, err := c.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// read all the body so the connection can be reused
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.StatusCode != http.StatusOK {
+		return nil, parseHTTPError(r.StatusCode, string(body))
+	}
+
+	return body, nil
+}
+
+// doIdempotent is like do but retries when the request fails in
+// transport, it must only be used for operations which are safe to repeat.
+// If a retry returns the applied error, the former request may have been
+// done successfully, so nil is returned. It stops retrying when the ctx is done.
+func (c *HTTPClient) doIdempotent(ctx context.Context, path string, method string, query url.Values, applied error) ([]byte, error) {
+	var body []byte
+	var err error
+	for i := 0; i <= c.retries; i++ {
+		if i > 0 {
+			if ctx.Err() != nil {
+				break
+			}
+			time.Sleep(time.Duration(i) * defaultHTTPRetryBackoff)
+		}
+
+		body, err = c.doContext(ctx, path, method, query)
+		if i > 0 && errors.Is(err, applied) {
+			return body, nil
+		}
+
+		if !isTransportError(err) {
+			return body, err
+		}
+	}
+	return body, err
+}
+
+// http.Client returns *url.Error only if the request fails in transport
+func isTransportError(err error) bool {
+	_, ok := err.(*url.Error)
+	return ok
+}
+
+type httpLocker struct {
+	c     *HTTPClient
+	names []string
+	tp    string
+	lease uint64
+	id    uint64
+}
+
+func (c *HTTPClient) newLeaseLocker(s *Session, tp string, names ...string) (ClientLocker, error) {
+	l, err := c.newHTTPLocker(tp, names...)
+	if err != nil {
+		return nil, err
+	}
+
+	l.(*httpLocker).lease = s.id
+	return l, nil
+}
+
+func (c *HTTPClient) newHTTPLocker(tp string, names ...string) (ClientLocker, error) {
+	tp = strings.ToLower(tp)
+	if !isValidLockType(tp) {
+		return nil, invalidTypef(tp)
+	}
+	if len(names) == 0 {
+		return nil, invalidArgumentf("empty lock names")
+	}
+	for _, name := range names {
+		if strings.Contains(name, ",") {
+			return nil, invalidArgumentf("invalid lock name %q, can not contain ','", name)
+		}
+	}
+
+	l := new(httpLocker)
+	l.c = c
+	l.names = names
+	l.tp = tp
+
+	return l, nil
+}
+
+func (l *httpLocker) Lock() error {
+	return l.LockTimeout(3600)
+}
+
+func (l *httpLocker) LockTimeout(timeout int) error {
+	return l.LockTimeoutDuration(time.Duration(timeout) * time.Second)
+}
+
+func (l *httpLocker) LockTimeoutDuration(timeout time.Duration) error {
+	if l.id != 0 {
+		return fmt.Errorf("lockid %d exists, must unlock first", l.id)
+	}
+
+	query := url.Values{}
+	query.Set("names", strings.Join(l.names, ","))
+	query.Set("type", l.tp)
+	if timeout%time.Second == 0 {
+		// use seconds if possible, so old servers still work
+		query.Set("timeout", strconv.FormatInt(int64(timeout/time.Second), 10))
+	} else {
+		query.Set("timeout_ms", strconv.FormatInt(durationToMs(timeout), 10))
+	}
+	if l.lease != 0 {
+		query.Set("lease", strconv.FormatUint(l.lease, 10))
+	}
+	if len(l.c.owner) > 0 {
+		query.Set("owner", l.c.owner)
+	}
+
+	// lock is not idempotent, a retry may grab the lock twice
+	body, err := l.c.do(lockPath, "POST", query)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.ParseUint(string(body), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid lock id %q: %v", body, err)
+	}
+
+	l.id = id
+	return nil
+}
+
+func (l *httpLocker) Unlock() error {
+	if l.id == 0 {
+		return fmt.Errorf("no lock id")
+	}
+
+	query := url.Values{}
+	query.Set("id", strconv.FormatUint(l.id, 10))
+
+	// unlock can be retried safely
+	_, err := l.c.doIdempotent(context.Background(), lockPath, "DELETE", query, ErrNotLocked)
+	if err == nil {
+		l.id = 0
+	}
+
+	return err
+}
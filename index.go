@@ -0,0 +1,165 @@
+package tlock
+
+import (
+	"sync"
+)
+
+const lockIndexShardSize = 64
+
+// lockIndex maps the names to the locks holding them, so the status of a
+// name is found without scanning all the locks. A key is indexed by its name,
+// a path by its canonical path, and its ancestors know the locks below them.
+// The glob and range locks are few, and kept in a set.
+type lockIndex struct {
+	shards [lockIndexShardSize]lockIndexShard
+
+	m      sync.RWMutex
+	globs  map[*lockInfo]struct{}
+	ranges map[*lockInfo]struct{}
+}
+
+type lockIndexKey struct {
+	tp   string
+	path pathGroupKey
+	name string
+}
+
+type lockIndexEntry struct {
+	// the locks on the name
+	held map[*lockInfo]struct{}
+	// the locks on the descendants, path only
+	below map[*lockInfo]struct{}
+}
+
+type lockIndexShard struct {
+	sync.RWMutex
+	entries map[lockIndexKey]*lockIndexEntry
+}
+
+func newLockIndex() *lockIndex {
+	x := new(lockIndex)
+	for i := range x.shards {
+		x.shards[i].entries = make(map[lockIndexKey]*lockIndexEntry)
+	}
+	x.globs = make(map[*lockInfo]struct{})
+	x.ranges = make(map[*lockInfo]struct{})
+	return x
+}
+
+func (x *lockIndex) getShard(key lockIndexKey) *lockIndexShard {
+	return &x.shards[crc32Hash(key.name)%lockIndexShardSize]
+}
+
+func (x *lockIndex) update(key lockIndexKey, l *lockInfo, below bool, add bool) {
+	s := x.getShard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		if !add {
+			return
+		}
+		e = &lockIndexEntry{
+			held:  make(map[*lockInfo]struct{}),
+			below: make(map[*lockInfo]struct{}),
+		}
+		s.entries[key] = e
+	}
+
+	set := e.held
+	if below {
+		set = e.below
+	}
+
+	if add {
+		set[l] = struct{}{}
+	} else {
+		delete(set, l)
+		if len(e.held) == 0 && len(e.below) == 0 {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// get returns the locks on the name, and the locks below it
+func (x *lockIndex) get(key lockIndexKey) (held []*lockInfo, below []*lockInfo) {
+	s := x.getShard(key)
+	s.RLock()
+	defer s.RUnlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+
+	for l := range e.held {
+		held = append(held, l)
+	}
+	for l := range e.below {
+		below = append(below, l)
+	}
+	return
+}
+
+func (x *lockIndex) Add(l *lockInfo) {
+	x.apply(l, true)
+}
+
+func (x *lockIndex) Remove(l *lockInfo) {
+	x.apply(l, false)
+}
+
+func (x *lockIndex) apply(l *lockInfo, add bool) {
+	switch l.tp {
+	case KeyLockType:
+		for _, name := range removeDuplicatedItems(l.names...) {
+			x.update(lockIndexKey{tp: KeyLockType, name: name}, l, false, add)
+		}
+	case PathLockType:
+		g := l.group.(*pathModeLockerGroup).g
+		paths, err := g.NormalizePaths(l.names...)
+		if err != nil {
+			return
+		}
+
+		group := pathGroupKey{g.sep, g.raw}
+		for _, path := range paths {
+			items := makeAncestorPaths(path, g.sep)
+			for _, item := range items[0 : len(items)-1] {
+				x.update(lockIndexKey{PathLockType, group, item}, l, true, add)
+			}
+			x.update(lockIndexKey{PathLockType, group, path}, l, false, add)
+		}
+	case GlobLockType, RangeLockType:
+		set := x.globs
+		if l.tp == RangeLockType {
+			set = x.ranges
+		}
+
+		x.m.Lock()
+		if add {
+			set[l] = struct{}{}
+		} else {
+			delete(set, l)
+		}
+		x.m.Unlock()
+	}
+}
+
+// snapshot returns the glob or range locks
+func (x *lockIndex) snapshot(tp string) []*lockInfo {
+	set := x.globs
+	if tp == RangeLockType {
+		set = x.ranges
+	}
+
+	x.m.RLock()
+	defer x.m.RUnlock()
+
+	locks := make([]*lockInfo, 0, len(set))
+	for l := range set {
+		locks = append(locks, l)
+	}
+	return locks
+}
@@ -1,40 +1,68 @@
 package tlock
 
 import (
-	"fmt"
-	"hash/crc32"
 	"sort"
 	"time"
 )
 
 const defaultKeySlotSize = 1024
 
+type KeyLockerGroupConfig struct {
+	// Ranges makes a key conflict with the range locks containing it
+	Ranges *RangeLockerGroup
+
+	// SlotSize is the number of slots, the keys in the same slot
+	// share a mutex to look up their locks, default is 1024
+	SlotSize int
+
+	// Hash chooses the slot of a key, default is crc32
+	Hash HashFunc
+}
+
 type KeyLockerGroup struct {
-	set []*refLockSet
+	set  []*refLockSet
+	hash HashFunc
+
+	ranges *RangeLockerGroup
 }
 
 func NewKeyLockerGroup() *KeyLockerGroup {
+	return NewKeyLockerGroupWithConfig(KeyLockerGroupConfig{})
+}
+
+func NewKeyLockerGroupWithConfig(cfg KeyLockerGroupConfig) *KeyLockerGroup {
 	g := new(KeyLockerGroup)
 
-	g.set = make([]*refLockSet, defaultKeySlotSize)
-	for i := 0; i < defaultKeySlotSize; i++ {
+	slotSize := cfg.SlotSize
+	if slotSize <= 0 {
+		slotSize = defaultKeySlotSize
+	}
+
+	g.set = make([]*refLockSet, slotSize)
+	for i := 0; i < slotSize; i++ {
 		g.set[i] = newRefLockSet()
 	}
-	return g
 
+	g.hash = cfg.Hash
+	if g.hash == nil {
+		g.hash = crc32Hash
+	}
+
+	g.ranges = cfg.Ranges
+	if g.ranges != nil {
+		g.ranges.addKeyGroup(g)
+	}
+	return g
 }
 
 func (g *KeyLockerGroup) getSet(key string) *refLockSet {
-	index := crc32.ChecksumIEEE([]byte(key)) % uint32(defaultKeySlotSize)
+	index := g.hash(key) % uint32(len(g.set))
 	return g.set[index]
 }
 
-func (g *KeyLockerGroup) Lock(keys ...string) {
+func (g *KeyLockerGroup) Lock(keys ...string) error {
 	// use a very long timeout
-	b := g.LockTimeout(InfiniteTimeout, keys...)
-	if !b {
-		panic("Wait lock too long, panic")
-	}
+	return g.LockTimeout(InfiniteTimeout, keys...)
 }
 
 func removeDuplicatedItems(keys ...string) []string {
@@ -55,9 +83,43 @@ func removeDuplicatedItems(keys ...string) []string {
 	return p
 }
 
-func (g *KeyLockerGroup) LockTimeout(timeout time.Duration, keys ...string) bool {
+// LockTimeout locks all keys, returns ErrLockTimeout if not all
+// are locked before timeout, no key is locked then.
+func (g *KeyLockerGroup) LockTimeout(timeout time.Duration, keys ...string) error {
+	return g.lockTimeout("", timeout, keys...)
+}
+
+// extendTimeout locks the keys for the holder of the held keys, the keys
+// sorting before the last held one are locked without waiting, so two
+// holders never wait for each other, see App Extend.
+func (g *KeyLockerGroup) extendTimeout(held []string, timeout time.Duration, keys ...string) error {
+	bound := ""
+	for _, key := range held {
+		if key > bound {
+			bound = key
+		}
+	}
+	return g.lockTimeout(bound, timeout, keys...)
+}
+
+// tryLock locks the keys without waiting, returns an error wrapping
+// ErrLockTimeout at once if any key, or a range containing it, is locked.
+func (g *KeyLockerGroup) tryLock(keys ...string) error {
+	// all the keys sort before the bound
+	bound := ""
+	for _, key := range keys {
+		if key >= bound {
+			bound = key + "\x00"
+		}
+	}
+	return g.lockTimeout(bound, 0, keys...)
+}
+
+// lockTimeout is like LockTimeout, but the keys sorting before the bound
+// are locked without waiting.
+func (g *KeyLockerGroup) lockTimeout(bound string, timeout time.Duration, keys ...string) error {
 	if len(keys) == 0 {
-		panic("empty keys, panic")
+		return invalidArgumentf("empty keys")
 	}
 
 	// remove duplicated items
@@ -69,26 +131,43 @@ func (g *KeyLockerGroup) LockTimeout(timeout time.Duration, keys ...string) bool
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
-	grapNum := 0
+	locks := make([]*refLock, 0, len(keys))
 
 	for _, key := range keys {
 		s := g.getSet(key)
 		m := s.Get(key)
-		b := LockWithTimer(m, timer)
-		if !b {
+
+		var err error
+		if key < bound {
+			if !m.tryLock() {
+				err = lockOrderf(key)
+			}
+		} else if !m.lockWithTimer(timer) {
+			err = ErrLockTimeout
+		}
+
+		if err != nil {
 			s.Put(key, m)
-			g.Unlock(keys[0:grapNum]...)
-			return false
-		} else {
-			grapNum++
+			g.releaseKeys(keys[0:len(locks)])
+			return err
 		}
+		locks = append(locks, m)
+	}
+
+	// lock the keys in the ranges after we own them, so the
+	// keys registered in the ranges never conflict with each other.
+	if g.ranges != nil && !g.ranges.lockKeys(keys, locks, timer) {
+		g.releaseKeys(keys)
+		return ErrLockTimeout
 	}
-	return true
+	return nil
 }
 
-func (g *KeyLockerGroup) Unlock(keys ...string) {
+// Unlock unlocks all keys, returns ErrNotLocked if any key is not
+// locked, the other locked keys are still unlocked.
+func (g *KeyLockerGroup) Unlock(keys ...string) error {
 	if len(keys) == 0 {
-		return
+		return nil
 	}
 
 	// remove duplicated items
@@ -97,15 +176,106 @@ func (g *KeyLockerGroup) Unlock(keys ...string) {
 	// Reverse Sort keys to avoid deadlock
 	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
 
+	// remove the keys from the ranges before we release them,
+	// so the keys can not be registered by others at the same time.
+	if g.ranges != nil {
+		locks := make([]*refLock, len(keys))
+		for i, key := range keys {
+			locks[i] = g.getSet(key).RawGet(key)
+		}
+		g.ranges.unlockKeys(keys, locks)
+	}
+
+	return g.releaseKeys(keys)
+}
+
+// WaitFreeTimeout waits until none of the keys is locked at a moment, and
+// none of the ranges containing them if Ranges is set, without locking them,
+// returns ErrLockTimeout if the keys are not free before timeout.
+func (g *KeyLockerGroup) WaitFreeTimeout(timeout time.Duration, keys ...string) error {
+	if len(keys) == 0 {
+		return invalidArgumentf("empty keys")
+	}
+
+	keys = removeDuplicatedItems(keys...)
+	sort.Strings(keys)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		key, ch, free := g.checkFree(keys)
+		if free {
+			return nil
+		}
+
+		if ch != nil {
+			// a range containing the keys is locked
+			select {
+			case <-ch:
+				continue
+			case <-timer.C:
+				return ErrLockTimeout
+			}
+		}
+
+		// wait the locked key, the read lock is released at once,
+		// and we check all the keys together again
+		s := g.getSet(key)
+		m := s.Get(key)
+		b := m.rlockWithTimer(timer)
+		if b {
+			m.tryRUnlock()
+		}
+		s.Put(key, m)
+
+		if !b {
+			return ErrLockTimeout
+		}
+	}
+}
+
+// checkFree read locks the keys without waiting, and checks the ranges
+// when holding the read locks, so it sees the keys at a moment. It returns
+// the locked key, or the channel to wait the ranges if they are not free.
+func (g *KeyLockerGroup) checkFree(keys []string) (string, <-chan struct{}, bool) {
+	locks := make([]*refLock, 0, len(keys))
+	defer func() {
+		for i, m := range locks {
+			m.tryRUnlock()
+			g.getSet(keys[i]).Put(keys[i], m)
+		}
+	}()
+
 	for _, key := range keys {
-		m := g.getSet(key).RawGet(key)
+		m := g.getSet(key).Get(key)
+		if !m.tryRLock() {
+			g.getSet(key).Put(key, m)
+			return key, nil, false
+		}
+		locks = append(locks, m)
+	}
 
-		if m == nil {
-			panic(fmt.Sprintf("%s is not locked, panic", key))
+	if g.ranges != nil {
+		if ch, free := g.ranges.checkKeysFree(keys); !free {
+			return "", ch, false
 		}
+	}
+	return "", nil, true
+}
+
+func (g *KeyLockerGroup) releaseKeys(keys []string) error {
+	var err error
+	for _, key := range keys {
+		m := g.getSet(key).RawGet(key)
 
-		m.Unlock()
+		if m == nil || !m.tryUnlock() {
+			err = notLockedf(key)
+			continue
+		}
 
 		g.getSet(key).Put(key, m)
 	}
+
+	return err
 }
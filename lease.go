@@ -0,0 +1,200 @@
+package tlock
+
+import (
+	"time"
+)
+
+// A lease is a ttl bound to many locks, if the lease is not
+// renewed before the ttl expires, all its locks are released.
+type lease struct {
+	id  uint64
+	ttl time.Duration
+
+	timer *time.Timer
+
+	// when the lease expires if not renewed
+	deadline time.Time
+
+	lockIDs map[uint64]struct{}
+}
+
+// the lease ids and lock ids are generated together, so a detached
+// lock can use its id for its lease.
+func (a *App) genLeaseID() uint64 {
+	return a.genLockID()
+}
+
+// GrantLease creates a lease with ttl, you must renew it before the ttl expires
+func (a *App) GrantLease(ttl time.Duration) (uint64, error) {
+	if ttl <= 0 {
+		return 0, invalidArgumentf("invalid lease ttl %v", ttl)
+	}
+
+	if a.isShuttingDown() {
+		return 0, ErrShuttingDown
+	}
+
+	id := a.genLeaseID()
+	a.addLease(id, ttl)
+	return id, nil
+}
+
+// grantDetachedLease grants the lease of a detached lock, the lease has
+// the lock id and only the lock.
+func (a *App) grantDetachedLease(id uint64, ttl time.Duration) {
+	a.addLease(id, ttl, id)
+}
+
+func (a *App) addLease(id uint64, ttl time.Duration, lockIDs ...uint64) {
+	l := new(lease)
+	l.id = id
+	l.ttl = ttl
+	l.lockIDs = make(map[uint64]struct{})
+	for _, lockID := range lockIDs {
+		l.lockIDs[lockID] = struct{}{}
+	}
+
+	a.leasesMutex.Lock()
+	a.leases[l.id] = l
+	l.deadline = time.Now().Add(ttl)
+	l.timer = time.AfterFunc(ttl, func() {
+		a.revokeLease(l.id, AuditExpire)
+	})
+	a.leasesMutex.Unlock()
+}
+
+// dropLease deletes the lease without releasing its locks
+func (a *App) dropLease(id uint64) {
+	a.leasesMutex.Lock()
+	l, ok := a.leases[id]
+	delete(a.leases, id)
+	a.leasesMutex.Unlock()
+
+	if ok {
+		l.timer.Stop()
+	}
+}
+
+// RenewLease resets the lease ttl
+func (a *App) RenewLease(id uint64) error {
+	a.leasesMutex.Lock()
+	defer a.leasesMutex.Unlock()
+
+	l, ok := a.leases[id]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+
+	if !l.timer.Stop() {
+		// the lease is expired and being revoked
+		return ErrLeaseNotFound
+	}
+
+	l.timer.Reset(l.ttl)
+	l.deadline = time.Now().Add(l.ttl)
+	return nil
+}
+
+// RevokeLease deletes the lease and releases all its locks
+func (a *App) RevokeLease(id uint64) error {
+	return a.revokeLease(id, AuditRelease)
+}
+
+// revokeLease releases the locks with the audit event
+func (a *App) revokeLease(id uint64, event AuditEvent) error {
+	a.leasesMutex.Lock()
+	l, ok := a.leases[id]
+	delete(a.leases, id)
+	a.leasesMutex.Unlock()
+
+	if !ok {
+		return ErrLeaseNotFound
+	}
+
+	l.timer.Stop()
+
+	for lockID, _ := range l.lockIDs {
+		a.unlock(lockID, event)
+	}
+
+	return nil
+}
+
+func (a *App) leaseExists(id uint64) bool {
+	a.leasesMutex.Lock()
+	_, ok := a.leases[id]
+	a.leasesMutex.Unlock()
+	return ok
+}
+
+// leaseTTL returns the time left before the lease expires
+func (a *App) leaseTTL(id uint64) (time.Duration, bool) {
+	a.leasesMutex.Lock()
+	defer a.leasesMutex.Unlock()
+
+	l, ok := a.leases[id]
+	if !ok {
+		return 0, false
+	}
+	return time.Until(l.deadline), true
+}
+
+func (a *App) attachLease(id uint64, lockID uint64) error {
+	a.leasesMutex.Lock()
+	defer a.leasesMutex.Unlock()
+
+	l, ok := a.leases[id]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+
+	l.lockIDs[lockID] = struct{}{}
+	return nil
+}
+
+// moveLease moves the lock from a lease to another, zero means no lease,
+// it returns ErrNotLocked if the lease from is revoked, the lock is being
+// released with it, or ErrLeaseNotFound if the lease to is not found.
+func (a *App) moveLease(lockID uint64, from uint64, to uint64) error {
+	a.leasesMutex.Lock()
+	defer a.leasesMutex.Unlock()
+
+	var src, dst *lease
+	var ok bool
+	if from != 0 {
+		if src, ok = a.leases[from]; !ok {
+			return ErrNotLocked
+		}
+	}
+	if to != 0 {
+		if dst, ok = a.leases[to]; !ok {
+			return ErrLeaseNotFound
+		}
+	}
+
+	if src != nil {
+		delete(src.lockIDs, lockID)
+	}
+	if dst != nil {
+		dst.lockIDs[lockID] = struct{}{}
+	}
+	return nil
+}
+
+// leaveLease removes the lock from its lease, the lease of a detached
+// lock is dropped with it.
+func (a *App) leaveLease(l *lockInfo) {
+	if l.opts.Detach > 0 {
+		a.dropLease(l.opts.Lease)
+	} else if l.opts.Lease != 0 {
+		a.detachLease(l.opts.Lease, l.id)
+	}
+}
+
+func (a *App) detachLease(id uint64, lockID uint64) {
+	a.leasesMutex.Lock()
+	if l, ok := a.leases[id]; ok {
+		delete(l.lockIDs, lockID)
+	}
+	a.leasesMutex.Unlock()
+}
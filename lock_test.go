@@ -1,7 +1,17 @@
 package tlock
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/quick"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -45,12 +55,12 @@ func (s *lockTestSuite) TestKeyLock(c *C) {
 
 	time.Sleep(1 * time.Second)
 
-	b := g.LockTimeout(100*time.Millisecond, "a")
-	c.Assert(b, Equals, false)
+	err := g.LockTimeout(100*time.Millisecond, "a")
+	c.Assert(err, Equals, ErrLockTimeout)
 	wg.Wait()
 
-	b = g.LockTimeout(100*time.Millisecond, "a")
-	c.Assert(b, Equals, true)
+	err = g.LockTimeout(100*time.Millisecond, "a")
+	c.Assert(err, IsNil)
 
 	g.Unlock("a")
 
@@ -68,13 +78,13 @@ func (s *lockTestSuite) TestKeyLock(c *C) {
 
 	time.Sleep(1 * time.Second)
 
-	b = g.LockTimeout(100*time.Millisecond, "a")
-	c.Assert(b, Equals, false)
+	err = g.LockTimeout(100*time.Millisecond, "a")
+	c.Assert(err, Equals, ErrLockTimeout)
 
 	wg.Wait()
 
-	b = g.LockTimeout(100*time.Millisecond, "a")
-	c.Assert(b, Equals, true)
+	err = g.LockTimeout(100*time.Millisecond, "a")
+	c.Assert(err, IsNil)
 
 	g.Unlock("a")
 }
@@ -111,12 +121,12 @@ func (s *lockTestSuite) TestPathLock(c *C) {
 
 	time.Sleep(1 * time.Second)
 
-	b := g.LockTimeout(100*time.Millisecond, "a/b")
-	c.Assert(b, Equals, false)
+	err := g.LockTimeout(100*time.Millisecond, "a/b")
+	c.Assert(err, Equals, ErrLockTimeout)
 	wg.Wait()
 
-	b = g.LockTimeout(100*time.Millisecond, "a/b")
-	c.Assert(b, Equals, true)
+	err = g.LockTimeout(100*time.Millisecond, "a/b")
+	c.Assert(err, IsNil)
 
 	g.Unlock("a/b")
 
@@ -134,13 +144,13 @@ func (s *lockTestSuite) TestPathLock(c *C) {
 
 	time.Sleep(1 * time.Second)
 
-	b = g.LockTimeout(100*time.Millisecond, "a")
-	c.Assert(b, Equals, false)
+	err = g.LockTimeout(100*time.Millisecond, "a")
+	c.Assert(err, Equals, ErrLockTimeout)
 
 	wg.Wait()
 
-	b = g.LockTimeout(100*time.Millisecond, "a")
-	c.Assert(b, Equals, true)
+	err = g.LockTimeout(100*time.Millisecond, "a")
+	c.Assert(err, IsNil)
 
 	g.Unlock("a")
 
@@ -161,3 +171,774 @@ func (s *lockTestSuite) TestDuplicatedNames(c *C) {
 	g2.Lock("a/b/c", "a/b/c")
 	g2.Unlock("a/b/c", "a/b/c")
 }
+
+func (s *lockTestSuite) TestInvalidInput(c *C) {
+	g1 := NewKeyLockerGroup()
+
+	c.Assert(errors.Is(g1.Lock(), ErrInvalidArgument), Equals, true)
+	c.Assert(errors.Is(g1.Unlock("a"), ErrNotLocked), Equals, true)
+
+	c.Assert(g1.Lock("a"), IsNil)
+	c.Assert(errors.Is(g1.Unlock("a", "b"), ErrNotLocked), Equals, true)
+	// a is still unlocked
+	c.Assert(errors.Is(g1.Unlock("a"), ErrNotLocked), Equals, true)
+
+	g2 := NewPathLockerGroup()
+
+	c.Assert(errors.Is(g2.Lock(), ErrInvalidArgument), Equals, true)
+	c.Assert(errors.Is(g2.Lock("/"), ErrInvalidArgument), Equals, true)
+	c.Assert(errors.Is(g2.Lock("a/..", "b"), ErrInvalidArgument), Equals, true)
+	c.Assert(errors.Is(g2.Unlock("a/b"), ErrNotLocked), Equals, true)
+
+	c.Assert(g2.Lock("a/b"), IsNil)
+	// a/b/c is not locked, and a is not write locked
+	c.Assert(errors.Is(g2.Unlock("a/b/c"), ErrNotLocked), Equals, true)
+	c.Assert(errors.Is(g2.Unlock("a"), ErrNotLocked), Equals, true)
+	c.Assert(g2.Unlock("a/b"), IsNil)
+	c.Assert(g2.Lock("a"), IsNil)
+	c.Assert(g2.Unlock("a"), IsNil)
+}
+
+func (s *lockTestSuite) TestPathSeparator(c *C) {
+	g1 := NewPathLockerGroup()
+	g2 := NewPathLockerGroupWithConfig(PathLockerGroupConfig{Separator: "."})
+	g3 := NewPathLockerGroupWithConfig(PathLockerGroupConfig{Raw: true})
+	g4 := NewPathLockerGroupWithConfig(PathLockerGroupConfig{Separator: "::", Raw: true})
+
+	tbl := []struct {
+		g    *PathLockerGroup
+		path string
+		// canonical path, empty means invalid
+		canonical string
+	}{
+		{g1, "a/b/c", "a/b/c/"},
+		{g1, "/a//b/./c/", "a/b/c/"},
+		{g1, "a/../../b", "b/"},
+		{g1, "a.b", "a.b/"},
+		{g1, "", ""},
+		{g1, "a/..", ""},
+		{g2, "org.team.service", "org.team.service."},
+		{g2, ".org..team.", "org.team."},
+		{g2, "a/b", "a/b."},
+		{g2, "...", ""},
+		{g3, "a/../b", "a/../b/"},
+		{g3, "a//b", "a//b/"},
+		{g3, "a/b/", "a/b/"},
+		{g3, "/a", "/a/"},
+		{g3, "//", "//"},
+		{g3, "/", ""},
+		{g4, "a::b::", "a::b::"},
+		{g4, "a:b", "a:b::"},
+	}
+
+	for _, t := range tbl {
+		paths, err := t.g.NormalizePaths(t.path)
+		if len(t.canonical) == 0 {
+			c.Assert(errors.Is(err, ErrInvalidArgument), Equals, true, Commentf("%q", t.path))
+		} else {
+			c.Assert(err, IsNil, Commentf("%q", t.path))
+			c.Assert(paths, DeepEquals, []string{t.canonical})
+		}
+	}
+
+	conflict := func(g *PathLockerGroup, p1 string, p2 string) bool {
+		c.Assert(g.Lock(p1), IsNil)
+		err := g.LockTimeout(10*time.Millisecond, p2)
+		if err == nil {
+			c.Assert(g.Unlock(p2), IsNil)
+		} else {
+			c.Assert(err, Equals, ErrLockTimeout)
+		}
+		c.Assert(g.Unlock(p1), IsNil)
+		return err != nil
+	}
+
+	c.Assert(conflict(g2, "org.team", "org.team.service"), Equals, true)
+	c.Assert(conflict(g2, "org.team.service", "org.team"), Equals, true)
+	c.Assert(conflict(g2, "org.team.a", "org.team.b"), Equals, false)
+	c.Assert(conflict(g2, "org/team", "org"), Equals, false)
+
+	// trailing separator is ignored
+	c.Assert(conflict(g3, "a/b/", "a/b"), Equals, true)
+	// .. is a literal segment in raw mode
+	c.Assert(conflict(g3, "a/../b", "b"), Equals, false)
+	c.Assert(conflict(g3, "a/..", "a/../b"), Equals, true)
+	c.Assert(conflict(g1, "a/c/../b", "a/b"), Equals, true)
+	// empty segment is kept in raw mode
+	c.Assert(conflict(g3, "a//b", "a/b"), Equals, false)
+	c.Assert(conflict(g3, "a/", "a//b"), Equals, true)
+	c.Assert(conflict(g1, "a//b", "a/b"), Equals, true)
+}
+
+// bruteForceNormalizePaths removes a path if another path is its
+// ancestor, the result is the same as NormalizePaths.
+func bruteForceNormalizePaths(g *PathLockerGroup, paths []string) []string {
+	canonical := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		canonical[g.canonicalizePath(path)] = struct{}{}
+	}
+
+	p := make([]string, 0, len(canonical))
+	for path := range canonical {
+		subsumed := false
+		for _, item := range makeAncestorPaths(path, g.sep) {
+			if _, ok := canonical[item]; ok && item != path {
+				subsumed = true
+				break
+			}
+		}
+
+		if !subsumed {
+			p = append(p, path)
+		}
+	}
+
+	sort.Strings(p)
+	return p
+}
+
+func (s *lockTestSuite) TestNormalizePaths(c *C) {
+	paths, err := NormalizePaths("b/", "ab/c/", "a/b/c", "a/b", "/a/b/", "b/a")
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []string{"a/b/", "ab/c/", "b/"})
+
+	// the input is not changed
+	input := []string{"a/b/c", "a"}
+	paths, err = NormalizePaths(input...)
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []string{"a/"})
+	c.Assert(input, DeepEquals, []string{"a/b/c", "a"})
+
+	groups := []*PathLockerGroup{
+		NewPathLockerGroup(),
+		NewPathLockerGroupWithConfig(PathLockerGroupConfig{Separator: "."}),
+		NewPathLockerGroupWithConfig(PathLockerGroupConfig{Raw: true}),
+		NewPathLockerGroupWithConfig(PathLockerGroupConfig{Separator: "::", Raw: true}),
+	}
+
+	// the last segment b: ends with a part of the separator
+	paths, err = groups[3].NormalizePaths("a::b:", "a::b", "a::b:::c")
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []string{"a::b::", "a::b:::"})
+
+	segs := []string{"a", "b", "ab", "ba", ".", "..", "", ":"}
+	seps := []string{"/", ".", "::", ":"}
+
+	randPath := func(r *rand.Rand) string {
+		n := r.Intn(5) + 1
+		p := make([]string, n)
+		for i := range p {
+			p[i] = segs[r.Intn(len(segs))]
+		}
+		return strings.Join(p, seps[r.Intn(len(seps))])
+	}
+
+	f := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		g := groups[r.Intn(len(groups))]
+
+		paths := make([]string, r.Intn(8)+1)
+		for i := range paths {
+			paths[i] = randPath(r)
+		}
+
+		for _, path := range paths {
+			if g.canonicalizePath(path) == g.sep {
+				_, err := g.NormalizePaths(paths...)
+				return errors.Is(err, ErrInvalidArgument)
+			}
+		}
+
+		p, err := g.NormalizePaths(paths...)
+		if err != nil {
+			return false
+		}
+
+		expected := bruteForceNormalizePaths(g, paths)
+		if !reflect.DeepEqual(p, expected) {
+			c.Logf("paths %q, sep %q, raw %v, got %q, expected %q", paths, g.sep, g.raw, p, expected)
+			return false
+		}
+		return true
+	}
+
+	err = quick.Check(f, &quick.Config{MaxCount: 10000})
+	c.Assert(err, IsNil)
+}
+
+func (s *lockTestSuite) TestMatchSegment(c *C) {
+	tbl := []struct {
+		pattern string
+		name    string
+		matched bool
+	}{
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"*", "", true},
+		{"*", "a/b", true},
+		{"a*c", "abbc", true},
+		{"a*c", "abcd", false},
+		{"a**", "a", true},
+		{"?", "a", true},
+		{"?", "", false},
+		{"[a-c]x", "bx", true},
+		{"[a-c]x", "dx", false},
+		{"[!a-c]x", "dx", true},
+		{"[^a-c]x", "ax", false},
+		{"[]]", "]", true},
+		{`[\]]`, "]", true},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+	}
+
+	for _, t := range tbl {
+		c.Assert(matchSegment(t.pattern, t.name), Equals, t.matched, Commentf("%v", t))
+	}
+
+	for _, p := range []string{"[", "[a-", `a\`, "[]"} {
+		c.Assert(validSegmentPattern(p), Equals, false, Commentf("%v", p))
+	}
+}
+
+func (s *lockTestSuite) TestGlobLock(c *C) {
+	g := NewPathLockerGroup()
+
+	err := g.LockGlob("services/*/config")
+	c.Assert(err, IsNil)
+
+	for _, path := range []string{"services", "services/a/config", "services/a/config/x"} {
+		err = g.LockTimeout(10*time.Millisecond, path)
+		c.Assert(err, Equals, ErrLockTimeout, Commentf("%v", path))
+	}
+
+	for _, path := range []string{"services/a/data", "other/a/config"} {
+		err = g.LockTimeout(10*time.Millisecond, path)
+		c.Assert(err, IsNil, Commentf("%v", path))
+		c.Assert(g.Unlock(path), IsNil)
+	}
+
+	for _, pattern := range []string{"services", "*/b/*", "services/a/conf*"} {
+		err = g.LockGlobTimeout(10*time.Millisecond, pattern)
+		c.Assert(err, Equals, ErrLockTimeout, Commentf("%v", pattern))
+	}
+
+	for _, pattern := range []string{"services/*/data", "other/*"} {
+		err = g.LockGlobTimeout(10*time.Millisecond, pattern)
+		c.Assert(err, IsNil, Commentf("%v", pattern))
+		c.Assert(g.UnlockGlob(pattern), IsNil)
+	}
+
+	// the path lock waits the glob lock
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(100 * time.Millisecond)
+		g.UnlockGlob("/services/*/config/")
+	}()
+
+	err = g.LockTimeout(time.Second, "services/a/config")
+	c.Assert(err, IsNil)
+	wg.Wait()
+
+	// and the glob lock waits the path lock
+	err = g.LockGlobTimeout(10*time.Millisecond, "services/?/config")
+	c.Assert(err, Equals, ErrLockTimeout)
+
+	c.Assert(g.Unlock("services/a/config"), IsNil)
+
+	err = g.LockGlobTimeout(10*time.Millisecond, "services/?/config")
+	c.Assert(err, IsNil)
+	c.Assert(g.UnlockGlob("services/?/config"), IsNil)
+
+	// a bogus unlock must not release the paths of others
+	c.Assert(g.Lock("x/y"), IsNil)
+	c.Assert(errors.Is(g.Unlock("x"), ErrNotLocked), Equals, true)
+	c.Assert(g.LockGlobTimeout(10*time.Millisecond, "x/*"), Equals, ErrLockTimeout)
+	c.Assert(g.Unlock("x/y"), IsNil)
+
+	c.Assert(errors.Is(g.UnlockGlob("x/*"), ErrNotLocked), Equals, true)
+	c.Assert(errors.Is(g.LockGlob("a/[b"), ErrInvalidArgument), Equals, true)
+	c.Assert(errors.Is(g.LockGlob("/"), ErrInvalidArgument), Equals, true)
+}
+
+func (s *lockTestSuite) TestGlobSeparator(c *C) {
+	g := NewPathLockerGroupWithConfig(PathLockerGroupConfig{Separator: "."})
+
+	c.Assert(g.LockGlob("org.*.service"), IsNil)
+
+	// a wildcard matches / but not the separator
+	c.Assert(g.LockTimeout(10*time.Millisecond, "org.a/b.service"), Equals, ErrLockTimeout)
+	c.Assert(g.LockTimeout(10*time.Millisecond, "org.a.b.service"), IsNil)
+	c.Assert(g.Unlock("org.a.b.service"), IsNil)
+
+	c.Assert(g.UnlockGlob("org.*.service"), IsNil)
+}
+
+func (s *lockTestSuite) TestRangeTree(c *C) {
+	var t rangeTree
+
+	bruteForce := make(map[keyRange]struct{})
+
+	randomRange := func() keyRange {
+		start := string(rune('a' + rand.Intn(26)))
+		switch rand.Intn(4) {
+		case 0:
+			return pointRange(start)
+		case 1:
+			return keyRange{start, ""}
+		default:
+			return keyRange{start, start + string(rune('a'+rand.Intn(26)))}
+		}
+	}
+
+	for i := 0; i < 10000; i++ {
+		r := randomRange()
+
+		expected := false
+		for b, _ := range bruteForce {
+			if b.intersects(r) {
+				expected = true
+				break
+			}
+		}
+		c.Assert(t.Intersects(r), Equals, expected, Commentf("%v", r))
+
+		_, ok := bruteForce[r]
+		if rand.Intn(2) == 0 {
+			c.Assert(t.Delete(r), Equals, ok)
+			delete(bruteForce, r)
+		} else if !ok {
+			t.Insert(r)
+			bruteForce[r] = struct{}{}
+		}
+
+		c.Assert(t.size, Equals, len(bruteForce))
+	}
+}
+
+func (s *lockTestSuite) TestRangeLock(c *C) {
+	r := NewRangeLockerGroup()
+	g := NewKeyLockerGroupWithConfig(KeyLockerGroupConfig{Ranges: r})
+
+	c.Assert(r.Lock("user:1000", "user:2000", "user:5000", ""), IsNil)
+
+	for _, args := range [][]string{
+		{"user:1500", "user:3000"},
+		{"user:0", "user:1001"},
+		{"user:6", "user:7"},
+		{"", ""},
+	} {
+		c.Assert(r.LockTimeout(10*time.Millisecond, args...), Equals, ErrLockTimeout, Commentf("%v", args))
+	}
+
+	for _, key := range []string{"user:1000", "user:1999", "user:9"} {
+		c.Assert(g.LockTimeout(10*time.Millisecond, key), Equals, ErrLockTimeout, Commentf("%v", key))
+	}
+
+	c.Assert(g.LockTimeout(10*time.Millisecond, "user:2000"), IsNil)
+	c.Assert(r.LockTimeout(10*time.Millisecond, "user:2000", "user:3000"), Equals, ErrLockTimeout)
+	c.Assert(r.LockTimeout(10*time.Millisecond, "user:2000\x00", "user:3000"), IsNil)
+	c.Assert(r.Unlock("user:2000\x00", "user:3000"), IsNil)
+
+	// the key waits the range
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(100 * time.Millisecond)
+		r.Unlock("user:1000", "user:2000", "user:5000", "")
+	}()
+
+	c.Assert(g.LockTimeout(time.Second, "user:1500"), IsNil)
+	wg.Wait()
+
+	// and the range waits the keys
+	c.Assert(r.LockTimeout(10*time.Millisecond, "user:1", "user:3"), Equals, ErrLockTimeout)
+	c.Assert(g.Unlock("user:1500", "user:2000"), IsNil)
+	c.Assert(r.LockTimeout(10*time.Millisecond, "user:1", "user:3"), IsNil)
+
+	// the intersecting ranges in a lock are merged
+	c.Assert(r.Lock("a", "c", "b", "d"), IsNil)
+	c.Assert(r.Unlock("b", "d", "a", "c"), IsNil)
+
+	c.Assert(errors.Is(r.Unlock("a", "b"), ErrNotLocked), Equals, true)
+	c.Assert(errors.Is(r.Lock("a"), ErrInvalidArgument), Equals, true)
+	c.Assert(errors.Is(r.Lock("b", "a"), ErrInvalidArgument), Equals, true)
+	c.Assert(errors.Is(r.Lock("a", "a"), ErrInvalidArgument), Equals, true)
+	c.Assert(r.Unlock("user:1", "user:3"), IsNil)
+}
+
+func (s *lockTestSuite) TestRangeLockFastKeys(c *C) {
+	r := NewRangeLockerGroup()
+	g := NewKeyLockerGroupWithConfig(KeyLockerGroupConfig{Ranges: r})
+
+	// no range, the keys are held without the tree
+	c.Assert(g.Lock("a", "c"), IsNil)
+	c.Assert(r.tree.size, Equals, 0)
+
+	// a range locker registers the keys held before it
+	c.Assert(r.LockTimeout(10*time.Millisecond, "a", "b"), Equals, ErrLockTimeout)
+	c.Assert(r.tree.size, Equals, 2)
+	c.Assert(r.Lock("b", "c"), IsNil)
+
+	// the keys are registered when a range is locked
+	c.Assert(g.LockTimeout(10*time.Millisecond, "b"), Equals, ErrLockTimeout)
+	c.Assert(g.Lock("d"), IsNil)
+	c.Assert(r.tree.size, Equals, 4)
+
+	c.Assert(g.Unlock("a", "c", "d"), IsNil)
+	c.Assert(r.Unlock("b", "c"), IsNil)
+	c.Assert(r.tree.size, Equals, 0)
+	c.Assert(atomic.LoadInt32(&r.active), Equals, int32(0))
+	c.Assert(atomic.LoadInt32(&r.fast), Equals, int32(0))
+
+	// the keys and the ranges never overlap
+	var (
+		m    sync.Mutex
+		held [10]bool
+		wg   sync.WaitGroup
+	)
+
+	hold := func(start int, end int, v bool) {
+		m.Lock()
+		defer m.Unlock()
+		for i := start; i < end; i++ {
+			c.Assert(held[i], Equals, !v, Commentf("%d", i))
+			held[i] = v
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				start := rand.Intn(10)
+				key := string(rune('a' + start))
+				if i%4 != 0 {
+					c.Assert(g.Lock(key), IsNil)
+					hold(start, start+1, true)
+					hold(start, start+1, false)
+					c.Assert(g.Unlock(key), IsNil)
+					continue
+				}
+
+				end := start + 1 + rand.Intn(10-start)
+				args := []string{key, string(rune('a' + end))}
+				c.Assert(r.Lock(args...), IsNil)
+				hold(start, end, true)
+				hold(start, end, false)
+				c.Assert(r.Unlock(args...), IsNil)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c.Assert(r.tree.size, Equals, 0)
+	c.Assert(atomic.LoadInt32(&r.active), Equals, int32(0))
+	c.Assert(atomic.LoadInt32(&r.fast), Equals, int32(0))
+}
+
+func (s *lockTestSuite) TestLockMode(c *C) {
+	g := NewPathLockerGroup()
+
+	modes := []LockMode{LockModeX, LockModeS, LockModeSIX}
+
+	// the same path
+	for _, m1 := range modes {
+		for _, m2 := range modes {
+			c.Assert(g.LockModeTimeout(m1, InfiniteTimeout, "db"), IsNil)
+
+			err := g.LockModeTimeout(m2, 10*time.Millisecond, "db")
+			if lockModeCompatible[m1][m2] {
+				c.Assert(err, IsNil, Commentf("%s %s", m1, m2))
+				c.Assert(g.UnlockMode(m2, "db"), IsNil)
+			} else {
+				c.Assert(err, Equals, ErrLockTimeout, Commentf("%s %s", m1, m2))
+			}
+
+			c.Assert(g.UnlockMode(m1, "db"), IsNil)
+		}
+	}
+
+	// the ancestor and the descendant
+	for _, m1 := range modes {
+		for _, m2 := range modes {
+			c.Assert(g.LockModeTimeout(m1, InfiniteTimeout, "db"), IsNil)
+
+			err := g.LockModeTimeout(m2, 10*time.Millisecond, "db/t")
+			if lockModeCompatible[m1][m2.intention()] {
+				c.Assert(err, IsNil, Commentf("%s %s", m1, m2))
+				c.Assert(g.UnlockMode(m2, "db/t"), IsNil)
+			} else {
+				c.Assert(err, Equals, ErrLockTimeout, Commentf("%s %s", m1, m2))
+			}
+
+			c.Assert(g.UnlockMode(m1, "db"), IsNil)
+		}
+	}
+
+	// a scan on db blocks the writer of db/t, but not the readers
+	c.Assert(g.LockModeTimeout(LockModeS, InfiniteTimeout, "db"), IsNil)
+	c.Assert(g.LockModeTimeout(LockModeS, InfiniteTimeout, "db/t"), IsNil)
+	c.Assert(g.LockTimeout(10*time.Millisecond, "db/t2"), Equals, ErrLockTimeout)
+
+	// the writer waits the scan
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(100 * time.Millisecond)
+		g.UnlockMode(LockModeS, "db")
+	}()
+	c.Assert(g.LockTimeout(time.Second, "db/t2"), IsNil)
+	wg.Wait()
+
+	// the sibling writers lock db with IX
+	c.Assert(g.LockTimeout(10*time.Millisecond, "db/t3"), IsNil)
+	c.Assert(g.LockModeTimeout(LockModeS, 10*time.Millisecond, "db"), Equals, ErrLockTimeout)
+
+	// a wrong mode unlocks nothing
+	c.Assert(errors.Is(g.UnlockMode(LockModeS, "db/t2"), ErrNotLocked), Equals, true)
+	c.Assert(errors.Is(g.LockModeTimeout(LockModeIS, time.Second, "db/t2"), ErrInvalidArgument), Equals, true)
+
+	c.Assert(g.Unlock("db/t2", "db/t3"), IsNil)
+	c.Assert(g.UnlockMode(LockModeS, "db/t"), IsNil)
+
+	c.Assert(g.LockModeTimeout(LockModeX, 10*time.Millisecond, "db"), IsNil)
+	c.Assert(g.Unlock("db"), IsNil)
+}
+
+func (s *lockTestSuite) TestLockModeFair(c *C) {
+	g := NewPathLockerGroup()
+
+	// the readers of the tables keep overlapping on db with IS
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				c.Check(g.LockModeTimeout(LockModeS, 5*time.Second, path), IsNil)
+				time.Sleep(time.Millisecond)
+				c.Check(g.UnlockMode(LockModeS, path), IsNil)
+			}
+		}(fmt.Sprintf("db/t%d", i))
+	}
+
+	// the writer of db is not starved, the new readers wait behind it
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(g.LockTimeout(time.Second, "db"), IsNil)
+	close(stop)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(g.Unlock("db"), IsNil)
+	wg.Wait()
+
+	// the requests behind a timed out one are granted
+	c.Assert(g.LockModeTimeout(LockModeS, time.Second, "db"), IsNil)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.Check(g.LockTimeout(50*time.Millisecond, "db"), Equals, ErrLockTimeout)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	t := time.Now()
+	c.Assert(g.LockModeTimeout(LockModeS, time.Second, "db/t"), IsNil)
+	c.Assert(time.Since(t) < time.Second, Equals, true)
+	wg.Wait()
+
+	c.Assert(g.UnlockMode(LockModeS, "db/t"), IsNil)
+	c.Assert(g.UnlockMode(LockModeS, "db"), IsNil)
+
+	// the paths sharing an ancestor lock it once with the count
+	c.Assert(g.LockTimeout(time.Second, "db/t1", "db/t2"), IsNil)
+	c.Assert(g.LockTimeout(10*time.Millisecond, "db"), Equals, ErrLockTimeout)
+	c.Assert(g.Unlock("db/t1"), IsNil)
+	c.Assert(g.LockTimeout(10*time.Millisecond, "db"), Equals, ErrLockTimeout)
+	c.Assert(g.Unlock("db/t2"), IsNil)
+
+	for _, set := range g.set {
+		c.Assert(set.set, HasLen, 0)
+	}
+}
+
+func (s *lockTestSuite) TestLockGroupConfig(c *C) {
+	var hashed int32
+	hash := func(name string) uint32 {
+		atomic.AddInt32(&hashed, 1)
+		return uint32(len(name))
+	}
+
+	k := NewKeyLockerGroupWithConfig(KeyLockerGroupConfig{SlotSize: 1, Hash: hash})
+	c.Assert(len(k.set), Equals, 1)
+	c.Assert(k.Lock("a", "b"), IsNil)
+	c.Assert(k.LockTimeout(10*time.Millisecond, "a"), Equals, ErrLockTimeout)
+	c.Assert(k.Unlock("a", "b"), IsNil)
+
+	g := NewPathLockerGroupWithConfig(PathLockerGroupConfig{SlotSize: 7, Hash: hash})
+	c.Assert(len(g.set), Equals, 7)
+	c.Assert(g.Lock("tenants/a/b"), IsNil)
+	c.Assert(g.LockTimeout(10*time.Millisecond, "tenants/a"), Equals, ErrLockTimeout)
+	c.Assert(g.Lock("tenants/b"), IsNil)
+
+	// every ancestor is in its own slot
+	c.Assert(g.getSet("tenants/").RawGet("tenants/"), NotNil)
+	c.Assert(g.getSet("tenants/a/").RawGet("tenants/a/"), NotNil)
+	c.Assert(g.getSet("tenants/a/b/").RawGet("tenants/a/b/"), NotNil)
+	c.Assert(g.getSet("tenants/a/b/") == g.getSet("tenants/"), Equals, false)
+
+	c.Assert(g.Unlock("tenants/a/b", "tenants/b"), IsNil)
+	c.Assert(atomic.LoadInt32(&hashed) > 0, Equals, true)
+}
+
+// firstSegmentHash hashes only the first segment, so all the paths
+// under a common root are in the same slot.
+func firstSegmentHash(name string) uint32 {
+	return crc32Hash(strings.SplitN(name, "/", 2)[0])
+}
+
+func benchmarkPathLock(b *testing.B, cfg PathLockerGroupConfig, depth int) {
+	g := NewPathLockerGroupWithConfig(cfg)
+
+	var n int32
+	b.RunParallel(func(pb *testing.PB) {
+		// every goroutine locks its own subtree under the common root
+		prefix := fmt.Sprintf("tenants/%d", atomic.AddInt32(&n, 1))
+		paths := make([]string, 16)
+		for i := range paths {
+			paths[i] = prefix + strings.Repeat(fmt.Sprintf("/%d", i), depth)
+		}
+
+		i := 0
+		for pb.Next() {
+			path := paths[i%len(paths)]
+			if err := g.Lock(path); err != nil {
+				b.Fatal(err)
+			}
+			if err := g.Unlock(path); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkPathLockCommonRoot(b *testing.B) {
+	for _, depth := range []int{1, 4} {
+		b.Run(fmt.Sprintf("depth=%d/first-segment", depth), func(b *testing.B) {
+			benchmarkPathLock(b, PathLockerGroupConfig{Hash: firstSegmentHash}, depth)
+		})
+		b.Run(fmt.Sprintf("depth=%d/slots=1", depth), func(b *testing.B) {
+			benchmarkPathLock(b, PathLockerGroupConfig{SlotSize: 1}, depth)
+		})
+		b.Run(fmt.Sprintf("depth=%d/default", depth), func(b *testing.B) {
+			benchmarkPathLock(b, PathLockerGroupConfig{}, depth)
+		})
+	}
+}
+
+func BenchmarkKeyLock(b *testing.B) {
+	for _, slots := range []int{1, 64, defaultKeySlotSize} {
+		b.Run(fmt.Sprintf("slots=%d", slots), func(b *testing.B) {
+			g := NewKeyLockerGroupWithConfig(KeyLockerGroupConfig{SlotSize: slots})
+
+			var n int32
+			b.RunParallel(func(pb *testing.PB) {
+				prefix := fmt.Sprintf("key%d-", atomic.AddInt32(&n, 1))
+				i := 0
+				for pb.Next() {
+					key := prefix + strconv.Itoa(i%16)
+					if err := g.Lock(key); err != nil {
+						b.Fatal(err)
+					}
+					if err := g.Unlock(key); err != nil {
+						b.Fatal(err)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func (s *lockTestSuite) TestWaitFree(c *C) {
+	r := NewRangeLockerGroup()
+	k := NewKeyLockerGroupWithConfig(KeyLockerGroupConfig{Ranges: r})
+
+	c.Assert(k.Lock("a"), IsNil)
+	c.Assert(k.WaitFreeTimeout(10*time.Millisecond, "b", "a"), Equals, ErrLockTimeout)
+	c.Assert(r.WaitFreeTimeout(10*time.Millisecond, "", "b"), Equals, ErrLockTimeout)
+	c.Assert(k.WaitFreeTimeout(10*time.Millisecond, "b", "c"), IsNil)
+	c.Assert(r.WaitFreeTimeout(10*time.Millisecond, "b", ""), IsNil)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(50 * time.Millisecond)
+		k.Unlock("a")
+		// the keys are not locked by the waiters
+		c.Assert(k.LockTimeout(time.Second, "a", "b"), IsNil)
+		c.Assert(k.Unlock("a", "b"), IsNil)
+	}()
+
+	c.Assert(k.WaitFreeTimeout(time.Second, "a", "b"), IsNil)
+	wg.Wait()
+
+	// the keys wait the ranges
+	c.Assert(r.Lock("a", "c"), IsNil)
+	c.Assert(k.WaitFreeTimeout(10*time.Millisecond, "b"), Equals, ErrLockTimeout)
+	c.Assert(k.WaitFreeTimeout(10*time.Millisecond, "c"), IsNil)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(50 * time.Millisecond)
+		r.Unlock("a", "c")
+	}()
+
+	c.Assert(k.WaitFreeTimeout(time.Second, "b"), IsNil)
+	wg.Wait()
+
+	g := NewPathLockerGroup()
+
+	c.Assert(g.Lock("a/b/c"), IsNil)
+	c.Assert(g.LockModeTimeout(LockModeS, time.Second, "x/y"), IsNil)
+	c.Assert(g.LockGlob("g/*/c"), IsNil)
+
+	for _, path := range []string{"a", "a/b/c", "a/b/c/d", "x/y", "x", "g/b", "g/b/c/d"} {
+		c.Assert(g.WaitFreeTimeout(10*time.Millisecond, "free", path), Equals, ErrLockTimeout, Commentf(path))
+	}
+
+	for _, path := range []string{"a/b/d", "a/bc", "x/z", "g/b/d"} {
+		c.Assert(g.WaitFreeTimeout(10*time.Millisecond, "free", path), IsNil, Commentf(path))
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(50 * time.Millisecond)
+		g.Unlock("a/b/c")
+		time.Sleep(50 * time.Millisecond)
+		g.UnlockMode(LockModeS, "x/y")
+		time.Sleep(50 * time.Millisecond)
+		g.UnlockGlob("g/*/c")
+	}()
+
+	c.Assert(g.WaitFreeTimeout(time.Second, "a/b", "x", "g"), IsNil)
+	wg.Wait()
+
+	// nothing is left locked
+	c.Assert(g.LockTimeout(10*time.Millisecond, "a", "x", "g"), IsNil)
+	c.Assert(g.Unlock("a", "x", "g"), IsNil)
+}
@@ -0,0 +1,286 @@
+package tlock
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// LockMode is the mode of a path lock, like the multi-granularity locking
+// in databases, a path lock locks the path with the mode, and its ancestors
+// with the intention mode, IS for S, IX for SIX and X.
+type LockMode int
+
+const (
+	// LockModeX is the exclusive mode, writes the subtree, it is the default
+	LockModeX LockMode = iota
+	// LockModeS is the shared mode, reads the subtree
+	LockModeS
+	// LockModeSIX is the shared and intention exclusive mode, reads the
+	// subtree and will write some descendants
+	LockModeSIX
+	// LockModeIX is the intention exclusive mode, will write some descendants
+	LockModeIX
+	// LockModeIS is the intention shared mode, will read some descendants
+	LockModeIS
+
+	numLockModes
+)
+
+var lockModeNames = [numLockModes]string{"x", "s", "six", "ix", "is"}
+
+// lockModeCompatible[a][b] is true if a and b can be held at the same time
+var lockModeCompatible = [numLockModes][numLockModes]bool{
+	//            X      S      SIX    IX     IS
+	LockModeX:   {false, false, false, false, false},
+	LockModeS:   {false, true, false, false, true},
+	LockModeSIX: {false, false, false, false, true},
+	LockModeIX:  {false, false, false, true, true},
+	LockModeIS:  {false, true, true, true, true},
+}
+
+func (m LockMode) String() string {
+	if m < 0 || m >= numLockModes {
+		return "unknown"
+	}
+	return lockModeNames[m]
+}
+
+// intention returns the mode to lock the ancestors
+func (m LockMode) intention() LockMode {
+	switch m {
+	case LockModeS, LockModeIS:
+		return LockModeIS
+	default:
+		return LockModeIX
+	}
+}
+
+// ParseLockMode parses x, s or six, the intention modes IS and IX are
+// only used for the ancestors, so they can not be parsed.
+func ParseLockMode(s string) (LockMode, error) {
+	switch strings.ToLower(s) {
+	case "", "x":
+		return LockModeX, nil
+	case "s":
+		return LockModeS, nil
+	case "six":
+		return LockModeSIX, nil
+	default:
+		return 0, invalidArgumentf("invalid lock mode %s, must be x, s or six", s)
+	}
+}
+
+// modeLock is a lock with many modes, the requests are granted in FIFO order,
+// a request waits if it is not compatible with the held modes, or any request
+// is waiting before it, so an X request is never starved by the overlapping
+// IS requests.
+type modeLock struct {
+	m sync.Mutex
+
+	// the reference count, protected by modeLockSet
+	ref int
+
+	held [numLockModes]int
+
+	// the waiting requests in FIFO order
+	queue []*modeWaiter
+
+	// created by WaitFree, closed when a mode is released
+	changed chan struct{}
+}
+
+// modeWaiter is a request waiting in the queue
+type modeWaiter struct {
+	mode LockMode
+	n    int
+
+	// closed when granted
+	ch      chan struct{}
+	granted bool
+}
+
+func (l *modeLock) compatible(mode LockMode) bool {
+	for m, n := range l.held {
+		if n > 0 && !lockModeCompatible[mode][m] {
+			return false
+		}
+	}
+	return true
+}
+
+// lockWithTimer locks the mode n times, like n requests together,
+// so a request holding the mode never waits behind the others.
+func (l *modeLock) lockWithTimer(mode LockMode, n int, timer *time.Timer) bool {
+	l.m.Lock()
+
+	if len(l.queue) == 0 && l.compatible(mode) {
+		l.held[mode] += n
+		l.m.Unlock()
+		return true
+	}
+
+	w := &modeWaiter{mode: mode, n: n, ch: make(chan struct{})}
+	l.queue = append(l.queue, w)
+	l.m.Unlock()
+
+	select {
+	case <-w.ch:
+		return true
+	case <-timer.C:
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if w.granted {
+		// granted after the timer fires, the timer is drained, so fail
+		l.held[mode] -= n
+	} else {
+		for i, v := range l.queue {
+			if v == w {
+				l.queue = append(l.queue[0:i], l.queue[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// the requests behind it may be granted now
+	l.release()
+	return false
+}
+
+// tryLock is like lockWithTimer, but returns false at once if it must wait
+func (l *modeLock) tryLock(mode LockMode, n int) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if len(l.queue) > 0 || !l.compatible(mode) {
+		return false
+	}
+
+	l.held[mode] += n
+	return true
+}
+
+// tryUnlock unlocks the mode, returns false if not locked
+func (l *modeLock) tryUnlock(mode LockMode) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.held[mode] <= 0 {
+		return false
+	}
+
+	l.held[mode]--
+	l.release()
+	return true
+}
+
+// release grants the waiting requests in order until one is not compatible,
+// and wakes up WaitFree, l.m is held.
+func (l *modeLock) release() {
+	n := 0
+	for _, w := range l.queue {
+		if !l.compatible(w.mode) {
+			break
+		}
+
+		l.held[w.mode] += w.n
+		w.granted = true
+		close(w.ch)
+		n++
+	}
+
+	if n > 0 {
+		l.queue = append(l.queue[0:0], l.queue[n:]...)
+	}
+
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+type modeLockSet struct {
+	sync.Mutex
+	set map[string]*modeLock
+}
+
+func newModeLockSet() *modeLockSet {
+	s := new(modeLockSet)
+
+	s.set = make(map[string]*modeLock, 16)
+
+	return s
+}
+
+func (s *modeLockSet) Get(key string) *modeLock {
+	return s.GetN(key, 1)
+}
+
+// GetN is like Get, but adds n references
+func (s *modeLockSet) GetN(key string, n int) *modeLock {
+	s.Lock()
+	defer s.Unlock()
+
+	v, ok := s.set[key]
+	if ok {
+		v.ref += n
+	} else {
+		v = &modeLock{ref: n}
+
+		s.set[key] = v
+	}
+
+	return v
+}
+
+func (s *modeLockSet) RawGet(key string) *modeLock {
+	s.Lock()
+	defer s.Unlock()
+
+	v := s.set[key]
+	return v
+}
+
+func (s *modeLockSet) Put(key string, v *modeLock) {
+	s.PutN(key, v, 1)
+}
+
+// PutN is like Put, but removes n references
+func (s *modeLockSet) PutN(key string, v *modeLock, n int) {
+	s.Lock()
+	defer s.Unlock()
+
+	v.ref -= n
+	if v.ref <= 0 {
+		delete(s.set, key)
+	}
+}
+
+// pathModeLockerGroup is the LockerGroup for path locks with the mode
+type pathModeLockerGroup struct {
+	g    *PathLockerGroup
+	mode LockMode
+}
+
+func (g *pathModeLockerGroup) Lock(paths ...string) error {
+	return g.g.LockModeTimeout(g.mode, InfiniteTimeout, paths...)
+}
+
+func (g *pathModeLockerGroup) LockTimeout(timeout time.Duration, paths ...string) error {
+	return g.g.LockModeTimeout(g.mode, timeout, paths...)
+}
+
+func (g *pathModeLockerGroup) extendTimeout(held []string, timeout time.Duration, paths ...string) error {
+	return g.g.extendTimeout(g.mode, held, timeout, paths...)
+}
+
+func (g *pathModeLockerGroup) tryLock(paths ...string) error {
+	return g.g.tryLockMode(g.mode, paths...)
+}
+
+func (g *pathModeLockerGroup) Unlock(paths ...string) error {
+	return g.g.UnlockMode(g.mode, paths...)
+}
@@ -1,9 +1,6 @@
 package tlock
 
 import (
-	"fmt"
-	"hash/crc32"
-	"path"
 	"sort"
 	"strings"
 	"time"
@@ -11,185 +8,456 @@ import (
 
 const defaultPathSlotSize = 4096
 
+const defaultPathSeparator = "/"
+
+type PathLockerGroupConfig struct {
+	// Separator splits the path into segments, default is "/"
+	Separator string
+
+	// Raw disables cleaning the path, so "." and ".." are literal segments
+	// and empty segments like "a//b" are kept, only one trailing separator
+	// is ignored, so "a/b/" is the same as "a/b".
+	Raw bool
+
+	// SlotSize is the number of slots, the paths in the same slot
+	// share a mutex to look up their locks, default is 4096
+	SlotSize int
+
+	// Hash chooses the slot of a path, every ancestor of a path is hashed
+	// separately, so the paths under a common root are spread across the
+	// slots, default is crc32
+	Hash HashFunc
+}
+
 type PathLockerGroup struct {
-	set []*refLockSet
+	set  []*modeLockSet
+	hash HashFunc
+
+	sep string
+	raw bool
+
+	globs *globTable
 }
 
-// a/b/c/ return ["a/", "a/b/", "a/b/c/"]
-func makeAncestorPaths(path string) []string {
+// a/b/c/ return ["a/", "a/b/", "a/b/c/"], the path must have the separator
+// suffix, and the path itself is always the last one, so for a multi-byte
+// separator like ::, a::b:::, whose last segment is b:, returns ["a::", "a::b:::"].
+func makeAncestorPaths(path string, sep string) []string {
 	items := make([]string, 0, 4)
 
+	body := path[0 : len(path)-len(sep)]
+
 	pos := 0
 	for {
-		index := strings.IndexByte(path[pos:], '/')
+		index := strings.Index(body[pos:], sep)
 		if index == -1 {
 			break
 		}
 
-		item := path[0 : pos+index+1]
+		item := path[0 : pos+index+len(sep)]
 		items = append(items, item)
 
-		pos += index + 1
-		if pos >= len(path) {
-			break
-		}
+		pos += index + len(sep)
 	}
 
-	return items
+	return append(items, path)
 }
 
-func (g *PathLockerGroup) Lock(paths ...string) {
+func (g *PathLockerGroup) Lock(paths ...string) error {
 	// use a very long timeout
-	b := g.LockTimeout(InfiniteTimeout, paths...)
-	if !b {
-		panic("Wait lock too long, panic")
-	}
+	return g.LockTimeout(InfiniteTimeout, paths...)
+}
+
+// LockTimeout locks all paths with LockModeX, returns ErrLockTimeout if not all
+// are locked before timeout, no path is locked then.
+func (g *PathLockerGroup) LockTimeout(timeout time.Duration, paths ...string) error {
+	return g.LockModeTimeout(LockModeX, timeout, paths...)
 }
 
-func (g *PathLockerGroup) LockTimeout(timeout time.Duration, paths ...string) bool {
+// LockModeTimeout locks all paths with the mode and their ancestors with the
+// intention mode, see LockMode, the modes are compatible as below:
+//
+//	      IS  IX  S   SIX X
+//	IS    y   y   y   y   n
+//	IX    y   y   n   n   n
+//	S     y   n   y   n   n
+//	SIX   y   n   n   n   n
+//	X     n   n   n   n   n
+//
+// so a subtree scan with S on db coexists with the readers of db/t with S,
+// which lock db with IS, but blocks the writers of db/t with X, which lock
+// db with IX.
+func (g *PathLockerGroup) LockModeTimeout(mode LockMode, timeout time.Duration, paths ...string) error {
+	return g.lockModeTimeout(mode, "", timeout, paths...)
+}
+
+// lockModeTimeout is like LockModeTimeout, but the nodes not sorting after
+// the bound are locked without waiting, see extendTimeout.
+func (g *PathLockerGroup) lockModeTimeout(mode LockMode, bound string, timeout time.Duration, paths ...string) error {
 	if len(paths) == 0 {
-		panic("empty paths, panic")
+		return invalidArgumentf("empty paths")
 	}
 
-	paths = g.canoicalizePaths(paths...)
+	if mode != LockModeX && mode != LockModeS && mode != LockModeSIX {
+		return invalidArgumentf("invalid lock mode %s", mode)
+	}
+
+	paths, err := g.NormalizePaths(paths...)
+	if err != nil {
+		return err
+	}
 
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
-	grapPathNum := 0
+	// register the paths first, so a glob lock can not lock them
+	if !g.globs.lockPaths(paths, timer) {
+		return ErrLockTimeout
+	}
+
+	if err := g.lockPathsWithTimer(paths, mode, bound, timer); err != nil {
+		g.globs.unlockPaths(paths)
+		return err
+	}
+
+	return nil
+}
+
+// extendTimeout locks the paths for the holder of the held paths, the nodes
+// not sorting after the held ones, like the ancestors shared with them, are
+// locked without waiting, so the holder never waits behind the requests
+// waiting it, see App Extend.
+func (g *PathLockerGroup) extendTimeout(mode LockMode, held []string, timeout time.Duration, paths ...string) error {
+	held, err := g.NormalizePaths(held...)
+	if err != nil {
+		return err
+	}
+
+	// the ancestors sort before the path, so the last path is the last node
+	return g.lockModeTimeout(mode, held[len(held)-1], timeout, paths...)
+}
+
+// tryLockMode locks the paths without waiting, returns an error wrapping
+// ErrLockTimeout at once if any node, or a glob covering it, is locked.
+func (g *PathLockerGroup) tryLockMode(mode LockMode, paths ...string) error {
+	paths, err := g.NormalizePaths(paths...)
+	if err != nil {
+		return err
+	}
+
+	// the nodes of the paths never sort after the last path
+	return g.lockModeTimeout(mode, paths[len(paths)-1], 0, paths...)
+}
 
+func (g *PathLockerGroup) lockPathsWithTimer(paths []string, mode LockMode, bound string, timer *time.Timer) error {
+	// no path is the ancestor of another after normalized, so a node is
+	// the path locked with the mode, or an ancestor locked with the
+	// intention mode for all its descendant paths.
+	counts := make(map[string]int)
 	for _, path := range paths {
-		items := makeAncestorPaths(path)
-
-		s := g.getSet(path)
-		grapLockNum := 0
-
-		for i, item := range items {
-			m := s.Get(item)
-			var b bool
-			if i == len(items)-1 {
-				// final node, use write lock
-				b = LockWithTimer(m, timer)
-			} else {
-				// ntermediate node, use read lock
-				b = LockWithTimer(m.RLocker(), timer)
-			}
+		items := makeAncestorPaths(path, g.sep)
+		for _, item := range items[0 : len(items)-1] {
+			counts[item]++
+		}
+	}
+
+	items := make([]string, 0, len(counts)+len(paths))
+	for item := range counts {
+		items = append(items, item)
+	}
+	items = append(items, paths...)
+
+	// lock the nodes in order, an ancestor is before its descendants, and a
+	// shared ancestor is locked once, so the FIFO queue of a node never makes
+	// a request wait behind the requests which wait it, no deadlock.
+	sort.Strings(items)
+
+	nodeMode := func(item string) (LockMode, int) {
+		if n, ok := counts[item]; ok {
+			return mode.intention(), n
+		}
+		return mode, 1
+	}
 
-			if !b {
-				s.Put(item, m)
+	for i, item := range items {
+		m, n := nodeMode(item)
 
-				g.unlockPathItems(s, items[0:grapLockNum], false)
-				g.Unlock(paths[0:grapPathNum]...)
+		s := g.getSet(item)
+		l := s.GetN(item, n)
 
-				return false
-			} else {
-				grapLockNum++
+		var err error
+		if item <= bound {
+			if !l.tryLock(m, n) {
+				err = lockOrderf(item)
 			}
+		} else if !l.lockWithTimer(m, n, timer) {
+			err = ErrLockTimeout
 		}
 
-		grapPathNum++
+		if err != nil {
+			s.PutN(item, l, n)
+
+			for _, item := range items[0:i] {
+				m, n := nodeMode(item)
+				l := g.getSet(item).RawGet(item)
+				for j := 0; j < n; j++ {
+					l.tryUnlock(m)
+				}
+				g.getSet(item).PutN(item, l, n)
+			}
+			return err
+		}
 	}
 
-	return true
+	return nil
 }
 
-func (g *PathLockerGroup) unlockPathItems(s *refLockSet, items []string, finalIsWriteLock bool) {
-	for i := len(items) - 1; i >= 0; i-- {
-		m := s.RawGet(items[i])
-		if m == nil {
-			panic(fmt.Sprintf("%s is not locked, panic", items[i]))
+func (g *PathLockerGroup) unlockPathItems(items []string, mode LockMode, hasFinal bool) error {
+	if hasFinal {
+		// check the final node first, if it is not locked with the mode, the
+		// path is not locked and we must not release the ancestor intentions.
+		final := items[len(items)-1]
+		s := g.getSet(final)
+		m := s.RawGet(final)
+		if m == nil || !m.tryUnlock(mode) {
+			return notLockedf(final)
 		}
 
-		if finalIsWriteLock && i == len(items)-1 {
-			// final node, use write lock
-			m.Unlock()
-		} else {
-			// intermediate node, use read lock
-			m.RUnlock()
+		s.Put(final, m)
+		items = items[0 : len(items)-1]
+	}
+
+	var err error
+	for i := len(items) - 1; i >= 0; i-- {
+		// intermediate node, use the intention mode
+		s := g.getSet(items[i])
+		m := s.RawGet(items[i])
+		if m == nil || !m.tryUnlock(mode.intention()) {
+			err = notLockedf(items[i])
+			continue
 		}
 
 		s.Put(items[i], m)
 	}
+
+	return err
 }
 
-func (g *PathLockerGroup) Unlock(paths ...string) {
+// Unlock unlocks all paths locked with LockModeX, returns ErrNotLocked if
+// any path is not locked, the other locked paths are still unlocked.
+func (g *PathLockerGroup) Unlock(paths ...string) error {
+	return g.UnlockMode(LockModeX, paths...)
+}
+
+// UnlockMode unlocks all paths locked with the mode, see Unlock.
+func (g *PathLockerGroup) UnlockMode(mode LockMode, paths ...string) error {
 	if len(paths) == 0 {
-		return
+		return nil
+	}
+
+	paths, err := g.NormalizePaths(paths...)
+	if err != nil {
+		return err
 	}
 
-	paths = g.canoicalizePaths(paths...)
 	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
 
 	for _, path := range paths {
-		items := makeAncestorPaths(path)
+		items := makeAncestorPaths(path, g.sep)
 
-		s := g.getSet(path)
+		if e := g.unlockPathItems(items, mode, true); e != nil {
+			err = e
+			continue
+		}
 
-		g.unlockPathItems(s, items, true)
+		g.globs.unlockPaths([]string{path})
 	}
-}
 
-func (g *PathLockerGroup) getSet(path string) *refLockSet {
-	base := strings.SplitN(path, "/", 2)
-	index := crc32.ChecksumIEEE([]byte(base[0])) % uint32(defaultPathSlotSize)
-	return g.set[index]
+	return err
 }
 
-func (g *PathLockerGroup) canonicalizePath(p string) string {
-	p = path.Clean(p)
+// WaitFreeTimeout waits until none of the paths, their ancestors and their
+// descendants is locked at a moment, including the glob locks, without
+// locking them, returns ErrLockTimeout if the paths are not free before timeout.
+func (g *PathLockerGroup) WaitFreeTimeout(timeout time.Duration, paths ...string) error {
+	if len(paths) == 0 {
+		return invalidArgumentf("empty paths")
+	}
+
+	paths, err := g.NormalizePaths(paths...)
+	if err != nil {
+		return err
+	}
+
+	// a path is free if it can be locked with LockModeX, the path
+	// node has no lock, and the ancestors have no lock but IS and IX,
+	// which are for other descendants.
+	modes := make(map[string]LockMode)
+	for _, path := range paths {
+		items := makeAncestorPaths(path, g.sep)
+		for _, item := range items[0 : len(items)-1] {
+			modes[item] = LockModeX.intention()
+		}
+	}
+	for _, path := range paths {
+		// no path is the ancestor of another after normalized
+		modes[path] = LockModeX
+	}
 
-	// remove first, so /a/b/c will be a/b/c
-	p = strings.TrimPrefix(p, "/")
+	items := make([]string, 0, len(modes))
+	for item := range modes {
+		items = append(items, item)
+	}
+	sort.Strings(items)
 
-	// add / suffix, path Clean will remove the / suffix
-	p = p + "/"
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		ch := g.checkFree(paths, items, modes)
+		if ch == nil {
+			return nil
+		}
 
-	return p
+		select {
+		case <-ch:
+		case <-timer.C:
+			return ErrLockTimeout
+		}
+	}
 }
 
-func (g *PathLockerGroup) canoicalizePaths(paths ...string) []string {
-	for i, path := range paths {
-		paths[i] = g.canonicalizePath(path)
-		if paths[i] == "/" {
-			panic("invalid path, can not empty")
+// checkFree holds the glob table and the nodes of the items together, so it
+// sees the paths at a moment, it returns nil if the paths are free, or the
+// channel to wait.
+func (g *PathLockerGroup) checkFree(paths []string, items []string, modes map[string]LockMode) <-chan struct{} {
+	g.globs.m.RLock()
+	defer g.globs.m.RUnlock()
+
+	if g.globs.pathsConflict(paths) {
+		return g.globs.changed
+	}
+
+	nodes := make([]*modeLock, len(items))
+	for i, item := range items {
+		nodes[i] = g.getSet(item).Get(item)
+	}
+
+	// the locks only hold one node mutex at a time, and we
+	// hold them in order, so no deadlock
+	for _, m := range nodes {
+		m.m.Lock()
+	}
+
+	var ch chan struct{}
+	for i, m := range nodes {
+		if !m.compatible(modes[items[i]]) {
+			if m.changed == nil {
+				m.changed = make(chan struct{})
+			}
+			ch = m.changed
+			break
 		}
 	}
 
-	if len(paths) <= 1 {
-		return paths
+	for i, m := range nodes {
+		m.m.Unlock()
+		g.getSet(items[i]).Put(items[i], m)
 	}
 
-	p := make([]string, 0, len(paths))
+	return ch
+}
 
-	sort.Strings(paths)
+// getSet returns the slot of a path item, not the first segment,
+// so the items of a path may be in different slots.
+func (g *PathLockerGroup) getSet(item string) *modeLockSet {
+	index := g.hash(item) % uint32(len(g.set))
+	return g.set[index]
+}
 
-	p = append(p, paths[0])
+// canonicalizePath returns the path with a separator suffix,
+// like a/b/c/, an empty path returns only the separator.
+func (g *PathLockerGroup) canonicalizePath(p string) string {
+	if g.raw {
+		return strings.TrimSuffix(p, g.sep) + g.sep
+	}
 
-	for i := 1; i < len(paths); i++ {
-		skipped := false
-		for j := 0; j < len(p); j++ {
-			if strings.Contains(paths[i], p[j]) {
-				// if we want to lock a/b and a/b/c at same time, we only
-				// need to lock the parent path a/b
-				skipped = true
-				break
+	// like path.Clean but for any separator, the path is always rooted,
+	// so /a/b/c will be a/b/c and ../a will be a
+	segs := strings.Split(p, g.sep)
+	items := make([]string, 0, len(segs))
+	for _, seg := range segs {
+		switch seg {
+		case "", ".":
+		case "..":
+			if len(items) > 0 {
+				items = items[0 : len(items)-1]
 			}
+		default:
+			items = append(items, seg)
 		}
+	}
 
-		if !skipped {
-			p = append(p, paths[i])
+	return strings.Join(items, g.sep) + g.sep
+}
+
+// NormalizePaths canonicalizes the paths and returns them sorted, the
+// duplicated paths and the descendants of other paths are removed, e.g,
+// if we want to lock a/b and a/b/c at same time, we only need to lock
+// the ancestor a/b, but b and ab/c are both kept.
+func (g *PathLockerGroup) NormalizePaths(paths ...string) ([]string, error) {
+	t := newPathTrie()
+	for _, path := range paths {
+		p := g.canonicalizePath(path)
+		if p == g.sep {
+			return nil, invalidArgumentf("invalid path %q, can not empty", path)
 		}
+
+		t.Insert(makeAncestorPaths(p, g.sep))
 	}
 
-	return p
+	p := t.Paths()
+	sort.Strings(p)
+	return p, nil
 }
 
+// NormalizePaths normalizes the paths with the default path config,
+// see PathLockerGroup NormalizePaths.
+func NormalizePaths(paths ...string) ([]string, error) {
+	return defaultPathNormalizer.NormalizePaths(paths...)
+}
+
+var defaultPathNormalizer = &PathLockerGroup{sep: defaultPathSeparator}
+
 func NewPathLockerGroup() *PathLockerGroup {
+	return NewPathLockerGroupWithConfig(PathLockerGroupConfig{})
+}
+
+func NewPathLockerGroupWithConfig(cfg PathLockerGroupConfig) *PathLockerGroup {
 	g := new(PathLockerGroup)
-	g.set = make([]*refLockSet, defaultPathSlotSize)
-	for i := 0; i < defaultPathSlotSize; i++ {
-		g.set[i] = newRefLockSet()
+
+	slotSize := cfg.SlotSize
+	if slotSize <= 0 {
+		slotSize = defaultPathSlotSize
 	}
 
+	g.set = make([]*modeLockSet, slotSize)
+	for i := 0; i < slotSize; i++ {
+		g.set[i] = newModeLockSet()
+	}
+
+	g.hash = cfg.Hash
+	if g.hash == nil {
+		g.hash = crc32Hash
+	}
+
+	g.sep = cfg.Separator
+	if len(g.sep) == 0 {
+		g.sep = defaultPathSeparator
+	}
+	g.raw = cfg.Raw
+
+	g.globs = newGlobTable(g.sep, g.hash)
+
 	return g
 }
@@ -0,0 +1,68 @@
+package tlock
+
+// pathTrie is used to remove the duplicated paths and the
+// descendants of other paths, each node is a path segment.
+type pathTrie struct {
+	root *pathTrieNode
+}
+
+type pathTrieNode struct {
+	// the canonical path if the node is inserted
+	path     string
+	children map[string]*pathTrieNode
+}
+
+func newPathTrie() *pathTrie {
+	t := new(pathTrie)
+	t.root = new(pathTrieNode)
+	return t
+}
+
+// Insert inserts a path by its ancestor paths, like ["a/", "a/b/", "a/b/c/"],
+// the path is ignored if it or its ancestor is already inserted, and all its
+// inserted descendants are removed.
+func (t *pathTrie) Insert(items []string) {
+	n := t.root
+	prev := ""
+	for _, item := range items {
+		if len(n.path) > 0 {
+			// an ancestor is inserted
+			return
+		}
+
+		seg := item[len(prev):]
+		prev = item
+
+		if n.children == nil {
+			n.children = make(map[string]*pathTrieNode)
+		}
+
+		child, ok := n.children[seg]
+		if !ok {
+			child = new(pathTrieNode)
+			n.children[seg] = child
+		}
+		n = child
+	}
+
+	n.path = prev
+	// the descendants are no need any more
+	n.children = nil
+}
+
+// Paths returns all inserted paths
+func (t *pathTrie) Paths() []string {
+	paths := make([]string, 0, 4)
+	return t.root.collect(paths)
+}
+
+func (n *pathTrieNode) collect(paths []string) []string {
+	if len(n.path) > 0 {
+		return append(paths, n.path)
+	}
+
+	for _, child := range n.children {
+		paths = child.collect(paths)
+	}
+	return paths
+}
@@ -0,0 +1,524 @@
+package tlock
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keyRange is [start, end), an empty end means no upper bound
+type keyRange struct {
+	start string
+	end   string
+}
+
+func (r keyRange) String() string {
+	return fmt.Sprintf("[%s,%s)", r.start, r.end)
+}
+
+func (r keyRange) intersects(o keyRange) bool {
+	return endAfter(o.end, r.start) && endAfter(r.end, o.start)
+}
+
+// pointRange is the range contains only the key
+func pointRange(key string) keyRange {
+	return keyRange{key, key + "\x00"}
+}
+
+// endAfter returns true if the range end is after the key, an empty end is infinite
+func endAfter(end string, key string) bool {
+	return len(end) == 0 || end > key
+}
+
+func maxEnd(a string, b string) string {
+	if len(a) == 0 || len(b) == 0 {
+		return ""
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func compareRange(a keyRange, b keyRange) int {
+	switch {
+	case a.start < b.start:
+		return -1
+	case a.start > b.start:
+		return 1
+	case a.end == b.end:
+		return 0
+	case len(a.end) == 0:
+		return 1
+	case len(b.end) == 0 || a.end < b.end:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// rangeNode is a treap node ordered by the range start, max is
+// the max end of the subtree, so we can skip the subtree whose
+// ranges all end before the query start.
+type rangeNode struct {
+	r    keyRange
+	max  string
+	prio uint32
+
+	left  *rangeNode
+	right *rangeNode
+}
+
+func (n *rangeNode) update() {
+	n.max = n.r.end
+	if n.left != nil {
+		n.max = maxEnd(n.max, n.left.max)
+	}
+	if n.right != nil {
+		n.max = maxEnd(n.max, n.right.max)
+	}
+}
+
+// split splits the treap into the ranges less than r and the others
+func splitRange(n *rangeNode, r keyRange) (*rangeNode, *rangeNode) {
+	if n == nil {
+		return nil, nil
+	}
+
+	if compareRange(n.r, r) < 0 {
+		left, right := splitRange(n.right, r)
+		n.right = left
+		n.update()
+		return n, right
+	}
+
+	left, right := splitRange(n.left, r)
+	n.left = right
+	n.update()
+	return left, n
+}
+
+func mergeRange(a *rangeNode, b *rangeNode) *rangeNode {
+	if a == nil {
+		return b
+	} else if b == nil {
+		return a
+	}
+
+	if a.prio > b.prio {
+		a.right = mergeRange(a.right, b)
+		a.update()
+		return a
+	}
+
+	b.left = mergeRange(a, b.left)
+	b.update()
+	return b
+}
+
+// rangeTree is an interval tree based on treap
+type rangeTree struct {
+	root *rangeNode
+	size int
+}
+
+func (t *rangeTree) Insert(r keyRange) {
+	n := &rangeNode{r: r, max: r.end, prio: rand.Uint32()}
+	left, right := splitRange(t.root, r)
+	t.root = mergeRange(mergeRange(left, n), right)
+	t.size++
+}
+
+// Delete deletes the range, returns false if not found
+func (t *rangeTree) Delete(r keyRange) bool {
+	var deleted bool
+	t.root = deleteRange(t.root, r, &deleted)
+	if deleted {
+		t.size--
+	}
+	return deleted
+}
+
+func deleteRange(n *rangeNode, r keyRange, deleted *bool) *rangeNode {
+	if n == nil {
+		return nil
+	}
+
+	switch c := compareRange(r, n.r); {
+	case c < 0:
+		n.left = deleteRange(n.left, r, deleted)
+	case c > 0:
+		n.right = deleteRange(n.right, r, deleted)
+	default:
+		*deleted = true
+		return mergeRange(n.left, n.right)
+	}
+
+	n.update()
+	return n
+}
+
+// Intersects returns true if any range in the tree intersects r
+func (t *rangeTree) Intersects(r keyRange) bool {
+	n := t.root
+	for n != nil {
+		if n.r.intersects(r) {
+			return true
+		}
+
+		if n.left != nil && endAfter(n.left.max, r.start) {
+			// if no range in the left intersects r, the range with the max
+			// end starts after r, so do all the ranges in the right.
+			n = n.left
+		} else if endAfter(r.end, n.r.start) {
+			n = n.right
+		} else {
+			return false
+		}
+	}
+	return false
+}
+
+// the states of a key held in a KeyLockerGroup with Ranges
+const (
+	// not held
+	keyUnranged int32 = iota
+	// held without the tree, no range was locked or waiting
+	keyFast
+	// waiting the ranges to be registered in the tree
+	keyPending
+	// registered in the tree
+	keyRanged
+)
+
+// RangeLockerGroup locks the key ranges, a range conflicts with
+// the ranges intersecting it, use KeyLockerGroupConfig Ranges to
+// make the keys conflict with the ranges containing them too.
+//
+// The keys are only registered in the tree when a range is locked or
+// waiting, so the key locks don't share the mutex of the tree if no
+// range is used. A range locker registers the keys held before it.
+type RangeLockerGroup struct {
+	m sync.Mutex
+
+	tree rangeTree
+
+	// closed and recreated when a range is released
+	changed chan struct{}
+
+	// the key groups using the ranges, protected by m
+	keyGroups []*KeyLockerGroup
+
+	// the ranges locked or waiting, and the keys held without the tree
+	active int32
+	fast   int32
+}
+
+func NewRangeLockerGroup() *RangeLockerGroup {
+	g := new(RangeLockerGroup)
+	g.changed = make(chan struct{})
+	return g
+}
+
+// parseRanges parses the args as [start1, end1, start2, end2, ...], the
+// intersecting ranges are merged, so the returned ranges never intersect.
+func parseRanges(args ...string) ([]keyRange, error) {
+	if len(args) == 0 {
+		return nil, invalidArgumentf("empty ranges")
+	}
+	if len(args)%2 != 0 {
+		return nil, invalidArgumentf("range %q has no end", args[len(args)-1])
+	}
+
+	ranges := make([]keyRange, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		r := keyRange{args[i], args[i+1]}
+		if !endAfter(r.end, r.start) {
+			return nil, invalidArgumentf("invalid range %s, end must be greater than start", r)
+		}
+		ranges = append(ranges, r)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return compareRange(ranges[i], ranges[j]) < 0
+	})
+
+	p := ranges[0:1]
+	for _, r := range ranges[1:] {
+		last := &p[len(p)-1]
+		if last.intersects(r) {
+			last.end = maxEnd(last.end, r.end)
+		} else {
+			p = append(p, r)
+		}
+	}
+	return p, nil
+}
+
+func (g *RangeLockerGroup) Lock(args ...string) error {
+	// use a very long timeout
+	return g.LockTimeout(InfiniteTimeout, args...)
+}
+
+// LockTimeout locks the ranges, args are [start1, end1, start2, end2, ...]
+// for the ranges [start, end), an empty end means no upper bound.
+// returns ErrLockTimeout if not all are locked before timeout.
+func (g *RangeLockerGroup) LockTimeout(timeout time.Duration, args ...string) error {
+	ranges, err := parseRanges(args...)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	atomic.AddInt32(&g.active, int32(len(ranges)))
+
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	g.registerFastKeys()
+	if !g.waitRanges(ranges, timer) {
+		atomic.AddInt32(&g.active, -int32(len(ranges)))
+		return ErrLockTimeout
+	}
+
+	for _, r := range ranges {
+		g.tree.Insert(r)
+	}
+	return nil
+}
+
+// tryLock locks the ranges without waiting, the free ranges are checked
+// before the timer fires, so it returns ErrLockTimeout only if any is locked.
+func (g *RangeLockerGroup) tryLock(args ...string) error {
+	return g.LockTimeout(0, args...)
+}
+
+// Unlock unlocks the ranges, the args must be the same as Lock,
+// returns ErrNotLocked if any range is not locked.
+func (g *RangeLockerGroup) Unlock(args ...string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	ranges, err := parseRanges(args...)
+	if err != nil {
+		return err
+	}
+
+	return g.unlockRanges(ranges)
+}
+
+// WaitFreeTimeout waits until none of the ranges intersects a locked range
+// or key, without locking them, args are like LockTimeout, returns
+// ErrLockTimeout if the ranges are not free before timeout.
+func (g *RangeLockerGroup) WaitFreeTimeout(timeout time.Duration, args ...string) error {
+	ranges, err := parseRanges(args...)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// like a waiting range, so the keys are registered
+	atomic.AddInt32(&g.active, int32(len(ranges)))
+	defer atomic.AddInt32(&g.active, -int32(len(ranges)))
+
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	g.registerFastKeys()
+	if !g.waitRanges(ranges, timer) {
+		return ErrLockTimeout
+	}
+	return nil
+}
+
+// checkKeysFree returns true if no range contains the keys, or the
+// channel to wait the ranges released.
+func (g *RangeLockerGroup) checkKeysFree(keys []string) (<-chan struct{}, bool) {
+	if atomic.LoadInt32(&g.active) == 0 {
+		return nil, true
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	for _, key := range keys {
+		if g.tree.Intersects(pointRange(key)) {
+			return g.changed, false
+		}
+	}
+	return nil, true
+}
+
+// addKeyGroup adds the key group whose keys conflict with the ranges
+func (g *RangeLockerGroup) addKeyGroup(k *KeyLockerGroup) {
+	g.m.Lock()
+	g.keyGroups = append(g.keyGroups, k)
+	g.m.Unlock()
+}
+
+// lockKeys registers the held keys in the tree and waits the ranges
+// containing them, if no range is locked or waiting, the keys are held
+// without the tree, the range locker registers them later.
+func (g *RangeLockerGroup) lockKeys(keys []string, locks []*refLock, timer *time.Timer) bool {
+	for _, m := range locks {
+		atomic.StoreInt32(&m.ranged, keyFast)
+	}
+	atomic.AddInt32(&g.fast, int32(len(locks)))
+
+	// a range locker increases active before it registers the fast keys,
+	// so either it sees our keys, or we see it here.
+	if atomic.LoadInt32(&g.active) == 0 {
+		return true
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	ranges := make([]keyRange, 0, len(keys))
+	pending := make([]*refLock, 0, len(keys))
+	for i, m := range locks {
+		// the keys may be registered by a range locker already
+		if atomic.CompareAndSwapInt32(&m.ranged, keyFast, keyPending) {
+			atomic.AddInt32(&g.fast, -1)
+			ranges = append(ranges, pointRange(keys[i]))
+			pending = append(pending, m)
+		}
+	}
+
+	if !g.waitRanges(ranges, timer) {
+		g.unregisterKeys(keys, locks)
+		return false
+	}
+
+	for i, r := range ranges {
+		g.tree.Insert(r)
+		atomic.StoreInt32(&pending[i].ranged, keyRanged)
+	}
+	return true
+}
+
+// unlockKeys removes the held keys from the tree, the nil locks are skipped
+func (g *RangeLockerGroup) unlockKeys(keys []string, locks []*refLock) {
+	ranged := false
+	for _, m := range locks {
+		if m == nil {
+			continue
+		}
+
+		if atomic.CompareAndSwapInt32(&m.ranged, keyFast, keyUnranged) {
+			atomic.AddInt32(&g.fast, -1)
+		} else if atomic.LoadInt32(&m.ranged) == keyRanged {
+			ranged = true
+		}
+	}
+
+	if !ranged {
+		return
+	}
+
+	g.m.Lock()
+	g.unregisterKeys(keys, locks)
+	g.m.Unlock()
+}
+
+// unregisterKeys removes the registered keys from the tree, g.m is held
+func (g *RangeLockerGroup) unregisterKeys(keys []string, locks []*refLock) {
+	for i, m := range locks {
+		if m == nil {
+			continue
+		}
+
+		if atomic.LoadInt32(&m.ranged) == keyRanged {
+			g.tree.Delete(pointRange(keys[i]))
+		}
+		atomic.StoreInt32(&m.ranged, keyUnranged)
+	}
+
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// registerFastKeys registers the keys held without the tree, g.m is held,
+// it is called by a range locker after increasing active, so no key is held
+// without the tree after it.
+func (g *RangeLockerGroup) registerFastKeys() {
+	if atomic.LoadInt32(&g.fast) == 0 {
+		return
+	}
+
+	for _, k := range g.keyGroups {
+		for _, s := range k.set {
+			s.Lock()
+			for key, m := range s.set {
+				if atomic.LoadInt32(&m.ranged) != keyFast {
+					continue
+				}
+
+				// a key conflicting with the tree is not held before the ranges,
+				// it has seen them and will wait them in lockKeys.
+				r := pointRange(key)
+				if g.tree.Intersects(r) {
+					continue
+				}
+
+				if atomic.CompareAndSwapInt32(&m.ranged, keyFast, keyRanged) {
+					atomic.AddInt32(&g.fast, -1)
+					g.tree.Insert(r)
+				}
+			}
+			s.Unlock()
+		}
+	}
+}
+
+// waitRanges waits until none of the ranges intersects the tree, g.m is held
+func (g *RangeLockerGroup) waitRanges(ranges []keyRange, timer *time.Timer) bool {
+	for g.intersects(ranges) {
+		ch := g.changed
+		g.m.Unlock()
+
+		select {
+		case <-ch:
+			g.m.Lock()
+		case <-timer.C:
+			g.m.Lock()
+			return false
+		}
+	}
+	return true
+}
+
+func (g *RangeLockerGroup) intersects(ranges []keyRange) bool {
+	for _, r := range ranges {
+		if g.tree.Intersects(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *RangeLockerGroup) unlockRanges(ranges []keyRange) error {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	var err error
+	for _, r := range ranges {
+		if !g.tree.Delete(r) {
+			err = notLockedf(r.String())
+		} else {
+			atomic.AddInt32(&g.active, -1)
+		}
+	}
+
+	close(g.changed)
+	g.changed = make(chan struct{})
+	return err
+}
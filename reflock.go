@@ -2,11 +2,79 @@ package tlock
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type refLock struct {
 	sync.RWMutex
 	ref int
+
+	// held write and read lock count, unlocking a not locked
+	// sync.RWMutex is a fatal error, so we must check it before
+	writers int32
+	readers int32
+
+	// the state in the ranges when held, see KeyLockerGroupConfig Ranges
+	ranged int32
+}
+
+func (l *refLock) lockWithTimer(timer *time.Timer) bool {
+	if !LockWithTimer(l, timer) {
+		return false
+	}
+	atomic.AddInt32(&l.writers, 1)
+	return true
+}
+
+func (l *refLock) rlockWithTimer(timer *time.Timer) bool {
+	if !LockWithTimer(l.RLocker(), timer) {
+		return false
+	}
+	atomic.AddInt32(&l.readers, 1)
+	return true
+}
+
+// tryLock write locks without waiting, returns false if locked
+func (l *refLock) tryLock() bool {
+	if !l.TryLock() {
+		return false
+	}
+	atomic.AddInt32(&l.writers, 1)
+	return true
+}
+
+// tryRLock read locks without waiting, returns false if write locked
+func (l *refLock) tryRLock() bool {
+	if !l.TryRLock() {
+		return false
+	}
+	atomic.AddInt32(&l.readers, 1)
+	return true
+}
+
+// tryUnlock unlocks the write lock, returns false if not locked
+func (l *refLock) tryUnlock() bool {
+	if !atomic.CompareAndSwapInt32(&l.writers, 1, 0) {
+		return false
+	}
+	l.Unlock()
+	return true
+}
+
+// tryRUnlock unlocks a read lock, returns false if not locked
+func (l *refLock) tryRUnlock() bool {
+	for {
+		n := atomic.LoadInt32(&l.readers)
+		if n <= 0 {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt32(&l.readers, n, n-1) {
+			l.RUnlock()
+			return true
+		}
+	}
 }
 
 type refLockSet struct {
@@ -0,0 +1,180 @@
+package tlock
+
+import (
+	"sync"
+)
+
+// the lock id has the counter in the low bits, so the locks
+// are spread across the shards evenly.
+const lockRegistryShardSize = 64
+
+// lockRegistry holds the granted locks, it is sharded by the lock id,
+// so granting and releasing the locks don't block each other.
+// The index is updated with the registry in the shard lock, so a lock
+// replaced and removed at the same time is never left in the index.
+type lockRegistry struct {
+	shards [lockRegistryShardSize]lockRegistryShard
+
+	index *lockIndex
+}
+
+type lockRegistryShard struct {
+	sync.RWMutex
+	locks map[uint64]*lockInfo
+}
+
+func newLockRegistry(index *lockIndex) *lockRegistry {
+	r := new(lockRegistry)
+	r.index = index
+	for i := range r.shards {
+		r.shards[i].locks = make(map[uint64]*lockInfo, 64)
+	}
+	return r
+}
+
+func (r *lockRegistry) getShard(id uint64) *lockRegistryShard {
+	return &r.shards[id%lockRegistryShardSize]
+}
+
+func (r *lockRegistry) Add(l *lockInfo) {
+	s := r.getShard(l.id)
+	s.Lock()
+	s.locks[l.id] = l
+	r.index.Add(l)
+	s.Unlock()
+}
+
+// Remove removes the lock and returns it, only one caller can remove a lock
+func (r *lockRegistry) Remove(id uint64) (*lockInfo, bool) {
+	s := r.getShard(id)
+	s.Lock()
+	l, ok := s.locks[id]
+	if ok {
+		delete(s.locks, id)
+		r.index.Remove(l)
+	}
+	s.Unlock()
+	return l, ok
+}
+
+func (r *lockRegistry) Get(id uint64) (*lockInfo, bool) {
+	s := r.getShard(id)
+	s.RLock()
+	l, ok := s.locks[id]
+	s.RUnlock()
+	return l, ok
+}
+
+// Replace replaces the lock with a new one of the same id, returns false if
+// the lock is not old, like it has been removed or replaced by others.
+func (r *lockRegistry) Replace(old *lockInfo, l *lockInfo) bool {
+	s := r.getShard(l.id)
+	s.Lock()
+	defer s.Unlock()
+
+	if s.locks[l.id] != old {
+		return false
+	}
+	s.locks[l.id] = l
+
+	// never see the names not locked in the index
+	r.index.Add(l)
+	r.index.Remove(old)
+	return true
+}
+
+// Commit adds, replaces and removes the locks together, the shards of the
+// locks are held in order when changing them, so others see all or none of
+// the changes. It returns false and changes nothing if a lock to replace or
+// remove is not the one in the registry.
+func (r *lockRegistry) Commit(adds []*lockInfo, replaces [][2]*lockInfo, removes []*lockInfo) bool {
+	var held [lockRegistryShardSize]bool
+	for _, l := range adds {
+		held[l.id%lockRegistryShardSize] = true
+	}
+	for _, p := range replaces {
+		held[p[0].id%lockRegistryShardSize] = true
+	}
+	for _, l := range removes {
+		held[l.id%lockRegistryShardSize] = true
+	}
+
+	for i := range r.shards {
+		if held[i] {
+			r.shards[i].Lock()
+		}
+	}
+	defer func() {
+		for i := range r.shards {
+			if held[i] {
+				r.shards[i].Unlock()
+			}
+		}
+	}()
+
+	for _, p := range replaces {
+		if r.getShard(p[0].id).locks[p[0].id] != p[0] {
+			return false
+		}
+	}
+	for _, l := range removes {
+		if r.getShard(l.id).locks[l.id] != l {
+			return false
+		}
+	}
+
+	// add before remove, a name handed over is always in the index
+	for _, l := range adds {
+		r.getShard(l.id).locks[l.id] = l
+		r.index.Add(l)
+	}
+	for _, p := range replaces {
+		r.getShard(p[1].id).locks[p[1].id] = p[1]
+		r.index.Add(p[1])
+		r.index.Remove(p[0])
+	}
+	for _, l := range removes {
+		delete(r.getShard(l.id).locks, l.id)
+		r.index.Remove(l)
+	}
+	return true
+}
+
+// Len returns the number of the locks
+func (r *lockRegistry) Len() int {
+	n := 0
+	for i := range r.shards {
+		r.shards[i].RLock()
+		n += len(r.shards[i].locks)
+		r.shards[i].RUnlock()
+	}
+	return n
+}
+
+// Snapshot returns all the locks at a moment, it holds the read locks of
+// all the shards together when copying, so no lock is granted or released
+// in the middle, but only the pointers are copied, the caller can sort and
+// format them later without blocking others.
+func (r *lockRegistry) Snapshot() []*lockInfo {
+	for i := range r.shards {
+		r.shards[i].RLock()
+	}
+
+	n := 0
+	for i := range r.shards {
+		n += len(r.shards[i].locks)
+	}
+
+	locks := make([]*lockInfo, 0, n)
+	for i := range r.shards {
+		for _, l := range r.shards[i].locks {
+			locks = append(locks, l)
+		}
+	}
+
+	for i := range r.shards {
+		r.shards[i].RUnlock()
+	}
+
+	return locks
+}
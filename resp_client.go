@@ -2,51 +2,258 @@ package tlock
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/siddontang/goredis"
 )
 
+// the default interval checking the connection of a held lock
+const defaultRESPCheckInterval = time.Second
+
 type RESPClient struct {
-	c *goredis.Client
+	c     *goredis.Client
+	owner string
+
+	checkInterval time.Duration
+	onLost        func(l ClientLocker, err error)
+	detach        time.Duration
+
+	// the session of GetLocker, see RESPClientConfig SessionTTL
+	sessionTTL int
+	sessionM   sync.Mutex
+	session    *Session
+}
+
+type RESPClientConfig struct {
+	// the server password, see AuthConfig
+	Password string
+
+	// the owner of the locks in the audit log, see LockOptions
+	Owner string
+
+	// the interval checking the connection of a held lock, zero uses 1s
+	CheckInterval time.Duration
+
+	// called in background when a held lock is lost, see LostLocker
+	OnLost func(l ClientLocker, err error)
+
+	// if not zero, lock with DETACH in seconds, the lock survives its
+	// connection, the client renews it, and reattaches to it with a new
+	// connection if the connection is broken. It is not used by sessions.
+	Detach time.Duration
+
+	// the max idle connections in the pool, zero uses the goredis default.
+	// The lockers of a session don't hold a connection, so many locks can
+	// be held over a few connections. Without SessionTTL, a locker of
+	// GetLocker holds a connection out of the pool until it is unlocked.
+	MaxIdleConns int
+
+	// if not zero, the lockers of GetLocker lock in a session of the client
+	// with the ttl in seconds, granted at the first GetLocker, so they hold
+	// no connection like the lockers of NewSession, and are lost together if
+	// the session is lost, the later lockers use a new session then. The
+	// locks are released a ttl after the client dies, not at once when its
+	// connection is closed. Detach is not used then.
+	SessionTTL time.Duration
+}
+
+// LostLocker is implemented by the lockers of RESPClient, the channel
+// returned by Lost is closed when the held lock is lost, like its connection
+// is broken and the server releases it, Unlock returns ErrNotLocked then.
+// For the lockers of a session, it is the Done of the session.
+type LostLocker interface {
+	ClientLocker
+	Lost() <-chan struct{}
 }
 
 func NewRESPClient(addr string) *RESPClient {
+	return NewRESPClientWithConfig(addr, RESPClientConfig{})
+}
+
+func NewRESPClientWithConfig(addr string, cfg RESPClientConfig) *RESPClient {
 	c := new(RESPClient)
-	c.c = goredis.NewClient(addr, "")
+	c.c = goredis.NewClient(addr, cfg.Password)
+	c.owner = cfg.Owner
+
+	c.checkInterval = cfg.CheckInterval
+	if c.checkInterval <= 0 {
+		c.checkInterval = defaultRESPCheckInterval
+	}
+	c.onLost = cfg.OnLost
+	if cfg.Detach > 0 {
+		// DETACH is in seconds
+		c.detach = (cfg.Detach + time.Second - 1) / time.Second * time.Second
+	}
+	if cfg.MaxIdleConns > 0 {
+		c.c.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.SessionTTL > 0 {
+		// GRANT is in seconds
+		c.sessionTTL = int((cfg.SessionTTL + time.Second - 1) / time.Second)
+	}
 
 	return c
 }
 
+// GetLocker returns a locker bound to its connection, a held lock holds a
+// connection, or a locker of the client session if SessionTTL is set.
 func (c *RESPClient) GetLocker(tp string, names ...string) (ClientLocker, error) {
-	return c.newRESPLocker(tp, names...)
+	if c.sessionTTL == 0 {
+		return c.newRESPLocker(tp, names...)
+	}
+
+	s, err := c.clientSession()
+	if err != nil {
+		return nil, err
+	}
+	return c.newLeaseLocker(s, tp, names...)
 }
 
+// clientSession returns the session of GetLocker, a new one if it is lost
+func (c *RESPClient) clientSession() (*Session, error) {
+	c.sessionM.Lock()
+	defer c.sessionM.Unlock()
+
+	if c.session != nil {
+		select {
+		case <-c.session.Done():
+		default:
+			return c.session, nil
+		}
+	}
+
+	s, err := c.NewSession(c.sessionTTL)
+	if err != nil {
+		return nil, err
+	}
+	c.session = s
+	return s, nil
+}
+
+// Close closes the client, and the session of GetLocker if any, whose
+// locks are released.
 func (c *RESPClient) Close() {
+	c.sessionM.Lock()
+	if c.session != nil {
+		c.session.Close()
+		c.session = nil
+	}
+	c.sessionM.Unlock()
+
 	c.c.Close()
 }
 
+// NewSession grants a lease with ttl seconds and keeps it alive in background
+func (c *RESPClient) NewSession(ttl int) (*Session, error) {
+	return newSession(c, ttl)
+}
+
+func (c *RESPClient) grantLease(ttl int) (uint64, error) {
+	id, err := goredis.Bytes(c.c.Do("GRANT", ttl))
+	if err != nil {
+		return 0, parseRESPError(err)
+	}
+
+	return strconv.ParseUint(string(id), 10, 64)
+}
+
+func (c *RESPClient) renewLease(id uint64, timeout time.Duration) error {
+	conn, err := c.c.Get()
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err = conn.Do("RENEW", id)
+	if _, ok := err.(goredis.Error); err != nil && !ok {
+		// broken or timed out, the reply may still come
+		conn.Finalize()
+		return err
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	conn.Close()
+	return parseRESPError(err)
+}
+
+func (c *RESPClient) revokeLease(id uint64) error {
+	_, err := c.c.Do("REVOKE", id)
+	return parseRESPError(err)
+}
+
+// parseRESPError maps the RESP error reply to the error defined in tlock,
+// other errors like network errors are returned directly.
+func parseRESPError(err error) error {
+	if e, ok := err.(goredis.Error); ok {
+		return parseError(string(e))
+	}
+	return err
+}
+
 type respLocker struct {
-	c     *goredis.Client
-	conn  *goredis.PoolConn
+	c     *RESPClient
 	names []string
 	tp    string
-	id    []byte
+	owner string
+
+	// the lock is tied to the session, not a connection
+	session *Session
+
+	// detach ttl, zero means the lock is bound to its connection
+	detach time.Duration
+
+	m sync.Mutex
+	h *respHold
+}
+
+// respHold is a held lock
+type respHold struct {
+	id []byte
+
+	// nil when reconnecting a detached lock, or a session lock
+	// which does not hold a connection
+	conn *goredis.PoolConn
+
+	lastRenew time.Time
+
+	// closed when lost, with the error
+	lost chan struct{}
+	err  error
+
+	// closed when unlocked
+	quit chan struct{}
+}
+
+func (c *RESPClient) newLeaseLocker(s *Session, tp string, names ...string) (ClientLocker, error) {
+	l, err := c.newRESPLocker(tp, names...)
+	if err != nil {
+		return nil, err
+	}
+
+	l.(*respLocker).session = s
+	// the lease keeps the lock, not detached
+	l.(*respLocker).detach = 0
+	return l, nil
 }
 
 func (c *RESPClient) newRESPLocker(tp string, names ...string) (ClientLocker, error) {
 	tp = strings.ToLower(tp)
-	if tp != KeyLockType && tp != PathLockType {
-		return nil, fmt.Errorf("invalid lock type %s, must key or path", tp)
+	if !isValidLockType(tp) {
+		return nil, invalidTypef(tp)
 	}
 	if len(names) == 0 {
-		return nil, fmt.Errorf("empty lock names")
+		return nil, invalidArgumentf("empty lock names")
 	}
 
 	l := new(respLocker)
-	l.c = c.c
+	l.c = c
 	l.names = names
 	l.tp = tp
+	l.owner = c.owner
+	l.detach = c.detach
 
 	return l, nil
 }
@@ -56,43 +263,240 @@ func (l *respLocker) Lock() error {
 }
 
 func (l *respLocker) LockTimeout(timeout int) error {
-	if l.id != nil {
-		return fmt.Errorf("lockid %s exists, must unlock first", l.id)
+	return l.LockTimeoutDuration(time.Duration(timeout) * time.Second)
+}
+
+func (l *respLocker) LockTimeoutDuration(timeout time.Duration) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.h != nil && l.h.err == nil {
+		return fmt.Errorf("lockid %s exists, must unlock first", l.h.id)
 	}
 
-	conn, err := l.c.Get()
+	conn, err := l.c.c.Get()
 	if err != nil {
 		return err
 	}
 
-	v := make([]interface{}, 0, len(l.names)+4)
-	for _, name := range l.names {
-		v = append(v, name)
+	id, err := goredis.Bytes(conn.Do("LOCK", l.lockArgs(timeout)...))
+	if err != nil {
+		conn.Close()
+		return parseRESPError(err)
 	}
 
-	v = append(v, "TYPE", l.tp)
-	v = append(v, "TIMEOUT", timeout)
+	h := &respHold{
+		id:        id,
+		conn:      conn,
+		lastRenew: time.Now(),
+		lost:      make(chan struct{}),
+		quit:      make(chan struct{}),
+	}
+	l.h = h
 
-	id, err := goredis.Bytes(conn.Do("LOCK", v...))
-	if err != nil {
+	if l.session != nil {
+		// the session keeps the lock, the connection can be reused by others
 		conn.Close()
-		return err
+		h.conn = nil
+		return nil
 	}
-	l.id = id
-	l.conn = conn
+
+	go l.check(h)
 	return nil
 }
 
+// legacyLock returns true if the lock can be sent in the legacy grammar
+//
+//	name1 name2 ... TYPE key TIMEOUT 60
+//
+// a server before NAMES takes the options of the new grammar as names, so
+// the new grammar is only sent if a new option is used, or a name is an
+// option, which the legacy grammar can not lock.
+func (l *respLocker) legacyLock(timeout time.Duration) bool {
+	if timeout%time.Second != 0 || l.session != nil || l.detach > 0 || len(l.owner) > 0 {
+		return false
+	}
+
+	for _, name := range l.names {
+		if s := strings.ToUpper(name); s == "NAMES" || isRESPLockOption(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// lockArgs returns the LOCK arguments, in the legacy grammar if possible
+func (l *respLocker) lockArgs(timeout time.Duration) []interface{} {
+	v := make([]interface{}, 0, len(l.names)+11)
+
+	if l.legacyLock(timeout) {
+		for _, name := range l.names {
+			v = append(v, name)
+		}
+		return append(v, "TYPE", l.tp, "TIMEOUT", int64(timeout/time.Second))
+	}
+
+	v = append(v, "TYPE", l.tp)
+	if timeout%time.Second == 0 {
+		v = append(v, "TIMEOUT", int64(timeout/time.Second))
+	} else {
+		v = append(v, "PXTIMEOUT", durationToMs(timeout))
+	}
+	if l.session != nil {
+		v = append(v, "SESSION", l.session.id)
+	}
+	if l.detach > 0 {
+		v = append(v, "DETACH", int64(l.detach/time.Second))
+	}
+	if len(l.owner) > 0 {
+		v = append(v, "OWNER", l.owner)
+	}
+
+	v = append(v, "NAMES")
+	for _, name := range l.names {
+		v = append(v, name)
+	}
+
+	return v
+}
+
+// Lost returns the channel closed when the held lock is lost,
+// nil if no lock is held.
+func (l *respLocker) Lost() <-chan struct{} {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.h == nil {
+		return nil
+	}
+	if l.session != nil {
+		return l.session.Done()
+	}
+	return l.h.lost
+}
+
 func (l *respLocker) Unlock() error {
-	if l.id == nil {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	h := l.h
+	if h == nil {
 		return fmt.Errorf("no lock id")
 	}
+	l.h = nil
 
-	_, err := l.conn.Do("UNLOCK", l.id)
-	l.conn.Close()
-	if err != nil {
-		l.id = nil
+	if h.err != nil {
+		return fmt.Errorf("%w: %v", ErrNotLocked, h.err)
 	}
 
-	return err
+	close(h.quit)
+
+	var err error
+	if h.conn != nil {
+		_, err = h.conn.Do("UNLOCK", h.id)
+		if _, ok := err.(goredis.Error); err != nil && !ok && l.detach > 0 {
+			// the detached lock survives the broken connection
+			h.conn.Finalize()
+			h.conn = nil
+		} else {
+			// the connection is released, if it is broken, it will not be put back
+			// to the pool and the server releases the lock when it is closed.
+			h.conn.Close()
+			return parseRESPError(err)
+		}
+	}
+
+	// a session lock, or a detached lock reconnecting
+	_, err = l.c.c.Do("UNLOCK", h.id)
+	return parseRESPError(err)
+}
+
+// check checks the connection of the held lock until it is unlocked or
+// lost, a detached lock is renewed and reattached with a new connection.
+func (l *respLocker) check(h *respHold) {
+	interval := l.c.checkInterval
+	if l.detach > 0 && l.detach/3 < interval {
+		// renew three times in a ttl, like Session
+		interval = l.detach / 3
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.quit:
+			return
+		case <-ticker.C:
+		}
+
+		l.m.Lock()
+		if l.h != h {
+			// unlocked
+			l.m.Unlock()
+			return
+		}
+
+		var err error
+		if l.detach > 0 {
+			err = l.renew(h)
+		} else if _, err = h.conn.Do("PING"); err != nil {
+			if _, ok := err.(goredis.Error); ok {
+				// the server replies, so the connection is alive
+				err = nil
+			}
+		}
+
+		if err != nil {
+			h.err = err
+			close(h.lost)
+			if h.conn != nil {
+				h.conn.Finalize()
+				h.conn = nil
+			}
+		}
+		l.m.Unlock()
+
+		if err != nil {
+			if l.c.onLost != nil {
+				l.c.onLost(l, err)
+			}
+			return
+		}
+	}
+}
+
+// renew renews the detached lock, and reconnects if the connection is broken,
+// it returns an error only if the lock is lost.
+func (l *respLocker) renew(h *respHold) error {
+	if h.conn == nil {
+		conn, err := l.c.c.Get()
+		if err != nil {
+			return l.renewFailed(h, err)
+		}
+		h.conn = conn
+	}
+
+	_, err := h.conn.Do("RENEW", h.id)
+	if err == nil {
+		h.lastRenew = time.Now()
+		return nil
+	}
+
+	if _, ok := err.(goredis.Error); !ok {
+		// the connection is broken, reattach with a new one later
+		h.conn.Finalize()
+		h.conn = nil
+		return l.renewFailed(h, err)
+	}
+
+	return parseRESPError(err)
+}
+
+func (l *respLocker) renewFailed(h *respHold, err error) error {
+	if time.Since(h.lastRenew) >= l.detach {
+		// the server has released the lock
+		return err
+	}
+	return nil
 }
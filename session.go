@@ -0,0 +1,136 @@
+package tlock
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// leaseClient is implemented by RESPClient and HTTPClient
+type leaseClient interface {
+	grantLease(ttl int) (uint64, error)
+	// returns an error if not renewed before the timeout
+	renewLease(id uint64, timeout time.Duration) error
+	revokeLease(id uint64) error
+	newLeaseLocker(s *Session, tp string, names ...string) (ClientLocker, error)
+}
+
+// Session owns a lease and renews it in background, all lockers
+// created by the session are bound to the lease, if the lease is lost,
+// the server releases all their locks together.
+type Session struct {
+	c   leaseClient
+	id  uint64
+	ttl time.Duration
+
+	done chan struct{}
+	quit chan struct{}
+
+	closeOnce sync.Once
+}
+
+func newSession(c leaseClient, ttl int) (*Session, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid session ttl %d", ttl)
+	}
+
+	// the server grants the lease after we send the request
+	start := time.Now()
+	id, err := c.grantLease(ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(Session)
+	s.c = c
+	s.id = id
+	s.ttl = time.Duration(ttl) * time.Second
+	s.done = make(chan struct{})
+	s.quit = make(chan struct{})
+
+	go s.keepAlive(start)
+
+	return s, nil
+}
+
+// ID returns the lease id of the session
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+// Done returns a channel which is closed when the lease is lost or the session is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) GetLocker(tp string, names ...string) (ClientLocker, error) {
+	return s.c.newLeaseLocker(s, tp, names...)
+}
+
+// Close stops renewing and revokes the lease, all locks of the session are released
+func (s *Session) Close() error {
+	err := ErrLeaseNotFound
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		<-s.done
+
+		err = s.c.revokeLease(s.id)
+	})
+	return err
+}
+
+// keepAlive renews the lease until the session is closed, and closes done
+// when the server releases the lease, a ttl after the last renew is sent,
+// even if a renew hangs.
+func (s *Session) keepAlive(lastRenew time.Time) {
+	defer close(s.done)
+
+	// renew three times in a ttl, so a failed renew can be retried, and
+	// a renew times out before the next one
+	ticker := time.NewTicker(s.ttl / 3)
+	defer ticker.Stop()
+
+	expire := time.NewTimer(s.ttl - time.Since(lastRenew))
+	defer expire.Stop()
+
+	// the result of the renew in flight, buffered so a renew finishing
+	// after we return never blocks
+	renewed := make(chan error, 1)
+	renewing := false
+	var sent time.Time
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-expire.C:
+			// the server has released the lease
+			return
+		case <-ticker.C:
+			if renewing {
+				continue
+			}
+
+			renewing = true
+			sent = time.Now()
+			go func() {
+				renewed <- s.c.renewLease(s.id, s.ttl/4)
+			}()
+		case err := <-renewed:
+			renewing = false
+			if errors.Is(err, ErrLeaseNotFound) {
+				return
+			}
+			if err != nil {
+				// retry at the next tick before the lease expires
+				continue
+			}
+
+			if !expire.Stop() {
+				<-expire.C
+			}
+			expire.Reset(s.ttl - time.Since(sent))
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package tlock
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// no lock holds or blocks the name
+	StatusFree = "free"
+	// the name is locked
+	StatusHeld = "held"
+	// the name is not locked, but a lock on its ancestor or descendant,
+	// a glob or range lock conflicts with it
+	StatusBlocked = "blocked"
+)
+
+// NameStatus is the status of a name, see App Status
+type NameStatus struct {
+	Name  string       `json:"name"`
+	State string       `json:"state"`
+	Locks []LockStatus `json:"locks,omitempty"`
+}
+
+// LockStatus is a lock holding or blocking a name
+type LockStatus struct {
+	ID    uint64   `json:"id,string"`
+	Type  string   `json:"type"`
+	Names []string `json:"names"`
+	Owner string   `json:"owner,omitempty"`
+
+	// how the lock relates to the name, self, ancestor, descendant,
+	// glob or range
+	Relation string `json:"relation"`
+
+	// path lock only
+	Mode string `json:"mode,omitempty"`
+
+	// the milliseconds since the lock is granted, and before its
+	// lease expires, zero if the lock has no lease
+	AgeMs float64 `json:"age_ms"`
+	TTLMs float64 `json:"ttl_ms,omitempty"`
+}
+
+// Status returns the status of the names without locking them, tp is key
+// or path, for path, opts Separator and Raw choose the path group like
+// LockWithOptions. A key is blocked by the range locks containing it, and a
+// path by the path locks on its ancestors and descendants and the glob locks
+// conflicting with it.
+func (a *App) Status(tp string, names []string, opts LockOptions) ([]NameStatus, error) {
+	if len(names) == 0 {
+		return nil, invalidArgumentf("empty names")
+	}
+
+	tp = strings.ToLower(tp)
+
+	var g *PathLockerGroup
+	switch tp {
+	case KeyLockType:
+	case PathLockType:
+		g = a.getPathLockerGroup(opts.Separator, opts.Raw)
+		if _, err := g.NormalizePaths(names...); err != nil {
+			return nil, err
+		}
+	case GlobLockType, RangeLockType:
+		return nil, invalidArgumentf("can not get status of %s, must be key or path", tp)
+	default:
+		return nil, invalidTypef(tp)
+	}
+
+	statuses := make([]NameStatus, len(names))
+	for i, name := range names {
+		if tp == KeyLockType {
+			statuses[i] = a.keyStatus(name)
+		} else {
+			statuses[i] = a.pathStatus(g, name)
+		}
+	}
+	return statuses, nil
+}
+
+func (a *App) keyStatus(name string) NameStatus {
+	st := NameStatus{Name: name, State: StatusFree}
+
+	held, _ := a.index.get(lockIndexKey{tp: KeyLockType, name: name})
+	st.addLocks(a, held, "self")
+
+	var blocked []*lockInfo
+	for _, l := range a.index.snapshot(RangeLockType) {
+		for i := 0; i+1 < len(l.names); i += 2 {
+			if (keyRange{l.names[i], l.names[i+1]}).intersects(pointRange(name)) {
+				blocked = append(blocked, l)
+				break
+			}
+		}
+	}
+	st.addLocks(a, blocked, "range")
+
+	return st
+}
+
+func (a *App) pathStatus(g *PathLockerGroup, name string) NameStatus {
+	st := NameStatus{Name: name, State: StatusFree}
+
+	path := g.canonicalizePath(name)
+	group := pathGroupKey{g.sep, g.raw}
+
+	held, below := a.index.get(lockIndexKey{PathLockType, group, path})
+	st.addLocks(a, held, "self")
+
+	items := makeAncestorPaths(path, g.sep)
+	for _, item := range items[0 : len(items)-1] {
+		above, _ := a.index.get(lockIndexKey{PathLockType, group, item})
+		st.addLocks(a, above, "ancestor")
+	}
+
+	st.addLocks(a, below, "descendant")
+
+	segs := pathSegments(path, g.sep)
+	var globs []*lockInfo
+	for _, l := range a.index.snapshot(GlobLockType) {
+		if l.group.(*globLockerGroup).g != g {
+			continue
+		}
+
+		patterns, err := g.normalizeGlobs(l.names...)
+		if err != nil {
+			continue
+		}
+		for _, glob := range patterns {
+			if globConflictsPath(glob, segs) {
+				globs = append(globs, l)
+				break
+			}
+		}
+	}
+	st.addLocks(a, globs, "glob")
+
+	return st
+}
+
+func (st *NameStatus) addLocks(a *App, locks []*lockInfo, relation string) {
+	if len(locks) == 0 {
+		return
+	}
+
+	sort.Sort(lockInfos(locks))
+
+	now := time.Now()
+	for _, l := range locks {
+		s := LockStatus{
+			ID:       l.id,
+			Type:     l.tp,
+			Names:    l.names,
+			Owner:    l.opts.Owner,
+			Relation: relation,
+			AgeMs:    durationMs(now.Sub(l.createTime)),
+		}
+
+		if l.tp == PathLockType {
+			s.Mode = l.opts.Mode.String()
+		}
+
+		if l.opts.Lease != 0 {
+			if ttl, ok := a.leaseTTL(l.opts.Lease); ok {
+				s.TTLMs = durationMs(ttl)
+			}
+		}
+
+		st.Locks = append(st.Locks, s)
+	}
+
+	if relation == "self" {
+		st.State = StatusHeld
+	} else if st.State == StatusFree {
+		st.State = StatusBlocked
+	}
+}
+
+type statusHandler struct {
+	a *App
+}
+
+func (a *App) newStatusHandler() *statusHandler {
+	h := new(statusHandler)
+	h.a = a
+
+	return h
+}
+
+// Status: Get /lock/status?names=a,b,c&type=key[&sep=/&raw=true]
+// It returns the JSON array of NameStatus, one for each name.
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	tp, names, opts, err := h.a.parseHTTPLock(r)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	statuses, err := h.a.Status(tp, names, opts)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	buf, _ := json.Marshal(statuses)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
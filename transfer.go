@@ -0,0 +1,318 @@
+package tlock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// a transfer waits the receiver to redeem the token
+type transfer struct {
+	token  string
+	lockID uint64
+
+	// the new owner, or the lease of the new session
+	owner string
+	lease uint64
+
+	timer *time.Timer
+}
+
+func genTransferToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInternal, err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Transfer hands the lock over to the owner or the session with the lease,
+// and returns a token, the receiver redeems it with Redeem to own the lock.
+// The lock is not bound to the RESP connection of the sender any more, if
+// the token is not redeemed before the timeout, zero means InfiniteTimeout,
+// the lock is released. A lock can only have one transfer at a time.
+func (a *App) Transfer(id uint64, owner string, lease uint64, timeout time.Duration) (string, error) {
+	if len(owner) == 0 && lease == 0 {
+		return "", invalidArgumentf("empty transfer owner or lease")
+	}
+
+	if a.isShuttingDown() {
+		return "", ErrShuttingDown
+	}
+
+	if timeout <= 0 {
+		timeout = InfiniteTimeout
+	}
+
+	if _, ok := a.locks.Get(id); !ok {
+		return "", ErrNotLocked
+	}
+
+	if lease != 0 && !a.leaseExists(lease) {
+		return "", ErrLeaseNotFound
+	}
+
+	token, err := genTransferToken()
+	if err != nil {
+		return "", err
+	}
+
+	t := &transfer{token: token, lockID: id, owner: owner, lease: lease}
+
+	a.transfersMutex.Lock()
+	defer a.transfersMutex.Unlock()
+
+	if _, ok := a.transferLocks[id]; ok {
+		return "", invalidArgumentf("lock %d is being transferred", id)
+	}
+
+	a.transfers[token] = t
+	a.transferLocks[id] = token
+	atomic.AddInt32(&a.transferCount, 1)
+	t.timer = time.AfterFunc(timeout, func() {
+		if _, err := a.takeTransfer(token, ""); err == nil {
+			a.unlock(id, AuditExpire)
+		}
+	})
+
+	// the receiver owns it now, the disconnect of the sender, whichever
+	// connection or HTTP sends the transfer, must not release it
+	a.unbindLock(id)
+
+	return token, nil
+}
+
+// takeTransfer removes the transfer of the token, the owner must be the one
+// of the transfer if not empty.
+func (a *App) takeTransfer(token string, owner string) (*transfer, error) {
+	a.transfersMutex.Lock()
+	defer a.transfersMutex.Unlock()
+
+	t, ok := a.transfers[token]
+	if !ok {
+		return nil, invalidArgumentf("invalid or expired transfer token")
+	}
+
+	if len(owner) > 0 && len(t.owner) > 0 && owner != t.owner {
+		return nil, ErrNotOwner
+	}
+
+	delete(a.transfers, token)
+	delete(a.transferLocks, t.lockID)
+	atomic.AddInt32(&a.transferCount, -1)
+	return t, nil
+}
+
+// cancelTransfer drops the transfer of the lock when it is unlocked
+func (a *App) cancelTransfer(id uint64) {
+	if atomic.LoadInt32(&a.transferCount) == 0 {
+		return
+	}
+
+	a.transfersMutex.Lock()
+	token, ok := a.transferLocks[id]
+	a.transfersMutex.Unlock()
+
+	if ok {
+		if t, err := a.takeTransfer(token, ""); err == nil {
+			t.timer.Stop()
+		}
+	}
+}
+
+// Redeem takes the lock of the transfer token and returns the lock id,
+// the lock owner is changed to the one of the transfer, and the lock leaves
+// its lease, or moves to the lease of the transfer, so the sender can not
+// release it any more, a detached lock is not detached any more either.
+// A lock moved to a lease is a session lock, see LockOptions Session.
+// If the owner is not empty, it must be the owner of
+// the transfer, or ErrNotOwner is returned.
+func (a *App) Redeem(token string, owner string) (uint64, error) {
+	l, err := a.redeem(token, owner)
+	if err != nil {
+		return 0, err
+	}
+	return l.id, nil
+}
+
+// redeem is like Redeem, but returns the redeemed lock
+func (a *App) redeem(token string, owner string) (*lockInfo, error) {
+	t, err := a.takeTransfer(token, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	t.timer.Stop()
+
+	id := t.lockID
+	l, ok := a.locks.Get(id)
+	if !ok {
+		return nil, ErrNotLocked
+	}
+
+	if err := a.moveLease(id, l.opts.Lease, t.lease); err != nil {
+		if err == ErrLeaseNotFound {
+			// no one owns the lock now
+			a.unlock(id, AuditExpire)
+		}
+		return nil, err
+	}
+
+	for {
+		n := *l
+		if len(t.owner) > 0 {
+			n.opts.Owner = t.owner
+		}
+		n.opts.Lease = t.lease
+		n.opts.Detach = 0
+		// the receiving session holds it, not the redeeming connection
+		n.opts.Session = t.lease != 0
+
+		if a.locks.Replace(l, &n) {
+			if l.opts.Detach > 0 {
+				// the lock left its own lease
+				a.dropLease(l.opts.Lease)
+			}
+			a.lockEvent(AuditTransfer, &n)
+			return &n, nil
+		}
+
+		// extended or shrunk by others at the same time
+		if l, ok = a.locks.Get(id); !ok {
+			if t.lease != 0 {
+				a.detachLease(t.lease, id)
+			}
+			return nil, ErrNotLocked
+		}
+	}
+}
+
+// parseRESPTransfer parses
+//
+//	lockid TO owner|LEASE leaseid [TIMEOUT 60 | PXTIMEOUT 60000]
+func (a *App) parseRESPTransfer(args [][]byte) (id uint64, owner string, lease uint64, timeout time.Duration, err error) {
+	if len(args) < 3 || strings.ToUpper(string(args[1])) != "TO" {
+		err = invalidArgumentf("invalid transfer, must be lockid TO owner|LEASE leaseid")
+		return
+	}
+
+	if id, err = parseID(string(args[0])); err != nil {
+		return
+	}
+
+	args = args[2:]
+	if strings.ToUpper(string(args[0])) == "LEASE" {
+		if len(args) < 2 {
+			err = invalidArgumentf("empty lease id")
+			return
+		}
+		if lease, err = parseID(string(args[1])); err != nil {
+			return
+		}
+		args = args[2:]
+	} else {
+		owner = string(args[0])
+		args = args[1:]
+	}
+
+	var opts LockOptions
+	var tp string
+	for i := 0; i < len(args); i += 2 {
+		s := strings.ToUpper(string(args[i]))
+		if s != "TIMEOUT" && s != "PXTIMEOUT" {
+			err = invalidArgumentf("invalid transfer option %s", args[i])
+			return
+		}
+		if i+1 >= len(args) {
+			err = invalidArgumentf("empty %s value", s)
+			return
+		}
+		if err = parseRESPLockOption(s, args[i+1], &tp, &opts); err != nil {
+			return
+		}
+	}
+
+	timeout = a.requestTimeout(opts.Timeout)
+	return
+}
+
+// parseRESPRedeem parses
+//
+//	token [OWNER owner]
+func (a *App) parseRESPRedeem(args [][]byte) (token string, owner string, err error) {
+	switch {
+	case len(args) == 1:
+	case len(args) == 3 && strings.ToUpper(string(args[1])) == "OWNER":
+		owner = string(args[2])
+	default:
+		return "", "", invalidArgumentf("invalid redeem, must be token [OWNER owner]")
+	}
+
+	return string(args[0]), owner, nil
+}
+
+type transferHandler struct {
+	a      *App
+	redeem bool
+}
+
+func (a *App) newTransferHandler(redeem bool) *transferHandler {
+	h := new(transferHandler)
+	h.a = a
+	h.redeem = redeem
+
+	return h
+}
+
+// Transfer: Post/Put /lock/transfer?id=lockid&to=owner[&lease=leaseid&timeout=10]
+// It returns the token, the receiver redeems it with
+// Redeem: Post/Put /lock/redeem?token=token[&owner=owner]
+// which returns the lock id, see App Transfer and Redeem.
+func (h *transferHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var v string
+	var err error
+	if h.redeem {
+		var id uint64
+		id, err = h.a.Redeem(r.FormValue("token"), r.FormValue("owner"))
+		v = strconv.FormatUint(id, 10)
+	} else {
+		v, err = h.transfer(r)
+	}
+
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(v))
+}
+
+func (h *transferHandler) transfer(r *http.Request) (string, error) {
+	id, err := parseID(r.FormValue("id"))
+	if err != nil {
+		return "", err
+	}
+
+	var lease uint64
+	if v := r.FormValue("lease"); len(v) > 0 {
+		if lease, err = parseID(v); err != nil {
+			return "", err
+		}
+	}
+
+	t, _ := strconv.Atoi(r.FormValue("timeout"))
+	timeout := h.a.requestTimeout(time.Duration(t) * time.Second)
+
+	return h.a.Transfer(id, r.FormValue("to"), lease, timeout)
+}
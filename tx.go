@@ -0,0 +1,544 @@
+package tlock
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the commands allowed in a transaction
+const (
+	TxLock   = "LOCK"
+	TxUnlock = "UNLOCK"
+	TxExtend = "EXTEND"
+	TxRenew  = "RENEW"
+)
+
+// TxOp is a command in a transaction, see App Exec
+type TxOp struct {
+	// TxLock, TxUnlock, TxExtend or TxRenew
+	Cmd string
+
+	// the lock id to unlock or extend, or the lease id to renew
+	ID uint64
+
+	// the lock type, names and options to lock, extend uses the names
+	// and the timeout only
+	Type    string
+	Names   []string
+	Options LockOptions
+}
+
+// txStep is a lock or extend in a transaction
+type txStep struct {
+	index int
+
+	tp    string
+	group LockerGroup
+	names []string
+	opts  LockOptions
+
+	// the lock to extend
+	l *lockInfo
+	// the names to add to the lock, extend only
+	extra []string
+
+	// the names to lock, the others are handed over
+	left []string
+
+	wait time.Duration
+}
+
+// txGroup is the names locked by the steps in a locker group, they are
+// locked together, see Exec.
+type txGroup struct {
+	tp    string
+	group LockerGroup
+	steps []*txStep
+
+	names []string
+	// the names held by the locks to extend
+	held []string
+
+	// lock without waiting, see txLockSpace
+	try    bool
+	locked bool
+}
+
+// txTryLocker is implemented by the groups locked without waiting
+// in a transaction, see Exec.
+type txTryLocker interface {
+	// returns an error wrapping ErrLockTimeout at once if any is locked
+	tryLock(names ...string) error
+}
+
+// txHandoff is a lock to unlock, its names can be handed over
+// to the locks and extends in the same transaction.
+type txHandoff struct {
+	l *lockInfo
+
+	// the names not handed over yet, canonical for path
+	names map[string]struct{}
+}
+
+// takeHandoffs hands the names over from the locks to unlock, returns the
+// names left to lock.
+func takeHandoffs(handoffs []*txHandoff, tp string, group LockerGroup, names []string) []string {
+	if tp != KeyLockType && tp != PathLockType {
+		return names
+	}
+
+	left := make([]string, 0, len(names))
+next:
+	for _, name := range names {
+		for _, h := range handoffs {
+			if h.l.tp != tp || !sameLockerGroup(h.l.group, group) {
+				continue
+			}
+			if _, ok := h.names[name]; ok {
+				delete(h.names, name)
+				continue next
+			}
+		}
+		left = append(left, name)
+	}
+	return left
+}
+
+// sameLockerGroup returns true if the names locked in a group
+// can be unlocked in the other.
+func sameLockerGroup(a LockerGroup, b LockerGroup) bool {
+	if a == b {
+		return true
+	}
+
+	pa, ok := a.(*pathModeLockerGroup)
+	if !ok {
+		return false
+	}
+	pb, ok := b.(*pathModeLockerGroup)
+	return ok && *pa == *pb
+}
+
+// txNames returns the names to lock or hand over, canonical for path
+func txNames(tp string, group LockerGroup, names []string) ([]string, error) {
+	switch tp {
+	case KeyLockType:
+		return removeDuplicatedItems(names...), nil
+	case PathLockType:
+		return group.(*pathModeLockerGroup).g.NormalizePaths(names...)
+	default:
+		return names, nil
+	}
+}
+
+// txLockSpace returns the space of the names locked in a group, the groups
+// in a space conflict with each other, like a key and a range containing it,
+// or a path in any mode and a glob matching it, and the groups in different
+// spaces never conflict.
+func txLockSpace(group LockerGroup) string {
+	switch g := group.(type) {
+	case *pathModeLockerGroup:
+		return fmt.Sprintf("path %s %t", g.g.sep, g.g.raw)
+	case *globLockerGroup:
+		return fmt.Sprintf("path %s %t", g.g.sep, g.g.raw)
+	default:
+		return "key"
+	}
+}
+
+// txGroupOrder returns the order to lock the groups in a transaction,
+// all transactions lock the groups in the same order.
+func txGroupOrder(tp string, group LockerGroup) string {
+	switch g := group.(type) {
+	case *pathModeLockerGroup:
+		return fmt.Sprintf("%s %s %s", txLockSpace(group), tp, g.mode)
+	default:
+		return fmt.Sprintf("%s %s", txLockSpace(group), tp)
+	}
+}
+
+// checkOverlap returns the name locked twice in the group, a path under
+// another path is locked twice too, the ranges are not checked.
+func (g *txGroup) checkOverlap() (string, bool) {
+	if g.tp == RangeLockType {
+		return "", false
+	}
+
+	names := append([]string(nil), g.names...)
+	sort.Strings(names)
+	for i := 1; i < len(names); i++ {
+		if names[i] == names[i-1] {
+			return names[i], true
+		}
+		// the paths are canonical, and a path sorts right after its
+		// ancestor or the descendants of the ancestor
+		if g.tp == PathLockType && strings.HasPrefix(names[i], names[i-1]) {
+			return names[i], true
+		}
+	}
+	return "", false
+}
+
+func txErrorf(index int, cmd string, err error) error {
+	return fmt.Errorf("command %d %s: %w", index+1, cmd, err)
+}
+
+// Exec runs the commands in a transaction, all or none of them take effect,
+// and returns the lock id of each TxLock, zero for the others.
+//
+// The leases are renewed first, then the names of TxLock and TxExtend are
+// merged per locker group and locked in order, like a Lock with all the
+// names, at last the locks are granted, extended and unlocked together, so
+// others never see a part of them. A group waits at most the shortest timeout
+// of its commands. The groups conflicting with each other, like key and range,
+// or path and glob, can not be locked in one order, so only the first of them
+// with names to lock waits, the others are locked without waiting, and an
+// error wrapping ErrLockTimeout is returned at once if any name is locked,
+// so two transactions never deadlock.
+// If a command fails, the names locked by the transaction are released, and
+// the error tells which command fails. A name locked by two commands is an
+// error.
+//
+// The names held by the locks to unlock are handed over to TxLock and TxExtend
+// of the same type and options without releasing, so unlocking a and locking
+// a, b in a transaction never lets others lock a in the middle. The other
+// names are locked like Lock, waiting a name held by the transaction in
+// another way, like in a different mode, times out.
+func (a *App) Exec(ops []TxOp) ([]uint64, error) {
+	if len(ops) == 0 {
+		return nil, invalidArgumentf("empty transaction")
+	}
+
+	if a.isShuttingDown() {
+		return nil, ErrShuttingDown
+	}
+
+	var (
+		steps    []*txStep
+		handoffs []*txHandoff
+		releases = make(map[uint64]int)
+		extends  = make(map[uint64]int)
+	)
+
+	for i := range ops {
+		op := &ops[i]
+		cmd := strings.ToUpper(op.Cmd)
+
+		switch cmd {
+		case TxLock:
+			if len(op.Names) == 0 {
+				return nil, txErrorf(i, cmd, invalidArgumentf("empty lock names"))
+			}
+
+			tp := strings.ToLower(op.Type)
+			group, err := a.lockGroup(tp, op.Options)
+			if err != nil {
+				return nil, txErrorf(i, cmd, err)
+			}
+
+			if err := op.Options.checkLease(); err != nil {
+				return nil, txErrorf(i, cmd, err)
+			}
+
+			if op.Options.Lease != 0 && !a.leaseExists(op.Options.Lease) {
+				return nil, txErrorf(i, cmd, ErrLeaseNotFound)
+			}
+
+			steps = append(steps, &txStep{index: i, tp: tp, group: group, names: op.Names, opts: op.Options})
+		case TxUnlock, TxExtend:
+			if op.ID == 0 {
+				return nil, txErrorf(i, cmd, invalidArgumentf("empty lock id"))
+			}
+
+			l, ok := a.locks.Get(op.ID)
+			if !ok {
+				return nil, txErrorf(i, cmd, ErrNotLocked)
+			}
+
+			if _, ok := releases[op.ID]; ok {
+				return nil, txErrorf(i, cmd, invalidArgumentf("lock %d is unlocked in the transaction", op.ID))
+			}
+			if _, ok := extends[op.ID]; ok {
+				return nil, txErrorf(i, cmd, invalidArgumentf("lock %d is extended in the transaction", op.ID))
+			}
+
+			if cmd == TxUnlock {
+				releases[op.ID] = i
+				handoffs = append(handoffs, &txHandoff{l: l})
+				continue
+			}
+
+			if len(op.Names) == 0 {
+				return nil, txErrorf(i, cmd, invalidArgumentf("empty names"))
+			}
+
+			extra, err := l.extraNames(op.Names)
+			if err != nil {
+				return nil, txErrorf(i, cmd, err)
+			}
+
+			extends[op.ID] = i
+			steps = append(steps, &txStep{index: i, tp: l.tp, group: l.group, names: op.Names, opts: op.Options, l: l, extra: extra})
+		case TxRenew:
+			if op.ID == 0 {
+				return nil, txErrorf(i, cmd, invalidArgumentf("empty lease id"))
+			}
+		default:
+			return nil, txErrorf(i, cmd, invalidArgumentf("command %s is not allowed in a transaction", op.Cmd))
+		}
+	}
+
+	for _, h := range handoffs {
+		if h.l.tp != KeyLockType && h.l.tp != PathLockType {
+			continue
+		}
+
+		names, err := txNames(h.l.tp, h.l.group, h.l.names)
+		if err != nil {
+			return nil, txErrorf(releases[h.l.id], TxUnlock, err)
+		}
+
+		h.names = make(map[string]struct{}, len(names))
+		for _, name := range names {
+			h.names[name] = struct{}{}
+		}
+	}
+
+	// renew first, so the leases don't expire when waiting the locks
+	for i := range ops {
+		if strings.ToUpper(ops[i].Cmd) == TxRenew {
+			if err := a.RenewLease(ops[i].ID); err != nil {
+				return nil, txErrorf(i, TxRenew, err)
+			}
+		}
+	}
+
+	var groups []*txGroup
+	for _, s := range steps {
+		if err := s.takeHandoffs(handoffs); err != nil {
+			return nil, txErrorf(s.index, strings.ToUpper(ops[s.index].Cmd), err)
+		}
+
+		var g *txGroup
+		for _, v := range groups {
+			if v.tp == s.tp && sameLockerGroup(v.group, s.group) {
+				g = v
+				break
+			}
+		}
+		if g == nil {
+			g = &txGroup{tp: s.tp, group: s.group}
+			groups = append(groups, g)
+		}
+
+		g.steps = append(g.steps, s)
+		g.names = append(g.names, s.left...)
+		if s.l != nil {
+			g.held = append(g.held, s.l.names...)
+		}
+
+		if name, ok := g.checkOverlap(); ok {
+			return nil, txErrorf(s.index, strings.ToUpper(ops[s.index].Cmd), invalidArgumentf("%s is locked twice in the transaction", name))
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return txGroupOrder(groups[i].tp, groups[i].group) < txGroupOrder(groups[j].tp, groups[j].group)
+	})
+
+	// waiting a group while holding another in the same space may deadlock
+	waited := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		if len(g.names) == 0 {
+			continue
+		}
+
+		space := txLockSpace(g.group)
+		g.try = waited[space]
+		waited[space] = true
+	}
+
+	rollback := func() {
+		for i := len(groups) - 1; i >= 0; i-- {
+			if groups[i].locked {
+				groups[i].group.Unlock(groups[i].names...)
+			}
+		}
+	}
+
+	for _, g := range groups {
+		if s, err := a.lockTxGroup(g); err != nil {
+			rollback()
+			return nil, txErrorf(s.index, strings.ToUpper(ops[s.index].Cmd), err)
+		}
+	}
+
+	if a.isShuttingDown() {
+		// we waited the locks when shutting down
+		rollback()
+		return nil, ErrShuttingDown
+	}
+
+	ids := make([]uint64, len(ops))
+
+	var (
+		adds     []*lockInfo
+		replaces [][2]*lockInfo
+		removes  = make([]*lockInfo, 0, len(handoffs))
+
+		// the steps of the replaces
+		extended []*txStep
+	)
+
+	for _, s := range steps {
+		if s.l == nil {
+			id := a.genLockID()
+			if s.opts.Detach > 0 {
+				s.opts.Lease = id
+			}
+
+			l := newLockInfo(id, s.tp, s.group, s.names, s.opts)
+			l.wait = s.wait
+
+			ids[s.index] = id
+			adds = append(adds, l)
+		} else {
+			n := s.l.withNames(append(append([]string(nil), s.l.names...), s.extra...))
+			replaces = append(replaces, [2]*lockInfo{s.l, n})
+			extended = append(extended, s)
+		}
+	}
+
+	for _, h := range handoffs {
+		removes = append(removes, h.l)
+	}
+
+	if !a.locks.Commit(adds, replaces, removes) {
+		// unlocked, like the lease expires, or changed by others when waiting
+		rollback()
+		return nil, fmt.Errorf("%w: the locks are changed by others in the transaction", ErrNotLocked)
+	}
+
+	for _, h := range handoffs {
+		a.leaveLease(h.l)
+		a.cancelTransfer(h.l.id)
+
+		a.lockEvent(AuditRelease, h.l)
+	}
+
+	for _, l := range adds {
+		a.lockEvent(AuditGrant, l)
+	}
+
+	for i, p := range replaces {
+		e := p[1].withNames(extended[i].extra)
+		e.wait = extended[i].wait
+		a.lockEvent(AuditExtend, e)
+	}
+
+	// release the names not handed over
+	for _, h := range handoffs {
+		if h.names == nil {
+			// never handed over, like a range lock
+			h.l.group.Unlock(h.l.names...)
+			continue
+		}
+		if len(h.names) == 0 {
+			continue
+		}
+
+		names := make([]string, 0, len(h.names))
+		for name := range h.names {
+			names = append(names, name)
+		}
+		h.l.group.Unlock(names...)
+	}
+
+	for _, l := range adds {
+		if l.opts.Detach > 0 {
+			a.grantDetachedLease(l.id, l.opts.Detach)
+			continue
+		}
+
+		// the lease may expire when we wait the locks
+		if l.opts.Lease != 0 {
+			if err := a.attachLease(l.opts.Lease, l.id); err != nil {
+				a.unlock(l.id, AuditExpire)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// takeHandoffs sets the names of the step not handed over
+func (s *txStep) takeHandoffs(handoffs []*txHandoff) error {
+	names := s.extra
+	if s.l == nil {
+		var err error
+		if names, err = txNames(s.tp, s.group, s.names); err != nil {
+			return err
+		}
+	}
+
+	s.left = takeHandoffs(handoffs, s.tp, s.group, names)
+	return nil
+}
+
+// lockTxGroup locks the names of the group, the names sorting before the
+// held names of the extended locks are not waited, see Extend. It returns
+// the step failing the group, whose timeout is the shortest.
+func (a *App) lockTxGroup(g *txGroup) (*txStep, error) {
+	var (
+		timeout time.Duration
+		failed  = g.steps[0]
+	)
+	for _, s := range g.steps {
+		if s.opts.Timeout > 0 && (timeout <= 0 || s.opts.Timeout < timeout) {
+			timeout = s.opts.Timeout
+			failed = s
+		}
+	}
+	if timeout <= 0 {
+		timeout = InfiniteTimeout
+	}
+
+	start := time.Now()
+	if len(g.names) > 0 {
+		var err error
+		if g.try {
+			err = g.group.(txTryLocker).tryLock(g.names...)
+		} else if len(g.held) > 0 {
+			err = g.group.(extendLocker).extendTimeout(g.held, timeout, g.names...)
+		} else {
+			err = g.group.LockTimeout(timeout, g.names...)
+		}
+
+		if err != nil {
+			if errors.Is(err, ErrLockTimeout) {
+				for _, s := range g.steps {
+					if len(s.left) == 0 {
+						continue
+					}
+
+					l := newLockInfo(0, s.tp, s.group, s.left, s.opts)
+					if s.l != nil {
+						l = s.l.withNames(s.left)
+					}
+					l.wait = time.Since(start)
+					a.lockEvent(AuditTimeout, l)
+				}
+			}
+			return failed, err
+		}
+	}
+
+	g.locked = true
+	for _, s := range g.steps {
+		s.wait = time.Since(start)
+	}
+	return nil, nil
+}
@@ -1,6 +1,7 @@
 package tlock
 
 import (
+	"hash/crc32"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -35,3 +36,16 @@ func LockWithTimer(m sync.Locker, timer *time.Timer) bool {
 		return false
 	}
 }
+
+// durationToMs returns the milliseconds of d, rounded up,
+// so a positive duration is never sent as 0 which means the default timeout.
+func durationToMs(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// HashFunc hashes a lock name to choose the slot of a lock group
+type HashFunc func(name string) uint32
+
+func crc32Hash(name string) uint32 {
+	return crc32.ChecksumIEEE([]byte(name))
+}
@@ -0,0 +1,425 @@
+package tlock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/siddontang/goredis"
+)
+
+// the events buffered for a watcher, a watcher is closed
+// if it can not keep up with the events.
+const watchEventBufferSize = 1024
+
+// WatchEvent is pushed to the watchers when a lock on the watched names is
+// granted or released, the events are the same as the audit log except
+// AuditTimeout, which does not change any lock.
+type WatchEvent struct {
+	Time  time.Time  `json:"time"`
+	Event AuditEvent `json:"event"`
+
+	ID    uint64   `json:"id,string"`
+	Type  string   `json:"type"`
+	Names []string `json:"names"`
+	Owner string   `json:"owner,omitempty"`
+}
+
+// Watcher receives the events of the locks on the watched names,
+// a key watcher watches the key locks on the keys and the range locks
+// containing the keys, a path watcher watches the path and glob locks
+// on the paths, their ancestors and their descendants.
+type Watcher struct {
+	hub *watchHub
+
+	tp string
+
+	keys map[string]struct{}
+
+	// path watcher only
+	g     *PathLockerGroup
+	paths []string
+	segs  [][]string
+
+	m          sync.Mutex
+	ch         chan *WatchEvent
+	closed     bool
+	overflowed bool
+}
+
+// Events returns the channel of the events, it is closed when the watcher
+// is closed, or overflowed if the receiver can not keep up with the events.
+func (w *Watcher) Events() <-chan *WatchEvent {
+	return w.ch
+}
+
+// Overflowed returns true if the watcher is closed because the events are not
+// received in time, some events are lost, the receiver should check the
+// locks and watch again.
+func (w *Watcher) Overflowed() bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.overflowed
+}
+
+// Close stops watching and closes the events channel
+func (w *Watcher) Close() {
+	w.hub.remove(w)
+	w.close()
+}
+
+func (w *Watcher) close() {
+	w.m.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+	w.m.Unlock()
+}
+
+func (w *Watcher) send(e *WatchEvent) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	select {
+	case w.ch <- e:
+	default:
+		w.closed = true
+		w.overflowed = true
+		close(w.ch)
+	}
+}
+
+func (w *Watcher) match(l *lockInfo) bool {
+	switch w.tp {
+	case KeyLockType:
+		switch l.tp {
+		case KeyLockType:
+			for _, name := range l.names {
+				if _, ok := w.keys[name]; ok {
+					return true
+				}
+			}
+		case RangeLockType:
+			for i := 0; i+1 < len(l.names); i += 2 {
+				r := keyRange{l.names[i], l.names[i+1]}
+				for key := range w.keys {
+					if r.intersects(pointRange(key)) {
+						return true
+					}
+				}
+			}
+		}
+	case PathLockType:
+		// paths in different groups never conflict
+		switch g := l.group.(type) {
+		case *pathModeLockerGroup:
+			if g.g != w.g {
+				return false
+			}
+		case *globLockerGroup:
+			if g.g != w.g {
+				return false
+			}
+		default:
+			return false
+		}
+
+		switch l.tp {
+		case PathLockType:
+			for _, name := range l.names {
+				p := w.g.canonicalizePath(name)
+				for _, wp := range w.paths {
+					if strings.HasPrefix(p, wp) || strings.HasPrefix(wp, p) {
+						return true
+					}
+				}
+			}
+		case GlobLockType:
+			globs, err := w.g.normalizeGlobs(l.names...)
+			if err != nil {
+				return false
+			}
+			for _, glob := range globs {
+				for _, segs := range w.segs {
+					if globConflictsPath(glob, segs) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+type watchHub struct {
+	m        sync.RWMutex
+	watchers map[*Watcher]struct{}
+	closed   bool
+
+	// the number of the watchers, so publishing is cheap without watchers
+	n int32
+}
+
+func newWatchHub() *watchHub {
+	h := new(watchHub)
+	h.watchers = make(map[*Watcher]struct{})
+	return h
+}
+
+func (h *watchHub) add(w *Watcher) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if h.closed {
+		return ErrShuttingDown
+	}
+
+	h.watchers[w] = struct{}{}
+	atomic.AddInt32(&h.n, 1)
+	return nil
+}
+
+func (h *watchHub) remove(w *Watcher) {
+	h.m.Lock()
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		atomic.AddInt32(&h.n, -1)
+	}
+	h.m.Unlock()
+}
+
+func (h *watchHub) publish(event AuditEvent, l *lockInfo) {
+	if atomic.LoadInt32(&h.n) == 0 {
+		return
+	}
+
+	e := &WatchEvent{
+		Time:  time.Now(),
+		Event: event,
+		ID:    l.id,
+		Type:  l.tp,
+		Names: l.names,
+		Owner: l.opts.Owner,
+	}
+
+	h.m.RLock()
+	for w := range h.watchers {
+		if w.match(l) {
+			w.send(e)
+		}
+	}
+	h.m.RUnlock()
+}
+
+// close closes all the watchers, no watcher can be added then
+func (h *watchHub) close() {
+	h.m.Lock()
+	h.closed = true
+	watchers := h.watchers
+	h.watchers = make(map[*Watcher]struct{})
+	atomic.StoreInt32(&h.n, 0)
+	h.m.Unlock()
+
+	for w := range watchers {
+		w.close()
+	}
+}
+
+// Watch watches the locks on the names without locking them, tp is key or
+// path, for path, the Separator and Raw in opts choose the path group like
+// LockWithOptions, and the other options are ignored, see Watcher.
+func (a *App) Watch(tp string, names []string, opts LockOptions) (*Watcher, error) {
+	if len(names) == 0 {
+		return nil, invalidArgumentf("empty watch names")
+	}
+
+	w := new(Watcher)
+	w.hub = a.watches
+	w.tp = strings.ToLower(tp)
+
+	switch w.tp {
+	case KeyLockType:
+		w.keys = make(map[string]struct{}, len(names))
+		for _, name := range names {
+			w.keys[name] = struct{}{}
+		}
+	case PathLockType:
+		w.g = a.getPathLockerGroup(opts.Separator, opts.Raw)
+		paths, err := w.g.NormalizePaths(names...)
+		if err != nil {
+			return nil, err
+		}
+		w.paths = paths
+		w.segs = make([][]string, len(paths))
+		for i, p := range paths {
+			w.segs[i] = pathSegments(p, w.g.sep)
+		}
+	default:
+		return nil, invalidArgumentf("can not watch %s, must be key or path", tp)
+	}
+
+	w.ch = make(chan *WatchEvent, watchEventBufferSize)
+
+	if err := a.watches.add(w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// handleRESPWatch handles
+//
+//	WATCH [TYPE key] [SEP /] [RAW 0] NAMES name1 name2 ...
+//
+// it replies OK, then pushes the events as ["event", json of WatchEvent],
+// and ["overflow"] if the watcher is overflowed. No other command but
+// UNWATCH, which replies OK after the last event, is allowed when watching.
+// It returns false if the connection is broken.
+func (a *App) handleRESPWatch(conn *goredis.Conn, args [][]byte) bool {
+	tp, names, opts, err := a.parseRESPLockArgs(args)
+	if err != nil {
+		return conn.SendValue(respError(err)) == nil
+	}
+
+	w, err := a.Watch(tp, names, opts)
+	if err != nil {
+		return conn.SendValue(respError(err)) == nil
+	}
+	defer w.Close()
+
+	var m sync.Mutex
+	send := func(v interface{}) error {
+		m.Lock()
+		defer m.Unlock()
+		return conn.SendValue(v)
+	}
+
+	if err := send("OK"); err != nil {
+		return false
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for e := range w.Events() {
+			buf, _ := json.Marshal(e)
+			if err := send([][]byte{[]byte("event"), buf}); err != nil {
+				return
+			}
+		}
+
+		if w.Overflowed() {
+			send([][]byte{[]byte("overflow")})
+		}
+	}()
+
+	for {
+		args, err := conn.ReceiveRequest()
+		if err != nil {
+			w.Close()
+			<-done
+			return false
+		}
+
+		if len(args) > 0 && strings.ToUpper(string(args[0])) == "UNWATCH" {
+			w.Close()
+			<-done
+			return send("OK") == nil
+		}
+
+		send(respError(invalidArgumentf("only UNWATCH is allowed when watching")))
+	}
+}
+
+type watchHandler struct {
+	a *App
+}
+
+func (a *App) newWatchHandler() *watchHandler {
+	h := new(watchHandler)
+	h.a = a
+
+	return h
+}
+
+// Watch: Get /lock/watch?names=a,b,c&type=key[&sep=/&raw=true]
+// It streams the events as server-sent events, like
+//
+//	event: release
+//	data: {"time":"...","event":"release","id":"1","type":"key","names":["a"]}
+//
+// until the client disconnects, an overflow event is sent before closing
+// the stream if the client can not keep up with the events.
+func (h *watchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHTTPError(w, fmt.Errorf("%w: streaming is not supported", ErrInternal))
+		return
+	}
+
+	tp := r.FormValue("type")
+	if len(tp) == 0 {
+		tp = KeyLockType
+	}
+
+	opts := LockOptions{Separator: r.FormValue("sep")}
+	if v := r.FormValue("raw"); len(v) > 0 {
+		var err error
+		opts.Raw, err = strconv.ParseBool(v)
+		if err != nil {
+			writeHTTPError(w, invalidArgumentf("invalid raw %s", v))
+			return
+		}
+	}
+
+	var names []string
+	if v := r.FormValue("names"); len(v) > 0 {
+		names = strings.Split(v, ",")
+	}
+
+	watcher, err := h.a.Watch(tp, names, opts)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	defer watcher.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case e, ok := <-watcher.Events():
+			if !ok {
+				if watcher.Overflowed() {
+					fmt.Fprint(w, "event: overflow\ndata: {}\n\n")
+					flusher.Flush()
+				}
+				return
+			}
+
+			buf, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Event, buf)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}